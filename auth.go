@@ -0,0 +1,143 @@
+package post
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+var (
+	errNoPassword             = errors.New("post: server requested a password but none was given")
+	errChannelBindingRequired = errors.New("post: channel binding required but not supported by the server")
+)
+
+// Respond to an authentication request from the server. The response,
+// if any, is flushed so the server can proceed.
+func (c *Conn) authenticate(resp *AuthResponse) (err error) {
+	if c.config.ChannelBinding == ChannelBindingRequire {
+		// only a SASL exchange can bind the channel
+		switch resp.Subtype {
+		case AuthenticationSASL, AuthenticationSASLContinue, AuthenticationSASLFinal:
+		case AuthenticationOk:
+			if c.sasl == nil || c.sasl.cbindData == nil {
+				return errChannelBindingRequired
+			}
+		default:
+			return errChannelBindingRequired
+		}
+	}
+	switch resp.Subtype {
+	case AuthenticationOk:
+		if c.sasl != nil && !c.saslDone {
+			// don't let the server skip proving it knows the password
+			return errors.New("post: server completed SASL authentication without a SASLFinal")
+		}
+		return nil
+	case AuthenticationCleartextPassword:
+		if c.config.Password == "" {
+			return errNoPassword
+		}
+		err = c.proto.SendPasswordMessage(c.config.Password)
+	case AuthenticationMD5Password:
+		if c.config.Password == "" {
+			return errNoPassword
+		}
+		if len(resp.Payload) != 4 {
+			return fmt.Errorf("post: expected 4 byte MD5 salt; got %v", len(resp.Payload))
+		}
+		err = c.proto.SendPasswordMessage(
+			md5Password(c.config.User, c.config.Password, resp.Payload))
+	case AuthenticationSASL:
+		err = c.startSASL(parseSASLMechanisms(resp.Payload))
+	case AuthenticationSASLContinue:
+		if c.sasl == nil {
+			return errors.New("post: unexpected SASLContinue")
+		}
+		var data []byte
+		data, err = c.sasl.clientFinal(resp.Payload)
+		if err != nil {
+			return err
+		}
+		err = c.proto.SendSASLResponse(data)
+	case AuthenticationSASLFinal:
+		if c.sasl == nil {
+			return errors.New("post: unexpected SASLFinal")
+		}
+		err = c.sasl.verifyServerFinal(resp.Payload)
+		if err == nil {
+			c.saslDone = true
+		}
+		return err
+	default:
+		return fmt.Errorf("post: unsupported authentication method %v", resp.Subtype)
+	}
+	if err != nil {
+		return err
+	}
+	return c.proto.Flush()
+}
+
+// Begin a SASL exchange using the strongest mechanism we support out of
+// those offered by the server.
+func (c *Conn) startSASL(mechanisms []string) (err error) {
+	if c.config.Password == "" {
+		return errNoPassword
+	}
+	var plain, plus bool
+	for _, mechanism := range mechanisms {
+		switch mechanism {
+		case scramSHA256:
+			plain = true
+		case scramSHA256Plus:
+			plus = true
+		}
+	}
+	c.sasl, err = newScramClient("", c.config.Password)
+	if err != nil {
+		return err
+	}
+	state, usingTLS := c.tlsState()
+	binding := c.config.ChannelBinding
+	if usingTLS && plus && binding != ChannelBindingDisable {
+		cbindData, err := tlsServerEndPoint(state)
+		switch {
+		case err == nil:
+			c.sasl.cbindData = cbindData
+			c.sasl.cbindFlag = "p=tls-server-end-point"
+			return c.proto.SendSASLInitialResponse(scramSHA256Plus, c.sasl.clientFirst())
+		case binding == ChannelBindingRequire:
+			return err
+		case !plain:
+			return fmt.Errorf("post: no supported SASL mechanism in %v", mechanisms)
+		}
+		// the certificate has no hash to bind to, e.g., with ed25519;
+		// "y" would claim the server offered no binding, which it
+		// takes for a downgrade attack
+		c.sasl.cbindFlag = "n"
+		return c.proto.SendSASLInitialResponse(scramSHA256, c.sasl.clientFirst())
+	}
+	switch {
+	case binding == ChannelBindingRequire:
+		return errChannelBindingRequired
+	case !plain:
+		return fmt.Errorf("post: no supported SASL mechanism in %v", mechanisms)
+	case usingTLS && binding != ChannelBindingDisable:
+		// we could have bound the channel, but the server did not offer
+		// to; telling it so lets it detect a downgrade attack
+		c.sasl.cbindFlag = "y"
+	default:
+		c.sasl.cbindFlag = "n"
+	}
+	return c.proto.SendSASLInitialResponse(scramSHA256, c.sasl.clientFirst())
+}
+
+// Compute the response to an MD5 password challenge:
+// "md5" + md5(md5(password + user) + salt), with both digests hex-encoded.
+func md5Password(user, password string, salt []byte) string {
+	inner := md5.Sum([]byte(password + user))
+	h := md5.New()
+	h.Write([]byte(hex.EncodeToString(inner[:])))
+	h.Write(salt)
+	return "md5" + hex.EncodeToString(h.Sum(nil))
+}
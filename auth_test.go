@@ -0,0 +1,419 @@
+package post
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"strings"
+	"testing"
+
+	"github.com/msakrejda/post/internal/testcert"
+)
+
+var md5PasswordTests = []struct {
+	user     string
+	password string
+	salt     []byte
+	result   string
+}{
+	{"bob", "sekrit", []byte{0x01, 0x02, 0x03, 0x04}, "md52781846406d91b66813b6aa2f09822c2"},
+	{"postgres", "postgres", []byte{0xde, 0xad, 0xbe, 0xef}, "md58ee245854025535aedb7b15709315318"},
+}
+
+func TestMD5Password(t *testing.T) {
+	for i, tt := range md5PasswordTests {
+		result := md5Password(tt.user, tt.password, tt.salt)
+		if result != tt.result {
+			t.Errorf("%d: want %v; got %v", i, tt.result, result)
+		}
+	}
+}
+
+func TestConnectMD5Password(t *testing.T) {
+	config, done := pipeConfig(t, func(b *fakeBackend) {
+		b.readStartup()
+		// AuthenticationMD5Password with salt 0x01020304
+		b.write([]byte{'R', 0x0, 0x0, 0x0, 0xc, 0x0, 0x0, 0x0, 0x5,
+			0x01, 0x02, 0x03, 0x04})
+		msgType, body := b.readMessage()
+		if msgType != 'p' {
+			t.Errorf("want PasswordMessage; got %q", msgType)
+		}
+		compareBytes(t, []byte{
+			'm', 'd', '5', '2', '7', '8', '1', '8', '4', '6', '4', '0',
+			'6', 'd', '9', '1', 'b', '6', '6', '8', '1', '3', 'b', '6',
+			'a', 'a', '2', 'f', '0', '9', '8', '2', '2', 'c', '2', 0x0,
+		}, body)
+		b.write(authOkMsg)
+		b.write(readyForQueryMsg)
+	})
+	config.Password = "sekrit"
+	c, err := Connect(context.Background(), config)
+	if err != nil {
+		t.Fatalf("want nil err; got %v", err)
+	}
+	<-done
+	c.conn.Close()
+}
+
+func TestConnectMD5PasswordBadSalt(t *testing.T) {
+	config, done := pipeConfig(t, func(b *fakeBackend) {
+		b.readStartup()
+		b.write([]byte{'R', 0x0, 0x0, 0x0, 0xa, 0x0, 0x0, 0x0, 0x5,
+			0x01, 0x02})
+	})
+	config.Password = "sekrit"
+	_, err := Connect(context.Background(), config)
+	if err == nil {
+		t.Error("want error; got nil")
+	}
+	<-done
+}
+
+func TestConnectMD5PasswordMissing(t *testing.T) {
+	config, done := pipeConfig(t, func(b *fakeBackend) {
+		b.readStartup()
+		b.write([]byte{'R', 0x0, 0x0, 0x0, 0xc, 0x0, 0x0, 0x0, 0x5,
+			0x01, 0x02, 0x03, 0x04})
+	})
+	_, err := Connect(context.Background(), config)
+	if err != errNoPassword {
+		t.Errorf("want %v; got %v", errNoPassword, err)
+	}
+	<-done
+}
+
+// The server side of a SCRAM-SHA-256 exchange, for driving the client
+// through the handshake.
+type scramServer struct {
+	t        *testing.T
+	password string
+	salt     []byte
+	nonce    string
+
+	// the expected gs2 header and channel binding data
+	gs2Header string
+	cbindData []byte
+
+	clientFirstBare string
+	serverFirst     string
+}
+
+func (s *scramServer) first(clientFirst string) string {
+	gs2Header := s.gs2Header
+	if gs2Header == "" {
+		gs2Header = "n,,"
+	}
+	if !strings.HasPrefix(clientFirst, gs2Header) {
+		s.t.Errorf("want gs2 header %v; got %v", gs2Header, clientFirst)
+	}
+	s.clientFirstBare = strings.TrimPrefix(clientFirst, gs2Header)
+	s.gs2Header = gs2Header
+	attrs, err := parseScramAttrs(s.clientFirstBare)
+	if err != nil {
+		s.t.Fatalf("want nil err; got %v", err)
+	}
+	s.nonce = attrs['r'] + "serverpart"
+	s.serverFirst = "r=" + s.nonce + ",s=" +
+		base64.StdEncoding.EncodeToString(s.salt) + ",i=4096"
+	return s.serverFirst
+}
+
+func (s *scramServer) final(clientFinal string) string {
+	attrs, err := parseScramAttrs(clientFinal)
+	if err != nil {
+		s.t.Fatalf("want nil err; got %v", err)
+	}
+	if attrs['r'] != s.nonce {
+		s.t.Errorf("want nonce %v; got %v", s.nonce, attrs['r'])
+	}
+	cbind := base64.StdEncoding.EncodeToString(append([]byte(s.gs2Header), s.cbindData...))
+	if attrs['c'] != cbind {
+		s.t.Errorf("want channel binding %v; got %v", cbind, attrs['c'])
+		return "e=channel-bindings-dont-match"
+	}
+	withoutProof := clientFinal[:strings.Index(clientFinal, ",p=")]
+	authMessage := s.clientFirstBare + "," + s.serverFirst + "," + withoutProof
+	salted := scramHi([]byte(s.password), s.salt, 4096)
+	clientKey := scramHMAC(salted, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	signature := scramHMAC(storedKey[:], authMessage)
+	proof, _ := base64.StdEncoding.DecodeString(attrs['p'])
+	for i := range proof {
+		proof[i] ^= signature[i]
+	}
+	if actual := sha256.Sum256(proof); actual != storedKey {
+		return "e=invalid-proof"
+	}
+	serverKey := scramHMAC(salted, "Server Key")
+	return "v=" + base64.StdEncoding.EncodeToString(scramHMAC(serverKey, authMessage))
+}
+
+// Build an AuthenticationRequest message of the given subtype.
+func authMsg(subtype AuthResponseType, payload []byte) []byte {
+	var code [4]byte
+	binary.BigEndian.PutUint32(code[:], uint32(subtype))
+	return backendMsg('R', code[:], payload)
+}
+
+// Read a SASLInitialResponse and return its mechanism and data.
+func (b *fakeBackend) readSASLInitialResponse() (mechanism string, data string) {
+	msgType, body := b.readMessage()
+	if msgType != 'p' {
+		b.t.Errorf("want SASLInitialResponse; got %q", msgType)
+		return "", ""
+	}
+	i := bytes.IndexByte(body, 0)
+	return string(body[:i]), string(body[i+5:])
+}
+
+func serveScram(t *testing.T, b *fakeBackend, server *scramServer, mechanisms string) bool {
+	b.write(authMsg(AuthenticationSASL, []byte(mechanisms+"\x00")))
+	mechanism, data := b.readSASLInitialResponse()
+	expected := scramSHA256
+	if server.cbindData != nil {
+		expected = scramSHA256Plus
+	}
+	if mechanism != expected {
+		t.Errorf("want mechanism %v; got %v", expected, mechanism)
+	}
+	b.write(authMsg(AuthenticationSASLContinue, []byte(server.first(data))))
+	msgType, body := b.readMessage()
+	if msgType != 'p' {
+		t.Errorf("want SASLResponse; got %q", msgType)
+	}
+	final := server.final(string(body))
+	if strings.HasPrefix(final, "e=") {
+		b.write(backendMsg('E',
+			[]byte("SFATAL\x00"),
+			[]byte("C28P01\x00"),
+			[]byte("Mpassword authentication failed for user \"bob\"\x00"),
+			[]byte{0x0}))
+		return false
+	}
+	b.write(authMsg(AuthenticationSASLFinal, []byte(final)))
+	return true
+}
+
+func TestConnectScram(t *testing.T) {
+	config, done := pipeConfig(t, func(b *fakeBackend) {
+		b.readStartup()
+		server := &scramServer{t: t, password: "pencil", salt: []byte("saltsalt")}
+		if serveScram(t, b, server, "SCRAM-SHA-256\x00") {
+			b.write(authOkMsg)
+			b.write(readyForQueryMsg)
+		}
+	})
+	config.Password = "pencil"
+	c, err := Connect(context.Background(), config)
+	if err != nil {
+		t.Fatalf("want nil err; got %v", err)
+	}
+	<-done
+	c.conn.Close()
+}
+
+func TestConnectScramWrongPassword(t *testing.T) {
+	config, done := pipeConfig(t, func(b *fakeBackend) {
+		b.readStartup()
+		server := &scramServer{t: t, password: "pencil", salt: []byte("saltsalt")}
+		if serveScram(t, b, server, "SCRAM-SHA-256\x00") {
+			t.Error("want failed exchange")
+		}
+	})
+	config.Password = "crayon"
+	_, err := Connect(context.Background(), config)
+	if err == nil {
+		t.Error("want error; got nil")
+	}
+	<-done
+}
+
+func TestConnectScramBadServerSignature(t *testing.T) {
+	config, done := pipeConfig(t, func(b *fakeBackend) {
+		b.readStartup()
+		server := &scramServer{t: t, password: "pencil", salt: []byte("saltsalt")}
+		b.write(authMsg(AuthenticationSASL, []byte("SCRAM-SHA-256\x00\x00")))
+		_, data := b.readSASLInitialResponse()
+		b.write(authMsg(AuthenticationSASLContinue, []byte(server.first(data))))
+		b.readMessage()
+		// an impostor server that does not know the password
+		b.write(authMsg(AuthenticationSASLFinal,
+			[]byte("v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=")))
+	})
+	config.Password = "pencil"
+	_, err := Connect(context.Background(), config)
+	if err == nil {
+		t.Error("want error; got nil")
+	}
+	<-done
+}
+
+func TestConnectScramSkippedFinal(t *testing.T) {
+	config, done := pipeConfig(t, func(b *fakeBackend) {
+		b.readStartup()
+		server := &scramServer{t: t, password: "pencil", salt: []byte("saltsalt")}
+		b.write(authMsg(AuthenticationSASL, []byte("SCRAM-SHA-256\x00\x00")))
+		_, data := b.readSASLInitialResponse()
+		b.write(authMsg(AuthenticationSASLContinue, []byte(server.first(data))))
+		b.readMessage()
+		b.write(authOkMsg)
+	})
+	config.Password = "pencil"
+	_, err := Connect(context.Background(), config)
+	if err == nil {
+		t.Error("want error; got nil")
+	}
+	<-done
+}
+
+func TestConnectSASLUnsupportedMechanism(t *testing.T) {
+	config, done := pipeConfig(t, func(b *fakeBackend) {
+		b.readStartup()
+		b.write(authMsg(AuthenticationSASL, []byte("SCRAM-SHA-512\x00\x00")))
+	})
+	config.Password = "pencil"
+	_, err := Connect(context.Background(), config)
+	if err == nil {
+		t.Error("want error; got nil")
+	}
+	<-done
+}
+
+var channelBindingTests = []struct {
+	binding    ChannelBinding
+	mechanisms string
+	gs2Header  string
+	bound      bool
+}{
+	{ChannelBindingPrefer, "SCRAM-SHA-256-PLUS\x00SCRAM-SHA-256\x00", "p=tls-server-end-point,,", true},
+	{ChannelBindingRequire, "SCRAM-SHA-256-PLUS\x00SCRAM-SHA-256\x00", "p=tls-server-end-point,,", true},
+	{ChannelBindingPrefer, "SCRAM-SHA-256\x00", "y,,", false},
+	{ChannelBindingDisable, "SCRAM-SHA-256-PLUS\x00SCRAM-SHA-256\x00", "n,,", false},
+}
+
+func TestConnectScramChannelBinding(t *testing.T) {
+	cert, tlsConfig := testcert.New(t)
+	endPoint := sha256.Sum256(cert.Leaf.Raw)
+	for i, tt := range channelBindingTests {
+		config, done := pipeConfig(t, func(b *fakeBackend) {
+			b = b.acceptTLS(cert)
+			b.readStartup()
+			server := &scramServer{t: t, password: "pencil", salt: []byte("saltsalt"),
+				gs2Header: tt.gs2Header}
+			if tt.bound {
+				server.cbindData = endPoint[:]
+			}
+			if serveScram(t, b, server, tt.mechanisms) {
+				b.write(authOkMsg)
+				b.write(readyForQueryMsg)
+			}
+		})
+		config.Password = "pencil"
+		config.SSLMode = SSLModeVerifyFull
+		config.TLSConfig = tlsConfig
+		config.ChannelBinding = tt.binding
+		c, err := Connect(context.Background(), config)
+		if err != nil {
+			t.Fatalf("%d: want nil err; got %v", i, err)
+		}
+		<-done
+		c.conn.Close()
+	}
+}
+
+func TestConnectScramChannelBindingEd25519(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("want nil err; got %v", err)
+	}
+	cert, tlsConfig := testcert.NewKey(t, key)
+	for i, binding := range []ChannelBinding{ChannelBindingPrefer, ChannelBindingRequire} {
+		config, done := pipeConfig(t, func(b *fakeBackend) {
+			b = b.acceptTLS(cert)
+			b.readStartup()
+			if binding == ChannelBindingRequire {
+				b.write(authMsg(AuthenticationSASL,
+					[]byte("SCRAM-SHA-256-PLUS\x00SCRAM-SHA-256\x00\x00")))
+				return
+			}
+			// no hash to bind to, so carry on without binding
+			server := &scramServer{t: t, password: "pencil", salt: []byte("saltsalt"),
+				gs2Header: "n,,"}
+			if serveScram(t, b, server, "SCRAM-SHA-256-PLUS\x00SCRAM-SHA-256\x00") {
+				b.write(authOkMsg)
+				b.write(readyForQueryMsg)
+			}
+		})
+		config.Password = "pencil"
+		config.SSLMode = SSLModeVerifyFull
+		config.TLSConfig = tlsConfig
+		config.ChannelBinding = binding
+		c, err := Connect(context.Background(), config)
+		if (err == nil) != (binding == ChannelBindingPrefer) {
+			t.Errorf("%d: want an error only if binding is required; got %v", i, err)
+		}
+		if err == nil {
+			c.conn.Close()
+		}
+		<-done
+	}
+}
+
+func TestConnectChannelBindingRequiredWithoutPlus(t *testing.T) {
+	cert, tlsConfig := testcert.New(t)
+	config, done := pipeConfig(t, func(b *fakeBackend) {
+		b = b.acceptTLS(cert)
+		b.readStartup()
+		b.write(authMsg(AuthenticationSASL, []byte("SCRAM-SHA-256\x00\x00")))
+	})
+	config.Password = "pencil"
+	config.SSLMode = SSLModeVerifyFull
+	config.TLSConfig = tlsConfig
+	config.ChannelBinding = ChannelBindingRequire
+	_, err := Connect(context.Background(), config)
+	if err != errChannelBindingRequired {
+		t.Errorf("want %v; got %v", errChannelBindingRequired, err)
+	}
+	<-done
+}
+
+func TestConnectChannelBindingRequiredWithoutTLS(t *testing.T) {
+	config, done := pipeConfig(t, func(b *fakeBackend) {
+		b.readStartup()
+		b.write(authMsg(AuthenticationSASL, []byte("SCRAM-SHA-256-PLUS\x00SCRAM-SHA-256\x00\x00")))
+	})
+	config.Password = "pencil"
+	config.ChannelBinding = ChannelBindingRequire
+	_, err := Connect(context.Background(), config)
+	if err != errChannelBindingRequired {
+		t.Errorf("want %v; got %v", errChannelBindingRequired, err)
+	}
+	<-done
+}
+
+var channelBindingRequiredTests = [][]byte{
+	authOkMsg,
+	{'R', 0x0, 0x0, 0x0, 0x8, 0x0, 0x0, 0x0, 0x3},
+	{'R', 0x0, 0x0, 0x0, 0xc, 0x0, 0x0, 0x0, 0x5, 0x01, 0x02, 0x03, 0x04},
+}
+
+func TestConnectChannelBindingRequiredNonSASL(t *testing.T) {
+	for i, tt := range channelBindingRequiredTests {
+		config, done := pipeConfig(t, func(b *fakeBackend) {
+			b.readStartup()
+			b.write(tt)
+		})
+		config.Password = "pencil"
+		config.ChannelBinding = ChannelBindingRequire
+		_, err := Connect(context.Background(), config)
+		if err != errChannelBindingRequired {
+			t.Errorf("%d: want %v; got %v", i, errChannelBindingRequired, err)
+		}
+		<-done
+	}
+}
@@ -0,0 +1,469 @@
+package post
+
+import (
+	"sort"
+	"strconv"
+)
+
+// Encode and Decode for backend messages, mirroring those of the
+// frontend messages: Encode appends the complete message to dst, and
+// Decode takes the message body, after the type byte and the length.
+// Decoded byte slices alias src.
+
+// Allocate the backend message for the given type; unknown types get an
+// *UnknownMessage.
+func newBackendMessage(msgType MessageType) BackendMessage {
+	switch msgType {
+	case MsgAuthentication:
+		return &AuthResponse{}
+	case MsgBackendKeyData:
+		return &BackendKeyData{}
+	case MsgBindComplete:
+		return &BindComplete{}
+	case MsgCloseComplete:
+		return &CloseComplete{}
+	case MsgCommandComplete:
+		return &CommandComplete{}
+	case MsgCopyData:
+		return &CopyData{}
+	case MsgCopyDone:
+		return &CopyDone{}
+	case MsgCopyInResponse:
+		return &CopyInResponse{}
+	case MsgCopyOutResponse:
+		return &CopyOutResponse{}
+	case MsgCopyBothResponse:
+		return &CopyBothResponse{}
+	case MsgDataRow:
+		return &DataRow{}
+	case MsgEmptyQueryResponse:
+		return &EmptyQueryResponse{}
+	case MsgErrorResponse:
+		return &PgError{}
+	case MsgFunctionCallResponse:
+		return &FunctionCallResponse{}
+	case MsgNegotiateProtocolVersion:
+		return &NegotiateProtocolVersion{}
+	case MsgNoData:
+		return &NoData{}
+	case MsgNoticeResponse:
+		return &Notice{}
+	case MsgNotificationResponse:
+		return &Notification{}
+	case MsgParameterDescription:
+		return &ParameterDescription{}
+	case MsgParameterStatus:
+		return &ParameterStatus{}
+	case MsgParseComplete:
+		return &ParseComplete{}
+	case MsgPortalSuspended:
+		return &PortalSuspended{}
+	case MsgReadyForQuery:
+		return &ReadyForQuery{}
+	case MsgRowDescription:
+		return &RowDescription{}
+	default:
+		return &UnknownMessage{MsgType: msgType}
+	}
+}
+
+func (m *AuthResponse) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, MsgAuthentication)
+	dst = appendInt32(dst, int32(m.Subtype))
+	dst = append(dst, m.Payload...)
+	return finishMessage(dst, start)
+}
+
+func (m *AuthResponse) Decode(src []byte) error {
+	r := newMsgReader("AuthResponse", src)
+	m.Subtype = AuthResponseType(r.int32())
+	m.Payload = nil
+	if len(r.src) > 0 {
+		m.Payload = r.rest()
+	}
+	return r.finish()
+}
+
+func (m *BackendKeyData) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, MsgBackendKeyData)
+	dst = appendInt32(dst, m.Pid)
+	dst = append(dst, m.SecretKey...)
+	return finishMessage(dst, start)
+}
+
+func (m *BackendKeyData) Decode(src []byte) error {
+	r := newMsgReader("BackendKeyData", src)
+	m.Pid = r.int32()
+	m.SecretKey = r.secretKey()
+	return r.finish()
+}
+
+// The longest secret key allowed by protocol 3.2; 3.0 keys are always 4
+// bytes.
+const maxSecretKeyLength = 256
+
+// Read a secret key for cancel requests, which takes up the rest of the
+// body.
+func (r *msgReader) secretKey() []byte {
+	if r.err == nil && (len(r.src) < 4 || len(r.src) > maxSecretKeyLength) {
+		r.fail("secret key length %v", len(r.src))
+		return nil
+	}
+	return r.rest()
+}
+
+func (m *BindComplete) Encode(dst []byte) []byte {
+	return encodeEmpty(dst, MsgBindComplete)
+}
+
+func (m *BindComplete) Decode(src []byte) error {
+	return decodeEmpty("BindComplete", src)
+}
+
+func (m *CloseComplete) Encode(dst []byte) []byte {
+	return encodeEmpty(dst, MsgCloseComplete)
+}
+
+func (m *CloseComplete) Decode(src []byte) error {
+	return decodeEmpty("CloseComplete", src)
+}
+
+func (m *CommandComplete) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, MsgCommandComplete)
+	dst = appendCString(dst, string(m.Tag))
+	return finishMessage(dst, start)
+}
+
+func (m *CommandComplete) Decode(src []byte) error {
+	r := newMsgReader("CommandComplete", src)
+	m.Tag = CommandTag(r.cstring())
+	return r.finish()
+}
+
+func (m *CopyInResponse) Encode(dst []byte) []byte {
+	return (*CopyResponse)(m).encode(dst, MsgCopyInResponse)
+}
+
+func (m *CopyInResponse) Decode(src []byte) error {
+	return (*CopyResponse)(m).decode("CopyInResponse", src)
+}
+
+func (m *CopyOutResponse) Encode(dst []byte) []byte {
+	return (*CopyResponse)(m).encode(dst, MsgCopyOutResponse)
+}
+
+func (m *CopyOutResponse) Decode(src []byte) error {
+	return (*CopyResponse)(m).decode("CopyOutResponse", src)
+}
+
+func (m *CopyBothResponse) Encode(dst []byte) []byte {
+	return (*CopyResponse)(m).encode(dst, MsgCopyBothResponse)
+}
+
+func (m *CopyBothResponse) Decode(src []byte) error {
+	return (*CopyResponse)(m).decode("CopyBothResponse", src)
+}
+
+func (m *CopyResponse) encode(dst []byte, msgType MessageType) []byte {
+	dst, start := beginMessage(dst, msgType)
+	dst = append(dst, byte(m.Format))
+	dst = appendFormats(dst, m.ColumnFormats)
+	return finishMessage(dst, start)
+}
+
+func (m *CopyResponse) decode(name string, src []byte) error {
+	r := newMsgReader(name, src)
+	m.Format = CopyFormat(r.byte1())
+	m.ColumnFormats = r.formats()
+	return r.finish()
+}
+
+func (m *DataRow) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, MsgDataRow)
+	dst = appendValues(dst, m.Values)
+	return finishMessage(dst, start)
+}
+
+func (m *DataRow) Decode(src []byte) error {
+	r := newMsgReader("DataRow", src)
+	m.Values = r.values()
+	return r.finish()
+}
+
+func (m *EmptyQueryResponse) Encode(dst []byte) []byte {
+	return encodeEmpty(dst, MsgEmptyQueryResponse)
+}
+
+func (m *EmptyQueryResponse) Decode(src []byte) error {
+	return decodeEmpty("EmptyQueryResponse", src)
+}
+
+func (m *FunctionCallResponse) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, MsgFunctionCallResponse)
+	dst = appendValue(dst, m.Result)
+	return finishMessage(dst, start)
+}
+
+func (m *FunctionCallResponse) Decode(src []byte) error {
+	r := newMsgReader("FunctionCallResponse", src)
+	m.Result = r.value()
+	return r.finish()
+}
+
+// The order in which PgError fields are encoded; the server uses the
+// same one.
+var errorFieldOrder = []ErrorField{
+	Severity, SeverityNonLocalized, Code, Message, Detail, Hint,
+	Position, InternalPosition, InternalQuery, Where, Schema, Table,
+	Column, DataType, Constraint, File, Line, Routine,
+}
+
+func (e *PgError) Encode(dst []byte) []byte {
+	return e.encode(dst, MsgErrorResponse)
+}
+
+func (e *PgError) Decode(src []byte) error {
+	return e.decode("ErrorResponse", src)
+}
+
+func (n *Notice) Encode(dst []byte) []byte {
+	return (*PgError)(n).encode(dst, MsgNoticeResponse)
+}
+
+func (n *Notice) Decode(src []byte) error {
+	return (*PgError)(n).decode("NoticeResponse", src)
+}
+
+// Encode the fields broken out in the struct, followed by any others in
+// Fields. Where both are set, the struct field wins; where the struct
+// field is empty, the one in Fields is used.
+func (e *PgError) encode(dst []byte, msgType MessageType) []byte {
+	values := map[ErrorField]string{
+		Severity:             e.Severity,
+		SeverityNonLocalized: e.SeverityNonLocalized,
+		Code:                 e.Code,
+		Message:              e.Message,
+		Detail:               e.Detail,
+		Hint:                 e.Hint,
+		Position:             itoaOrEmpty(e.Position),
+		InternalPosition:     itoaOrEmpty(e.InternalPosition),
+		InternalQuery:        e.InternalQuery,
+		Where:                e.Where,
+		Schema:               e.Schema,
+		Table:                e.Table,
+		Column:               e.Column,
+		DataType:             e.DataType,
+		Constraint:           e.Constraint,
+		File:                 e.File,
+		Line:                 itoaOrEmpty(e.Line),
+		Routine:              e.Routine,
+	}
+	var extra []ErrorField
+	for field := range e.Fields {
+		if _, ok := values[field]; !ok {
+			extra = append(extra, field)
+		}
+	}
+	sort.Slice(extra, func(i, j int) bool { return extra[i] < extra[j] })
+
+	dst, start := beginMessage(dst, msgType)
+	for _, field := range errorFieldOrder {
+		val := values[field]
+		if val == "" {
+			val = e.Fields[field]
+		}
+		if val != "" {
+			dst = append(dst, byte(field))
+			dst = appendCString(dst, val)
+		}
+	}
+	for _, field := range extra {
+		dst = append(dst, byte(field))
+		dst = appendCString(dst, e.Fields[field])
+	}
+	dst = append(dst, 0)
+	return finishMessage(dst, start)
+}
+
+func (e *PgError) decode(name string, src []byte) error {
+	r := newMsgReader(name, src)
+	fields := make(map[ErrorField]string)
+	for r.err == nil {
+		field := r.byte1()
+		if field == 0 {
+			break
+		}
+		fields[ErrorField(field)] = r.cstring()
+	}
+	err := r.finish()
+	if err != nil {
+		return err
+	}
+	*e = *NewPgError(fields)
+	return nil
+}
+
+func itoaOrEmpty(val int) string {
+	if val == 0 {
+		return ""
+	}
+	return strconv.Itoa(val)
+}
+
+func (m *NoData) Encode(dst []byte) []byte {
+	return encodeEmpty(dst, MsgNoData)
+}
+
+func (m *NoData) Decode(src []byte) error {
+	return decodeEmpty("NoData", src)
+}
+
+func (m *Notification) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, MsgNotificationResponse)
+	dst = appendInt32(dst, m.Pid)
+	dst = appendCString(dst, m.Channel)
+	dst = appendCString(dst, m.Payload)
+	return finishMessage(dst, start)
+}
+
+func (m *Notification) Decode(src []byte) error {
+	r := newMsgReader("NotificationResponse", src)
+	m.Pid = r.int32()
+	m.Channel = r.cstring()
+	m.Payload = r.cstring()
+	return r.finish()
+}
+
+func (m *NegotiateProtocolVersion) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, MsgNegotiateProtocolVersion)
+	dst = appendInt32(dst, m.NewestMinor)
+	dst = appendInt32(dst, int32(len(m.UnrecognizedOptions)))
+	for _, option := range m.UnrecognizedOptions {
+		dst = appendCString(dst, option)
+	}
+	return finishMessage(dst, start)
+}
+
+func (m *NegotiateProtocolVersion) Decode(src []byte) error {
+	r := newMsgReader("NegotiateProtocolVersion", src)
+	m.NewestMinor = r.int32()
+	// the count is an Int32 here, and each option takes at least its
+	// terminator
+	n := r.int32()
+	if r.err == nil && (n < 0 || int(n) > len(r.src)) {
+		r.fail("bad count %v", n)
+		n = 0
+	}
+	m.UnrecognizedOptions = make([]string, n)
+	for i := range m.UnrecognizedOptions {
+		m.UnrecognizedOptions[i] = r.cstring()
+	}
+	return r.finish()
+}
+
+func (m *ParameterDescription) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, MsgParameterDescription)
+	dst = appendInt16(dst, int16(len(m.Types)))
+	for _, typ := range m.Types {
+		dst = appendInt32(dst, int32(typ))
+	}
+	return finishMessage(dst, start)
+}
+
+func (m *ParameterDescription) Decode(src []byte) error {
+	r := newMsgReader("ParameterDescription", src)
+	m.Types = make([]Oid, r.count(4))
+	for i := range m.Types {
+		m.Types[i] = Oid(r.int32())
+	}
+	return r.finish()
+}
+
+func (m *ParameterStatus) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, MsgParameterStatus)
+	dst = appendCString(dst, m.Parameter)
+	dst = appendCString(dst, m.Value)
+	return finishMessage(dst, start)
+}
+
+func (m *ParameterStatus) Decode(src []byte) error {
+	r := newMsgReader("ParameterStatus", src)
+	m.Parameter = r.cstring()
+	m.Value = r.cstring()
+	return r.finish()
+}
+
+func (m *ParseComplete) Encode(dst []byte) []byte {
+	return encodeEmpty(dst, MsgParseComplete)
+}
+
+func (m *ParseComplete) Decode(src []byte) error {
+	return decodeEmpty("ParseComplete", src)
+}
+
+func (m *PortalSuspended) Encode(dst []byte) []byte {
+	return encodeEmpty(dst, MsgPortalSuspended)
+}
+
+func (m *PortalSuspended) Decode(src []byte) error {
+	return decodeEmpty("PortalSuspended", src)
+}
+
+func (m *ReadyForQuery) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, MsgReadyForQuery)
+	dst = append(dst, byte(m.Status))
+	return finishMessage(dst, start)
+}
+
+func (m *ReadyForQuery) Decode(src []byte) error {
+	r := newMsgReader("ReadyForQuery", src)
+	m.Status = TransactionStatus(r.byte1())
+	return r.finish()
+}
+
+// The encoded size of a FieldDescription with an empty name.
+const fieldDescriptionSize = 1 + 4 + 2 + 4 + 2 + 4 + 2
+
+func (m *RowDescription) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, MsgRowDescription)
+	dst = appendInt16(dst, int16(len(m.Fields)))
+	for _, field := range m.Fields {
+		dst = appendCString(dst, field.Name)
+		dst = appendInt32(dst, int32(field.TableOid))
+		dst = appendInt16(dst, field.TableAttNo)
+		dst = appendInt32(dst, int32(field.TypeOid))
+		dst = appendInt16(dst, field.TypLen)
+		dst = appendInt32(dst, field.AttTypMod)
+		dst = appendInt16(dst, int16(field.Format))
+	}
+	return finishMessage(dst, start)
+}
+
+func (m *RowDescription) Decode(src []byte) error {
+	r := newMsgReader("RowDescription", src)
+	m.Fields = make([]FieldDescription, r.count(fieldDescriptionSize))
+	for i := range m.Fields {
+		field := &m.Fields[i]
+		field.Name = r.cstring()
+		field.TableOid = Oid(r.int32())
+		field.TableAttNo = r.int16()
+		field.TypeOid = Oid(r.int32())
+		field.TypLen = r.int16()
+		field.AttTypMod = r.int32()
+		field.Format = DataFormat(r.int16())
+	}
+	return r.finish()
+}
+
+// Encode the message with its MsgType and Body as is.
+func (m *UnknownMessage) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, m.MsgType)
+	dst = append(dst, m.Body...)
+	return finishMessage(dst, start)
+}
+
+// Decode sets the Body; the MsgType must be set by the caller.
+func (m *UnknownMessage) Decode(src []byte) error {
+	m.Body = src
+	return nil
+}
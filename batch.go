@@ -0,0 +1,228 @@
+package post
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrSkipped is the error of a query in a Batch that the server skipped
+// because of an error in an earlier query before the same Sync.
+var ErrSkipped = errors.New("post: query skipped after an earlier error")
+
+// A Batch is a list of queries to send all at once, without
+// waiting for the results of one before sending the next. Each query is
+// run with the extended query protocol, and its parameters are sent as
+// for PreparedStatement.Query. The results are read
+// while the batch is still being sent, so a batch of any size can be
+// sent at once.
+type Batch struct {
+	// SyncEach, if set, sends a Sync after every query rather than once
+	// at the end. Each query then runs in its own implicit transaction,
+	// and an error only affects its own query. Otherwise, the batch runs
+	// as a single implicit transaction, and an error skips the rest of
+	// it.
+	SyncEach bool
+
+	queries []batchQuery
+}
+
+type batchQuery struct {
+	// the statement to run, or nil to parse sql as the unnamed
+	// statement
+	stmt    *PreparedStatement
+	sql     string
+	params  [][]byte
+	formats []DataFormat
+	err     error
+}
+
+// Queue a query to parse and run with the given parameters.
+func (b *Batch) Queue(sql string, args ...interface{}) {
+	params, formats, err := encodeParameters(args)
+	b.queries = append(b.queries, batchQuery{sql: sql, params: params, formats: formats, err: err})
+}
+
+// Queue a run of a prepared statement with the given parameters.
+func (b *Batch) QueuePrepared(stmt *PreparedStatement, args ...interface{}) {
+	params, formats, err := encodeParameters(args)
+	if err == nil && len(args) != len(stmt.Parameters) {
+		err = fmt.Errorf("statement takes %v parameters; got %v",
+			len(stmt.Parameters), len(args))
+	}
+	b.queries = append(b.queries, batchQuery{stmt: stmt, params: params, formats: formats, err: err})
+}
+
+// Get the number of queries queued.
+func (b *Batch) Len() int {
+	return len(b.queries)
+}
+
+func (b *Batch) send(p *ProtoStream) (err error) {
+	for i, query := range b.queries {
+		if query.stmt == nil {
+			err = p.SendParse("", query.sql, nil)
+			if err == nil {
+				err = p.Send(&Bind{ParameterFormats: query.formats, Parameters: query.params})
+			}
+			if err == nil {
+				err = p.SendDescribe(Portal, "")
+			}
+		} else {
+			err = p.Send(&Bind{Statement: query.stmt.Name,
+				ParameterFormats: query.formats, Parameters: query.params})
+		}
+		if err == nil {
+			err = p.SendExecute("", 0)
+		}
+		if err == nil && (b.SyncEach || i == len(b.queries)-1) {
+			err = p.SendSync()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Get the number of queries before each Sync.
+func (b *Batch) syncs() []int {
+	if !b.SyncEach {
+		return []int{len(b.queries)}
+	}
+	syncs := make([]int, len(b.queries))
+	for i := range syncs {
+		syncs[i] = i + 1
+	}
+	return syncs
+}
+
+// A BatchResult is the result of a single query in a Batch.
+type BatchResult struct {
+	// The fields of the rows returned, or nil if the query does not
+	// return rows.
+	Fields []FieldDescription
+	Rows   [][][]byte
+	Tag    CommandTag
+	// The error running the query, if any: a *PgError, or ErrSkipped.
+	// A query that completed is given the error of a failed commit at
+	// the end of its Sync, since it was rolled back with the rest.
+	Err error
+}
+
+// Send the queries of a batch and collect their results, one for each
+// query in the order they were queued. The error returned is for
+// problems with the batch as a whole, such as failing to encode a
+// parameter or losing the connection; errors running the individual
+// queries are reported in their results. If ctx is done before the
+// batch completes, the server is asked to cancel it, and any queries
+// failing as a result are reported along with ctx's error.
+func (c *Conn) SendBatch(ctx context.Context, b *Batch) ([]*BatchResult, error) {
+	if len(b.queries) == 0 {
+		return nil, nil
+	}
+	results := make([]*BatchResult, len(b.queries))
+	for i, query := range b.queries {
+		if query.err != nil {
+			return nil, fmt.Errorf("post: query %d: %w", i+1, query.err)
+		}
+		results[i] = &BatchResult{}
+		if query.stmt != nil {
+			results[i].Fields = query.stmt.Fields
+		}
+	}
+	syncs := b.syncs()
+	r, err := c.startQuery(ctx, func(*ProtoStream) error { return nil })
+	if err != nil {
+		return nil, err
+	}
+	// send the batch while reading its results, since the server stops
+	// reading once it cannot send results, and would never get the end
+	// of a big enough batch
+	sent := make(chan error, 1)
+	go func() {
+		err := b.send(c.proto)
+		if err == nil {
+			err = c.proto.Flush()
+		}
+		if err != nil {
+			// the results of the rest of the batch will never come
+			c.conn.Close()
+		}
+		sent <- err
+	}()
+	// the query the next response is for, and the first query before
+	// the next Sync
+	next, first := 0, 0
+	for !r.done {
+		msg, err := c.proto.ReceiveMessage()
+		if err != nil {
+			r.fail(err)
+			// the server may be stuck sending to us, and the sending
+			// above stuck in turn
+			c.conn.Close()
+			break
+		}
+		if c.handleAsync(msg) {
+			continue
+		}
+		if pgErr, ok := msg.(*PgError); ok && next == syncs[0] {
+			// an error committing the implicit transaction, e.g., a
+			// deferred constraint, which undoes every query before the
+			// Sync
+			for i := first; i < next; i++ {
+				if results[i].Err == nil {
+					results[i].Err = pgErr
+				}
+			}
+			continue
+		}
+		if _, ok := msg.(*ReadyForQuery); !ok && next == syncs[0] {
+			r.unexpected(msg)
+			continue
+		}
+		switch msg := msg.(type) {
+		case *ParseComplete, *BindComplete, *NoData:
+		case *RowDescription:
+			results[next].Fields = msg.Fields
+		case *DataRow:
+			results[next].Rows = append(results[next].Rows, msg.Values)
+		case *CommandComplete:
+			results[next].Tag = msg.Tag
+			next++
+		case *EmptyQueryResponse:
+			next++
+		case *PgError:
+			results[next].Err = msg
+			next++
+			// the server skips the rest of the queries up to the Sync
+			for ; next < syncs[0]; next++ {
+				results[next].Err = ErrSkipped
+			}
+		case *ReadyForQuery:
+			c.txStatus = msg.Status
+			if next != syncs[0] {
+				r.unexpected(msg)
+				next = syncs[0]
+			}
+			first = next
+			syncs = syncs[1:]
+			if len(syncs) == 0 {
+				r.finish()
+			}
+		default:
+			r.unexpected(msg)
+		}
+	}
+	if err := <-sent; err != nil {
+		r.fail(err)
+	}
+	if r.err == nil && ctx.Err() != nil {
+		for _, result := range results {
+			if result.Err != nil {
+				return results, ctx.Err()
+			}
+		}
+	}
+	return results, r.err
+}
@@ -0,0 +1,179 @@
+package post
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestSendBatch(t *testing.T) {
+	c, done := connectServing(t, func(p *ProtoStream) {
+		msgs := receiveAll(t, p,
+			MsgParse, MsgBind, MsgDescribe, MsgExecute,
+			MsgParse, MsgBind, MsgDescribe, MsgExecute,
+			MsgParse, MsgBind, MsgDescribe, MsgExecute,
+			MsgSync)
+		if bind := msgs[1].(*Bind); !reflect.DeepEqual([][]byte{[]byte("7")}, bind.Parameters) {
+			t.Errorf("want Bind of 7; got %#v", bind)
+		}
+		sendAll(t, p,
+			&ParseComplete{}, &BindComplete{}, testFields, testRow, &CommandComplete{"SELECT 1"},
+			&ParseComplete{}, &BindComplete{}, testErr,
+			testIdle)
+		p.ReceiveFrontendMessage()
+	})
+	defer func() { <-done }()
+	defer c.Close()
+
+	b := &Batch{}
+	b.Queue("select $1, null", 7)
+	b.Queue("select * from nope")
+	b.Queue("select 3")
+	results, err := c.SendBatch(context.Background(), b)
+	if err != nil {
+		t.Fatalf("want nil err; got %v", err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("want 3 results; got %v", len(results))
+	}
+	if result := results[0]; len(result.Fields) != 2 || len(result.Rows) != 1 ||
+		result.Tag != "SELECT 1" || result.Err != nil {
+		t.Errorf("want one row; got %#v", result)
+	}
+	if pgErr, ok := results[1].Err.(*PgError); !ok || pgErr.Code != "42P01" {
+		t.Errorf("want 42P01 error; got %v", results[1].Err)
+	}
+	if results[2].Err != ErrSkipped {
+		t.Errorf("want %v; got %v", ErrSkipped, results[2].Err)
+	}
+}
+
+func TestSendBatchLarge(t *testing.T) {
+	const queries = 1000
+	c, done := connectServing(t, func(p *ProtoStream) {
+		// answer each message right away, as a server does once its
+		// output buffer fills, which over a pipe blocks until the
+		// client reads the answer
+		for i := 0; i < queries; i++ {
+			receiveAll(t, p, MsgParse, MsgBind, MsgDescribe, MsgExecute)
+			sendAll(t, p, &ParseComplete{}, &BindComplete{}, &NoData{},
+				&CommandComplete{"INSERT 0 1"})
+		}
+		receiveAll(t, p, MsgSync)
+		sendAll(t, p, testIdle)
+		p.ReceiveFrontendMessage()
+	})
+	defer func() { <-done }()
+	defer c.Close()
+
+	b := &Batch{}
+	for i := 0; i < queries; i++ {
+		b.Queue("insert into t values ($1)", i)
+	}
+	results, err := c.SendBatch(context.Background(), b)
+	if err != nil {
+		t.Fatalf("want nil err; got %v", err)
+	}
+	for i, result := range results {
+		if result.Tag != "INSERT 0 1" || result.Err != nil {
+			t.Errorf("%d: want INSERT 0 1; got %#v", i, result)
+		}
+	}
+}
+
+func TestSendBatchSyncEach(t *testing.T) {
+	c, done := connectServing(t, func(p *ProtoStream) {
+		receiveAll(t, p,
+			MsgBind, MsgExecute, MsgSync,
+			MsgParse, MsgBind, MsgDescribe, MsgExecute, MsgSync,
+			MsgBind, MsgExecute, MsgSync)
+		sendAll(t, p,
+			testErr, testIdle,
+			&ParseComplete{}, &BindComplete{}, &NoData{}, &CommandComplete{"DELETE 2"}, testIdle,
+			&BindComplete{}, testRow, testRow, &CommandComplete{"SELECT 2"}, testIdle)
+		p.ReceiveFrontendMessage()
+	})
+	defer func() { <-done }()
+	defer c.Close()
+
+	stmt := &PreparedStatement{Name: "s", Parameters: []Oid{23}, Fields: testFields.Fields, c: c}
+	b := &Batch{SyncEach: true}
+	b.QueuePrepared(stmt, 1)
+	b.Queue("delete from t")
+	b.QueuePrepared(stmt, 2)
+	results, err := c.SendBatch(context.Background(), b)
+	if err != nil {
+		t.Fatalf("want nil err; got %v", err)
+	}
+	var batchTests = []struct {
+		rows int
+		tag  CommandTag
+		err  bool
+	}{
+		{0, "", true},
+		{0, "DELETE 2", false},
+		{2, "SELECT 2", false},
+	}
+	for i, tt := range batchTests {
+		result := results[i]
+		if len(result.Rows) != tt.rows || result.Tag != tt.tag || (result.Err != nil) != tt.err {
+			t.Errorf("%d: want %v rows, tag %q, err %v; got %#v", i, tt.rows, tt.tag, tt.err, result)
+		}
+	}
+	if results[2].Fields == nil {
+		t.Error("want fields of prepared statement; got nil")
+	}
+}
+
+func TestSendBatchCommitError(t *testing.T) {
+	commitErr := &PgError{Severity: "ERROR", Code: "23503", Message: "deferred"}
+	c, done := connectServing(t, func(p *ProtoStream) {
+		receiveAll(t, p,
+			MsgParse, MsgBind, MsgDescribe, MsgExecute, MsgSync,
+			MsgParse, MsgBind, MsgDescribe, MsgExecute, MsgSync)
+		sendAll(t, p,
+			&ParseComplete{}, &BindComplete{}, &NoData{}, &CommandComplete{"INSERT 0 1"},
+			commitErr, testIdle,
+			&ParseComplete{}, &BindComplete{}, &NoData{}, &CommandComplete{"INSERT 0 1"},
+			testIdle)
+		p.ReceiveFrontendMessage()
+	})
+	defer func() { <-done }()
+	defer c.Close()
+
+	b := &Batch{SyncEach: true}
+	b.Queue("insert into t values (1)")
+	b.Queue("insert into t values (2)")
+	results, err := c.SendBatch(context.Background(), b)
+	if err != nil {
+		t.Fatalf("want nil err; got %v", err)
+	}
+	if pgErr, ok := results[0].Err.(*PgError); !ok || pgErr.Code != "23503" {
+		t.Errorf("want 23503 error; got %v", results[0].Err)
+	}
+	if results[1].Err != nil {
+		t.Errorf("want nil err; got %v", results[1].Err)
+	}
+}
+
+func TestSendBatchEncodeError(t *testing.T) {
+	c, done := connectServing(t, func(p *ProtoStream) {
+		p.ReceiveFrontendMessage()
+	})
+	defer func() { <-done }()
+	defer c.Close()
+
+	stmt := &PreparedStatement{Name: "s", Parameters: []Oid{23}, c: c}
+	var batchTests = []func(b *Batch){
+		func(b *Batch) { b.Queue("select $1", struct{}{}) },
+		func(b *Batch) { b.QueuePrepared(stmt) },
+	}
+	for i, queue := range batchTests {
+		b := &Batch{}
+		b.Queue("select 1")
+		queue(b)
+		if _, err := c.SendBatch(context.Background(), b); err == nil {
+			t.Errorf("%d: want err; got nil", i)
+		}
+	}
+}
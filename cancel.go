@@ -0,0 +1,79 @@
+package post
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// How long a query gets to wind up once the server is asked to cancel
+// it, before the connection is cut.
+const cancelGrace = 10 * time.Second
+
+// Ask the server to cancel the query running on the connection, if any.
+// The request goes over a new connection to the same server, made the
+// way this one was, including TLS. The server gives no answer to it: if
+// the query is cancelled, it fails on this connection with an error.
+// Cancel may be called from any goroutine.
+func (c *Conn) Cancel(ctx context.Context) error {
+	if c.keyData == nil {
+		return errors.New("post: server sent no BackendKeyData to cancel with")
+	}
+	conn, err := c.config.dial(ctx)
+	if err != nil {
+		return err
+	}
+	side := &Conn{config: c.config, conn: conn, proto: NewProtoStreamConn(conn)}
+	side.proto.SetTracer(c.config.Tracer)
+	err = side.withContext(ctx, func() error {
+		var err error
+		switch c.negotiation {
+		case negotiateSSLRequest:
+			err = side.startTLS(c.mode)
+		case negotiateDirect:
+			err = side.startDirectTLS(c.mode)
+		}
+		if err != nil {
+			return err
+		}
+		err = side.proto.SendCancelRequest(c.keyData.Pid, c.keyData.SecretKey)
+		if err == nil {
+			err = side.proto.Flush()
+		}
+		if err != nil {
+			return err
+		}
+		// the server closes the connection once it has seen the request
+		msgType, err := side.proto.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err == nil {
+			err = fmt.Errorf("post: unexpected message type %q after CancelRequest",
+				byte(msgType))
+		}
+		return err
+	})
+	side.conn.Close()
+	return err
+}
+
+// Apply ctx's cancellation to the query running on the connection until
+// the returned function is called: if ctx is done, ask the server to
+// cancel the query, leaving it to be read to the end as usual. If the
+// request cannot be sent, or the query does not end in time, the
+// connection is cut instead.
+func (c *Conn) watchQuery(ctx context.Context) (stop func()) {
+	return c.watch(ctx, func(conn net.Conn) {
+		cancelCtx, cancel := context.WithTimeout(context.Background(), cancelGrace)
+		defer cancel()
+		if c.Cancel(cancelCtx) != nil {
+			conn.SetDeadline(time.Unix(1, 0))
+			return
+		}
+		conn.SetDeadline(time.Now().Add(cancelGrace))
+	})
+}
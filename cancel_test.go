@@ -0,0 +1,118 @@
+package post
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+)
+
+// Connect to a fake backend that completes startup with a
+// BackendKeyData and then hands the server end of the connection to
+// serve. Any further connections are for cancel requests, which are
+// sent on the returned channel.
+func connectCancelable(t *testing.T, serve func(p *ProtoStream)) (*Conn, <-chan *CancelRequest, <-chan struct{}) {
+	config, done := pipeConfig(t, func(b *fakeBackend) {
+		b.readStartup()
+		b.write(authOkMsg)
+		b.write(backendKeyDataMsg)
+		b.write(readyForQueryMsg)
+		serve(NewProtoStreamConn(b.Conn))
+	})
+	cancels := make(chan *CancelRequest, 1)
+	dial := config.Dial
+	config.Dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if dial != nil {
+			defer func() { dial = nil }()
+			return dial(ctx, network, addr)
+		}
+		client, server := net.Pipe()
+		go func() {
+			defer server.Close()
+			msg, err := NewProtoStreamConn(server).ReceiveStartupMessage()
+			if err != nil {
+				t.Errorf("want nil err; got %v", err)
+			}
+			cancel, ok := msg.(*CancelRequest)
+			if !ok {
+				t.Errorf("want CancelRequest; got %#v", msg)
+			}
+			cancels <- cancel
+		}()
+		return client, nil
+	}
+	c, err := Connect(context.Background(), config)
+	if err != nil {
+		t.Fatalf("want nil err; got %v", err)
+	}
+	return c, cancels, done
+}
+
+func TestCancel(t *testing.T) {
+	c, cancels, done := connectCancelable(t, func(p *ProtoStream) {
+		p.ReceiveFrontendMessage()
+	})
+	defer func() { <-done }()
+	defer c.Close()
+
+	if err := c.Cancel(context.Background()); err != nil {
+		t.Fatalf("want nil err; got %v", err)
+	}
+	expected := &CancelRequest{Pid: 0x3039, SecretKey: []byte{0x12, 0x34, 0x56, 0x78}}
+	if actual := <-cancels; !reflect.DeepEqual(expected, actual) {
+		t.Errorf("want %#v; got %#v", expected, actual)
+	}
+}
+
+func TestCancelWithoutKeyData(t *testing.T) {
+	c, done := connectServing(t, func(p *ProtoStream) {
+		p.ReceiveFrontendMessage()
+	})
+	defer func() { <-done }()
+	defer c.Close()
+
+	if err := c.Cancel(context.Background()); err == nil {
+		t.Error("want err; got nil")
+	}
+}
+
+func TestQueryContextCancel(t *testing.T) {
+	var cancels <-chan *CancelRequest
+	ready := make(chan struct{})
+	c, cancels, done := connectCancelable(t, func(p *ProtoStream) {
+		<-ready
+		receiveAll(t, p, MsgQuery)
+		// the query runs until it is cancelled
+		<-cancels
+		sendAll(t, p, testFields,
+			&PgError{Severity: "ERROR", Code: "57014", Message: "canceling statement"},
+			testIdle)
+
+		receiveAll(t, p, MsgQuery)
+		sendAll(t, p, &CommandComplete{"SELECT 0"}, testIdle)
+		p.ReceiveFrontendMessage()
+	})
+	close(ready)
+	defer func() { <-done }()
+	defer c.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r, err := c.SimpleQuery(ctx, "select pg_sleep(60)")
+	if err != nil {
+		t.Fatalf("want nil err; got %v", err)
+	}
+	cancel()
+	readResults(r)
+	if err := r.Close(); err != context.Canceled {
+		t.Errorf("want %v; got %v", context.Canceled, err)
+	}
+	// the connection is still usable
+	r, err = c.SimpleQuery(context.Background(), "select")
+	if err != nil {
+		t.Fatalf("want nil err; got %v", err)
+	}
+	readResults(r)
+	if err := r.Close(); err != nil {
+		t.Errorf("want nil err; got %v", err)
+	}
+}
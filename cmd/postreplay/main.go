@@ -0,0 +1,78 @@
+// Command postreplay serves recorded protocol sessions, so a client can
+// be run against them to reproduce a problem without the original
+// server.
+//
+//	postreplay [-listen address] [-port port] [-dump] file
+//
+// The file is a capture written by post.CaptureWriter or a pcap file of
+// traffic to a server on the given port (5432 by default). Each
+// connection accepted on the listen address (127.0.0.1:5433 by default)
+// is served the next recorded session, checking that the client sends
+// exactly what was recorded. With -dump, the sessions are printed
+// instead.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+
+	"github.com/msakrejda/post/replay"
+)
+
+func main() {
+	listen := flag.String("listen", "127.0.0.1:5433", "address to listen on")
+	port := flag.Int("port", 5432, "server port of the traffic in a pcap file")
+	dump := flag.Bool("dump", false, "print the recorded sessions and exit")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: postreplay [flags] file\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	log.SetFlags(0)
+	log.SetPrefix("postreplay: ")
+
+	f, err := os.Open(flag.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	sessions, err := replay.Read(f, *port)
+	f.Close()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *dump {
+		for i, sess := range sessions {
+			fmt.Printf("# session %d\n", i)
+			for _, record := range sess {
+				fmt.Println(record)
+			}
+		}
+		return
+	}
+
+	listener, err := net.Listen("tcp", *listen)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("replaying %d sessions on %v", len(sessions), listener.Addr())
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	s := &replay.Server{
+		Sessions: sessions,
+		ErrorLog: func(err error) { log.Print(err) },
+	}
+	err = s.Serve(ctx, listener)
+	if err != nil && err != context.Canceled {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,397 @@
+package post
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config describes how to reach and authenticate to a server.
+type Config struct {
+	// Host name or IP address to connect to. A Host beginning with a
+	// slash is taken to be the directory holding the server's Unix
+	// domain socket. Defaults to "localhost".
+	Host string
+	// Port to connect to. Defaults to 5432.
+	Port     int
+	User     string
+	Password string
+	// Database to connect to. If empty, the server defaults to the
+	// database named after the user.
+	Database string
+	// Additional run-time parameters to send in the startup message,
+	// e.g., "application_name" or "search_path".
+	Params map[string]string
+	// Protocol version to request, e.g., ProtocolVersion32 for longer
+	// cancel keys. Defaults to ProtocolVersion30. A server that only
+	// supports an older minor version falls back to it; see
+	// Conn.ProtocolVersion.
+	ProtocolVersion int32
+	// Protocol extension options to request, named with the "_pq_."
+	// prefix. A server ignores those it does not recognize; see
+	// Conn.UnrecognizedProtocolOptions.
+	ProtocolOptions map[string]string
+	// Dial, if set, is used instead of a net.Dialer to open the
+	// connection to the server.
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+	// Whether and how to use TLS. Defaults to SSLModePrefer.
+	SSLMode SSLMode
+	// How to start TLS. Defaults to SSLNegotiationPostgres.
+	SSLNegotiation SSLNegotiation
+	// If direct TLS negotiation fails, try again with an SSLRequest.
+	SSLNegotiationFallback bool
+	// TLSConfig, if set, is the basis for the TLS client configuration,
+	// e.g., to supply root certificates or a client certificate. Its
+	// verification settings are adjusted to match SSLMode.
+	TLSConfig *tls.Config
+	// Whether to bind SCRAM authentication to the TLS session.
+	ChannelBinding ChannelBinding
+	// Tracer, if set, is told about every message exchanged with the
+	// server, starting with the TLS negotiation.
+	Tracer Tracer
+}
+
+// ChannelBinding controls the use of SCRAM-SHA-256-PLUS, which proves
+// to the server and the client that the TLS session was not
+// intercepted.
+type ChannelBinding int
+
+const (
+	// Use channel binding if the connection uses TLS and the server
+	// supports it, unless the server's certificate has no hash to bind
+	// to, e.g., one signed with ed25519.
+	ChannelBindingPrefer ChannelBinding = iota
+	// Never use channel binding.
+	ChannelBindingDisable
+	// Fail unless the server authenticates with channel binding.
+	ChannelBindingRequire
+)
+
+func (c *Config) network() (network, addr string) {
+	port := c.Port
+	if port == 0 {
+		port = 5432
+	}
+	host := c.Host
+	if host == "" {
+		host = "localhost"
+	}
+	if strings.HasPrefix(host, "/") {
+		return "unix", filepath.Join(host, ".s.PGSQL."+strconv.Itoa(port))
+	}
+	return "tcp", net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+func (c *Config) dial(ctx context.Context) (net.Conn, error) {
+	network, addr := c.network()
+	if c.Dial != nil {
+		return c.Dial(ctx, network, addr)
+	}
+	var d net.Dialer
+	return d.DialContext(ctx, network, addr)
+}
+
+func (c *Config) startupParams() map[string]string {
+	params := make(map[string]string, len(c.Params)+len(c.ProtocolOptions)+2)
+	for key, val := range c.Params {
+		params[key] = val
+	}
+	for key, val := range c.ProtocolOptions {
+		params[key] = val
+	}
+	params["user"] = c.User
+	if c.Database != "" {
+		params["database"] = c.Database
+	}
+	return params
+}
+
+// A Conn is a single authenticated connection to a server.
+type Conn struct {
+	config   Config
+	conn     net.Conn
+	proto    *ProtoStream
+	params   map[string]string
+	keyData  *BackendKeyData
+	txStatus TransactionStatus
+	// the protocol version in use, and the options the server ignored
+	version      int32
+	unrecognized []string
+	// how TLS was negotiated, to do the same for cancel requests
+	mode        SSLMode
+	negotiation tlsNegotiation
+	// whether the results of a query are still being read
+	busy bool
+
+	// SASL exchange state, only used during the handshake
+	sasl     *scramClient
+	saslDone bool
+}
+
+// Connect to the server described by config and perform the startup
+// and authentication handshake. The returned Conn is ready for queries.
+func Connect(ctx context.Context, config Config) (*Conn, error) {
+	if config.User == "" {
+		return nil, errors.New("post: no user specified")
+	}
+	for name := range config.ProtocolOptions {
+		if !strings.HasPrefix(name, protocolOptionPrefix) {
+			return nil, fmt.Errorf("post: protocol option %q lacks the %q prefix",
+				name, protocolOptionPrefix)
+		}
+	}
+	mode, err := config.sslMode()
+	if err != nil {
+		return nil, err
+	}
+	attempts, err := config.tlsAttempts(mode)
+	if err != nil {
+		return nil, err
+	}
+	var c *Conn
+	for _, negotiation := range attempts {
+		c, err = connect(ctx, config, mode, negotiation)
+		if err == nil || c == nil || ctx.Err() != nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Open a connection, negotiate TLS as requested, and perform the
+// handshake. If the handshake fails, the connection is closed, but the
+// Conn is still returned along with the error; a nil Conn means the
+// server could not be reached at all.
+func connect(ctx context.Context, config Config, mode SSLMode,
+	negotiation tlsNegotiation) (*Conn, error) {
+	conn, err := config.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c := &Conn{
+		config:      config,
+		mode:        mode,
+		negotiation: negotiation,
+		conn:        conn,
+		proto:       NewProtoStreamConn(conn),
+		params:      make(map[string]string),
+	}
+	c.proto.SetTracer(config.Tracer)
+	err = c.withContext(ctx, func() error {
+		var err error
+		switch negotiation {
+		case negotiateSSLRequest:
+			err = c.startTLS(mode)
+		case negotiateDirect:
+			err = c.startDirectTLS(mode)
+		}
+		if err != nil {
+			return err
+		}
+		return c.startup()
+	})
+	if err != nil {
+		c.conn.Close()
+		return c, err
+	}
+	return c, nil
+}
+
+// Run f with ctx's cancellation applied to the underlying connection.
+// If ctx is done before f completes, the context's error is returned
+// instead of the resulting I/O error.
+func (c *Conn) withContext(ctx context.Context, f func() error) (err error) {
+	stop := c.watchContext(ctx)
+	err = f()
+	stop()
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// Apply ctx's cancellation to the underlying connection until the
+// returned function is called.
+func (c *Conn) watchContext(ctx context.Context) (stop func()) {
+	return c.watch(ctx, func(conn net.Conn) {
+		// unblock any pending reads or writes
+		conn.SetDeadline(time.Unix(1, 0))
+	})
+}
+
+// Call done with the underlying connection if ctx is done before the
+// returned function is called. The connection's deadline is reset once
+// the function is called.
+func (c *Conn) watch(ctx context.Context, done func(conn net.Conn)) (stop func()) {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+	// c.conn may be replaced, e.g., when starting TLS, but the deadline
+	// of the original connection applies to anything layered on it
+	conn := c.conn
+	stopping := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			done(conn)
+		case <-stopping:
+		}
+	}()
+	return func() {
+		close(stopping)
+		<-stopped
+		conn.SetDeadline(time.Time{})
+	}
+}
+
+func (c *Conn) startup() (err error) {
+	c.version = c.config.ProtocolVersion
+	if c.version == 0 {
+		c.version = ProtocolVersion30
+	}
+	err = c.proto.SendStartupMessageVersion(c.version, c.config.startupParams())
+	if err != nil {
+		return err
+	}
+	err = c.proto.Flush()
+	if err != nil {
+		return err
+	}
+	for {
+		msg, err := c.proto.ReceiveMessage()
+		if err != nil {
+			return err
+		}
+		switch msg := msg.(type) {
+		case *AuthResponse:
+			err = c.authenticate(msg)
+			if err != nil {
+				return err
+			}
+		case *ParameterStatus:
+			c.params[msg.Parameter] = msg.Value
+		case *BackendKeyData:
+			c.keyData = msg
+		case *NegotiateProtocolVersion:
+			err = c.negotiate(msg)
+			if err != nil {
+				return err
+			}
+		case *Notice:
+			// nothing to do with these yet
+		case *PgError:
+			return msg
+		case *ReadyForQuery:
+			c.txStatus = msg.Status
+			return nil
+		default:
+			return fmt.Errorf("post: unexpected message type %q during startup",
+				byte(msg.Type()))
+		}
+	}
+}
+
+// Prefix of the names of protocol extension options.
+const protocolOptionPrefix = "_pq_."
+
+// Fall back to the protocol version offered by the server, which must be
+// one we could have asked for in the first place.
+func (c *Conn) negotiate(msg *NegotiateProtocolVersion) error {
+	requested := c.version & 0xFFFF
+	if msg.NewestMinor < 0 || msg.NewestMinor > requested {
+		return fmt.Errorf("post: server offered protocol 3.%v when asked for 3.%v",
+			msg.NewestMinor, requested)
+	}
+	for _, name := range msg.UnrecognizedOptions {
+		if _, ok := c.config.ProtocolOptions[name]; !ok {
+			return fmt.Errorf("post: server does not recognize protocol option %q, which was not requested",
+				name)
+		}
+	}
+	c.version = c.version&^0xFFFF | msg.NewestMinor
+	c.unrecognized = msg.UnrecognizedOptions
+	return nil
+}
+
+// Handle a message the server may send at any time, outside the flow of
+// a query, and report whether msg was one.
+func (c *Conn) handleAsync(msg BackendMessage) bool {
+	switch msg := msg.(type) {
+	case *ParameterStatus:
+		c.params[msg.Parameter] = msg.Value
+	case *Notice, *Notification:
+		// nothing to do with these yet
+	default:
+		return false
+	}
+	return true
+}
+
+// Get the value of a run-time parameter reported by the server, such
+// as "server_version" or "client_encoding". The result is empty if the
+// server has not reported the parameter.
+func (c *Conn) ParameterStatus(name string) string {
+	return c.params[name]
+}
+
+// Get a copy of all run-time parameters reported by the server.
+func (c *Conn) Parameters() map[string]string {
+	params := make(map[string]string, len(c.params))
+	for key, val := range c.params {
+		params[key] = val
+	}
+	return params
+}
+
+// Get the process id and secret key needed to cancel queries on this
+// connection. The result is nil if the server did not send them.
+func (c *Conn) BackendKeyData() *BackendKeyData {
+	return c.keyData
+}
+
+// Get the protocol version in use: the one requested, or an older minor
+// version offered by the server instead.
+func (c *Conn) ProtocolVersion() int32 {
+	return c.version
+}
+
+// Get the protocol options requested that the server did not recognize,
+// and which are therefore not in effect.
+func (c *Conn) UnrecognizedProtocolOptions() []string {
+	return c.unrecognized
+}
+
+// Get the transaction status reported in the last ReadyForQuery.
+func (c *Conn) TxStatus() TransactionStatus {
+	return c.txStatus
+}
+
+// Get the underlying ProtoStream, e.g., to send messages not covered
+// by the Conn API.
+func (c *Conn) ProtoStream() *ProtoStream {
+	return c.proto
+}
+
+// Send a Terminate message and close the connection.
+func (c *Conn) Close() error {
+	err := c.proto.SendTerminate()
+	if err == nil {
+		err = c.proto.Flush()
+	}
+	closeErr := c.conn.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
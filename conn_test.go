@@ -0,0 +1,324 @@
+package post
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A fakeBackend is the server end of a net.Pipe, driven by a test.
+type fakeBackend struct {
+	net.Conn
+	t *testing.T
+}
+
+// Read a startup message and return its parameters.
+func (b *fakeBackend) readStartup() map[string]string {
+	var header [8]byte
+	_, err := io.ReadFull(b, header[:])
+	if err != nil {
+		b.t.Errorf("want nil err reading startup; got %v", err)
+		return nil
+	}
+	size := binary.BigEndian.Uint32(header[0:4])
+	if version := binary.BigEndian.Uint32(header[4:8]); version != 196608 {
+		b.t.Errorf("want protocol version 196608; got %v", version)
+	}
+	body := make([]byte, size-8)
+	_, err = io.ReadFull(b, body)
+	if err != nil {
+		b.t.Errorf("want nil err reading startup; got %v", err)
+		return nil
+	}
+	params := make(map[string]string)
+	fields := strings.Split(string(body), "\x00")
+	for i := 0; i+1 < len(fields); i += 2 {
+		if fields[i] == "" {
+			break
+		}
+		params[fields[i]] = fields[i+1]
+	}
+	return params
+}
+
+// Read a regular frontend message and return its type and body.
+func (b *fakeBackend) readMessage() (msgType byte, body []byte) {
+	var header [5]byte
+	_, err := io.ReadFull(b, header[:])
+	if err != nil {
+		b.t.Errorf("want nil err reading message; got %v", err)
+		return 0, nil
+	}
+	body = make([]byte, binary.BigEndian.Uint32(header[1:5])-4)
+	_, err = io.ReadFull(b, body)
+	if err != nil {
+		b.t.Errorf("want nil err reading message; got %v", err)
+	}
+	return header[0], body
+}
+
+func (b *fakeBackend) write(data []byte) {
+	_, err := b.Write(data)
+	if err != nil {
+		b.t.Errorf("want nil err writing %#v; got %v", data, err)
+	}
+}
+
+// Build a backend message of the given type out of the body parts.
+func backendMsg(msgType byte, parts ...[]byte) []byte {
+	body := bytes.Join(parts, nil)
+	msg := []byte{msgType, 0x0, 0x0, 0x0, 0x0}
+	binary.BigEndian.PutUint32(msg[1:], uint32(4+len(body)))
+	return append(msg, body...)
+}
+
+// Return a Config whose connections are served by serve over a
+// net.Pipe. The returned channel is closed once serve returns.
+func pipeConfig(t *testing.T, serve func(b *fakeBackend)) (Config, <-chan struct{}) {
+	done := make(chan struct{})
+	config := Config{
+		User:    "bob",
+		SSLMode: SSLModeDisable,
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			client, server := net.Pipe()
+			go func() {
+				defer close(done)
+				defer server.Close()
+				serve(&fakeBackend{server, t})
+			}()
+			return client, nil
+		},
+	}
+	return config, done
+}
+
+var (
+	authOkMsg        = []byte{'R', 0x0, 0x0, 0x0, 0x8, 0x0, 0x0, 0x0, 0x0}
+	readyForQueryMsg = []byte{'Z', 0x0, 0x0, 0x0, 0x5, 'I'}
+	serverVersionMsg = []byte{'S', 0x0, 0x0, 0x0, 0x17,
+		's', 'e', 'r', 'v', 'e', 'r', '_', 'v', 'e', 'r', 's', 'i', 'o', 'n', 0x0,
+		'9', '.', '3', 0x0}
+	backendKeyDataMsg = []byte{'K', 0x0, 0x0, 0x0, 0xc,
+		0x0, 0x0, 0x30, 0x39, // pid
+		0x12, 0x34, 0x56, 0x78, // secret key
+	}
+)
+
+func TestConnect(t *testing.T) {
+	config, done := pipeConfig(t, func(b *fakeBackend) {
+		params := b.readStartup()
+		if params["user"] != "bob" {
+			t.Errorf("want user bob; got %#v", params["user"])
+		}
+		if params["database"] != "db" {
+			t.Errorf("want database db; got %#v", params["database"])
+		}
+		if params["application_name"] != "test" {
+			t.Errorf("want application_name test; got %#v", params["application_name"])
+		}
+		b.write(authOkMsg)
+		b.write(serverVersionMsg)
+		b.write(backendKeyDataMsg)
+		b.write(readyForQueryMsg)
+		msgType, _ := b.readMessage()
+		if msgType != 'X' {
+			t.Errorf("want Terminate; got %q", msgType)
+		}
+	})
+	config.Database = "db"
+	config.Params = map[string]string{"application_name": "test"}
+	c, err := Connect(context.Background(), config)
+	if err != nil {
+		t.Fatalf("want nil err; got %v", err)
+	}
+	if v := c.ParameterStatus("server_version"); v != "9.3" {
+		t.Errorf("want server_version 9.3; got %#v", v)
+	}
+	if keyData := c.BackendKeyData(); keyData == nil ||
+		keyData.Pid != 12345 || !bytes.Equal(keyData.SecretKey, []byte{0x12, 0x34, 0x56, 0x78}) {
+		t.Errorf("want pid 12345 and key 0x12345678; got %#v", keyData)
+	}
+	if status := c.TxStatus(); status != Idle {
+		t.Errorf("want %v; got %v", Idle, status)
+	}
+	err = c.Close()
+	if err != nil {
+		t.Errorf("want nil err; got %v", err)
+	}
+	<-done
+}
+
+func TestConnectCleartextPassword(t *testing.T) {
+	config, done := pipeConfig(t, func(b *fakeBackend) {
+		b.readStartup()
+		b.write([]byte{'R', 0x0, 0x0, 0x0, 0x8, 0x0, 0x0, 0x0, 0x3})
+		msgType, body := b.readMessage()
+		if msgType != 'p' {
+			t.Errorf("want PasswordMessage; got %q", msgType)
+		}
+		compareBytes(t, []byte{'s', 'e', 'k', 'r', 'i', 't', 0x0}, body)
+		b.write(authOkMsg)
+		b.write(readyForQueryMsg)
+	})
+	config.Password = "sekrit"
+	c, err := Connect(context.Background(), config)
+	if err != nil {
+		t.Fatalf("want nil err; got %v", err)
+	}
+	<-done
+	c.conn.Close()
+}
+
+func TestConnectErrorResponse(t *testing.T) {
+	config, done := pipeConfig(t, func(b *fakeBackend) {
+		b.readStartup()
+		b.write(backendMsg('E',
+			[]byte("SFATAL\x00"),
+			[]byte("C28000\x00"),
+			[]byte("Mrole \"bob\" does not exist\x00"),
+			[]byte{0x0}))
+	})
+	_, err := Connect(context.Background(), config)
+	var pgErr *PgError
+	if !errors.As(err, &pgErr) {
+		t.Fatalf("want PgError; got %v", err)
+	}
+	if pgErr.Code != "28000" || pgErr.Message != "role \"bob\" does not exist" {
+		t.Errorf("want role error; got %v", pgErr)
+	}
+	<-done
+}
+
+func TestConnectUnsupportedAuth(t *testing.T) {
+	config, done := pipeConfig(t, func(b *fakeBackend) {
+		b.readStartup()
+		// AuthenticationKerberosV5
+		b.write([]byte{'R', 0x0, 0x0, 0x0, 0x8, 0x0, 0x0, 0x0, 0x2})
+	})
+	_, err := Connect(context.Background(), config)
+	if err == nil {
+		t.Error("want error; got nil")
+	}
+	<-done
+}
+
+func TestConnectNoUser(t *testing.T) {
+	_, err := Connect(context.Background(), Config{})
+	if err == nil {
+		t.Error("want error; got nil")
+	}
+}
+
+var negotiateTests = []struct {
+	negotiate    *NegotiateProtocolVersion
+	version      int32
+	unrecognized []string
+	valid        bool
+}{
+	{nil, ProtocolVersion32, nil, true},
+	{&NegotiateProtocolVersion{0, []string{"_pq_.foo"}}, ProtocolVersion30, []string{"_pq_.foo"}, true},
+	{&NegotiateProtocolVersion{2, []string{"_pq_.foo"}}, ProtocolVersion32, []string{"_pq_.foo"}, true},
+	{&NegotiateProtocolVersion{1, []string{}}, 3<<16 | 1, []string{}, true},
+	{&NegotiateProtocolVersion{3, []string{}}, 0, nil, false},
+	{&NegotiateProtocolVersion{0, []string{"_pq_.bar"}}, 0, nil, false},
+}
+
+func TestConnectNegotiateProtocolVersion(t *testing.T) {
+	for i, tt := range negotiateTests {
+		config, done := pipeConfig(t, func(b *fakeBackend) {
+			p := NewProtoStreamConn(b.Conn)
+			msg, err := p.ReceiveStartupMessage()
+			if err != nil {
+				t.Errorf("%d: want nil err; got %v", i, err)
+				return
+			}
+			startup := msg.(*StartupMessage)
+			if startup.ProtocolVersion != ProtocolVersion32 || startup.Parameters["_pq_.foo"] != "on" {
+				t.Errorf("%d: want 3.2 with _pq_.foo; got %#v", i, startup)
+			}
+			if tt.negotiate != nil {
+				sendAll(t, p, tt.negotiate)
+			}
+			if !tt.valid {
+				return
+			}
+			sendAll(t, p, &AuthResponse{AuthenticationOk, nil}, testIdle)
+			io.Copy(io.Discard, b)
+		})
+		config.ProtocolVersion = ProtocolVersion32
+		config.ProtocolOptions = map[string]string{"_pq_.foo": "on"}
+		c, err := Connect(context.Background(), config)
+		if !tt.valid {
+			if err == nil {
+				t.Errorf("%d: want err; got nil", i)
+				c.Close()
+			}
+			<-done
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%d: want nil err; got %v", i, err)
+		}
+		if version := c.ProtocolVersion(); version != tt.version {
+			t.Errorf("%d: want version %x; got %x", i, tt.version, version)
+		}
+		if unrecognized := c.UnrecognizedProtocolOptions(); !reflect.DeepEqual(tt.unrecognized, unrecognized) {
+			t.Errorf("%d: want unrecognized %v; got %v", i, tt.unrecognized, unrecognized)
+		}
+		c.Close()
+		<-done
+	}
+}
+
+func TestConnectProtocolOptionPrefix(t *testing.T) {
+	config := Config{User: "bob", ProtocolOptions: map[string]string{"foo": "on"}}
+	_, err := Connect(context.Background(), config)
+	if err == nil {
+		t.Error("want error; got nil")
+	}
+}
+
+func TestConnectContextDeadline(t *testing.T) {
+	config, done := pipeConfig(t, func(b *fakeBackend) {
+		b.readStartup()
+		// never answer; wait for the client to give up
+		io.Copy(io.Discard, b)
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := Connect(ctx, config)
+	if err != context.DeadlineExceeded {
+		t.Errorf("want %v; got %v", context.DeadlineExceeded, err)
+	}
+	<-done
+}
+
+var networkTests = []struct {
+	host    string
+	port    int
+	network string
+	addr    string
+}{
+	{"", 0, "tcp", "localhost:5432"},
+	{"db.example.com", 6432, "tcp", "db.example.com:6432"},
+	{"::1", 0, "tcp", "[::1]:5432"},
+	{"/var/run/postgresql", 0, "unix", "/var/run/postgresql/.s.PGSQL.5432"},
+}
+
+func TestConfigNetwork(t *testing.T) {
+	for i, tt := range networkTests {
+		config := Config{Host: tt.host, Port: tt.port}
+		network, addr := config.network()
+		if network != tt.network || addr != tt.addr {
+			t.Errorf("%d: want %v %v; got %v %v", i,
+				tt.network, tt.addr, network, addr)
+		}
+	}
+}
@@ -0,0 +1,368 @@
+package post
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// OIDs of the built-in types CopyFromWriter knows how to encode.
+const (
+	OidBool        Oid = 16
+	OidBytea       Oid = 17
+	OidName        Oid = 19
+	OidInt8        Oid = 20
+	OidInt2        Oid = 21
+	OidInt4        Oid = 23
+	OidText        Oid = 25
+	OidOid         Oid = 26
+	OidJSON        Oid = 114
+	OidFloat4      Oid = 700
+	OidFloat8      Oid = 701
+	OidBpchar      Oid = 1042
+	OidVarchar     Oid = 1043
+	OidDate        Oid = 1082
+	OidTimestamp   Oid = 1114
+	OidTimestamptz Oid = 1184
+	OidUUID        Oid = 2950
+	OidJSONB       Oid = 3802
+)
+
+// The signature, flags, and header extension length that start binary
+// COPY data.
+var copyHeader = []byte("PGCOPY\n\377\r\n\000\000\000\000\000\000\000\000\000")
+
+// How much row data to gather before sending it in a CopyData message.
+const copyChunkSize = 64 * 1024
+
+// The start of 2000, from which binary dates and timestamps count.
+var pgEpoch = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// A CopyFromWriter sends rows to the server for a COPY FROM STDIN in
+// binary format, encoding each value according to the type of its
+// column:
+//
+//	w, err := c.CopyFrom(ctx, "COPY t (id, name) FROM STDIN (FORMAT binary)",
+//		[]Oid{OidInt4, OidText})
+//	err = w.WriteRow(1, "alice")
+//	tag, err := w.Close()
+//
+// Until it is closed or aborted, the Conn cannot be used for anything
+// else.
+type CopyFromWriter struct {
+	r     *Results
+	types []Oid
+	buf   []byte
+	rows  int
+	// the error that ended the copy early, if any
+	err error
+}
+
+// Run sql, which must be a COPY FROM STDIN in binary format, and return
+// a CopyFromWriter for rows whose columns have the given types. If ctx
+// is done before the copy is over, the server is asked to cancel it.
+func (c *Conn) CopyFrom(ctx context.Context, sql string, types []Oid) (*CopyFromWriter, error) {
+	r, err := c.startQuery(ctx, func(p *ProtoStream) error {
+		return p.SendQuery(sql)
+	})
+	if err != nil {
+		return nil, err
+	}
+	for !r.done {
+		msg := r.receive()
+		switch msg := msg.(type) {
+		case nil:
+		case *CopyInResponse:
+			w := &CopyFromWriter{r: r, types: types}
+			w.buf = append(w.buf, copyHeader...)
+			if msg.Format != CopyBinary {
+				return nil, w.abort(errors.New("post: COPY is not in binary format"))
+			}
+			if len(msg.ColumnFormats) != len(types) {
+				return nil, w.abort(fmt.Errorf("post: COPY has %v columns; got %v types",
+					len(msg.ColumnFormats), len(types)))
+			}
+			return w, nil
+		default:
+			r.unexpected(msg)
+		}
+	}
+	if r.err == nil {
+		return nil, errors.New("post: query did not start a COPY FROM STDIN")
+	}
+	return nil, r.err
+}
+
+// Write a row, with one value for each column, or nil for NULL. Values
+// are converted to the column type where that loses nothing, e.g., any
+// integer that fits in an int4; a []byte is taken to be the value in
+// binary format already. If a value cannot be encoded, the copy is
+// aborted and the error returned.
+func (w *CopyFromWriter) WriteRow(values ...interface{}) error {
+	if w.err != nil {
+		return w.err
+	}
+	if len(values) != len(w.types) {
+		return w.abort(fmt.Errorf("post: row %d has %v values for %v columns",
+			w.rows+1, len(values), len(w.types)))
+	}
+	start := len(w.buf)
+	w.buf = appendInt16(w.buf, int16(len(values)))
+	for i, value := range values {
+		var err error
+		w.buf, err = appendBinaryValue(w.buf, w.types[i], value)
+		if err != nil {
+			w.buf = w.buf[:start]
+			return w.abort(fmt.Errorf("post: row %d, column %d: %w", w.rows+1, i+1, err))
+		}
+	}
+	w.rows++
+	if len(w.buf) >= copyChunkSize {
+		err := w.r.c.proto.SendCopyData(w.buf)
+		if err != nil {
+			w.r.fail(err)
+			w.err = w.r.err
+			return w.err
+		}
+		w.buf = w.buf[:0]
+	}
+	return nil
+}
+
+// Finish the copy, and return the command tag, e.g., "COPY 2". Errors
+// reported by the server, such as a constraint violation by one of the
+// rows, are returned as a *PgError.
+func (w *CopyFromWriter) Close() (CommandTag, error) {
+	if w.err != nil || w.r.done {
+		return w.r.tag, w.err
+	}
+	// the trailer: a tuple of -1 fields
+	w.buf = appendInt16(w.buf, -1)
+	err := w.r.c.proto.SendCopyData(w.buf)
+	if err == nil {
+		err = w.r.c.proto.SendCopyDone()
+	}
+	if err == nil {
+		err = w.r.c.proto.Flush()
+	}
+	if err != nil {
+		w.r.fail(err)
+	}
+	w.buf = nil
+	for !w.r.done {
+		msg := w.r.receive()
+		switch msg := msg.(type) {
+		case nil:
+		case *CommandComplete:
+			w.r.tag = msg.Tag
+		default:
+			w.r.unexpected(msg)
+		}
+	}
+	w.err = w.r.err
+	return w.r.tag, w.err
+}
+
+// Abort the copy with a CopyFail carrying err's message, so that none of
+// the rows are kept. WriteRow and Close return err from then on. The
+// error returned is only for problems talking to the server.
+func (w *CopyFromWriter) Abort(err error) error {
+	if w.err != nil || w.r.done {
+		return nil
+	}
+	w.abort(err)
+	if _, ok := w.r.err.(*PgError); ok || w.r.err == nil {
+		return nil
+	}
+	return w.r.err
+}
+
+// Abort the copy with err, and return it.
+func (w *CopyFromWriter) abort(err error) error {
+	w.err = err
+	w.buf = nil
+	sendErr := w.r.c.proto.SendCopyFail(err.Error())
+	if sendErr == nil {
+		sendErr = w.r.c.proto.Flush()
+	}
+	if sendErr != nil {
+		w.r.fail(sendErr)
+	}
+	// the server answers with an error, which is expected
+	for !w.r.done {
+		if msg := w.r.receive(); msg != nil {
+			w.r.unexpected(msg)
+		}
+	}
+	return err
+}
+
+// Append a value in the binary format of the given type, preceded by
+// its length.
+func appendBinaryValue(dst []byte, typ Oid, value interface{}) ([]byte, error) {
+	switch value := value.(type) {
+	case nil:
+		return appendInt32(dst, -1), nil
+	case []byte:
+		if value == nil {
+			return appendInt32(dst, -1), nil
+		}
+		dst = appendInt32(dst, int32(len(value)))
+		return append(dst, value...), nil
+	}
+	start := len(dst)
+	dst = append(dst, 0, 0, 0, 0)
+	dst, err := appendBinary(dst, typ, value)
+	if err != nil {
+		return dst[:start], err
+	}
+	be.PutUint32(dst[start:], uint32(len(dst)-start-4))
+	return dst, nil
+}
+
+// Append a non-nil value in the binary format of the given type.
+func appendBinary(dst []byte, typ Oid, value interface{}) ([]byte, error) {
+	switch typ {
+	case OidBool:
+		if value, ok := value.(bool); ok {
+			if value {
+				return append(dst, 1), nil
+			}
+			return append(dst, 0), nil
+		}
+	case OidBytea:
+		if value, ok := value.(string); ok {
+			return append(dst, value...), nil
+		}
+	case OidText, OidVarchar, OidBpchar, OidName, OidJSON:
+		if value, ok := textValue(value); ok {
+			return append(dst, value...), nil
+		}
+	case OidJSONB:
+		if value, ok := textValue(value); ok {
+			// format version 1
+			return append(append(dst, 1), value...), nil
+		}
+	case OidInt2, OidInt4, OidInt8, OidOid:
+		n, ok := intValue(value)
+		if !ok {
+			break
+		}
+		switch {
+		case typ == OidInt2 && n >= math.MinInt16 && n <= math.MaxInt16:
+			return appendInt16(dst, int16(n)), nil
+		case typ == OidInt4 && n >= math.MinInt32 && n <= math.MaxInt32:
+			return appendInt32(dst, int32(n)), nil
+		case typ == OidOid && n >= 0 && n <= math.MaxUint32:
+			return appendInt32(dst, int32(uint32(n))), nil
+		case typ == OidInt8:
+			return appendInt64(dst, n), nil
+		}
+		return dst, fmt.Errorf("%v out of range for type %v", value, typ)
+	case OidFloat4, OidFloat8:
+		var f float64
+		switch value := value.(type) {
+		case float32:
+			f = float64(value)
+		case float64:
+			f = value
+		default:
+			n, ok := intValue(value)
+			if !ok {
+				return dst, fmt.Errorf("cannot encode %T as type %v", value, typ)
+			}
+			f = float64(n)
+			if typ == OidFloat4 {
+				f = float64(float32(n))
+			}
+			// 1<<63 is where int64(f) would overflow
+			if f >= 1<<63 || int64(f) != n {
+				return dst, fmt.Errorf("%v cannot be represented exactly as type %v", value, typ)
+			}
+		}
+		if typ == OidFloat4 {
+			return appendInt32(dst, int32(math.Float32bits(float32(f)))), nil
+		}
+		return appendInt64(dst, int64(math.Float64bits(f))), nil
+	case OidDate, OidTimestamp, OidTimestamptz:
+		t, ok := value.(time.Time)
+		if !ok {
+			break
+		}
+		switch typ {
+		case OidDate:
+			// the day of the date in its own location
+			secs := wallClock(t).Unix() - pgEpoch.Unix()
+			days := secs / (24 * 60 * 60)
+			if secs < 0 && secs%(24*60*60) != 0 {
+				days--
+			}
+			return appendInt32(dst, int32(days)), nil
+		case OidTimestamp:
+			return appendInt64(dst, wallClock(t).UnixMicro()-pgEpoch.UnixMicro()), nil
+		}
+		return appendInt64(dst, t.UnixMicro()-pgEpoch.UnixMicro()), nil
+	case OidUUID:
+		switch value := value.(type) {
+		case [16]byte:
+			return append(dst, value[:]...), nil
+		case string:
+			uuid, err := hex.DecodeString(strings.ReplaceAll(value, "-", ""))
+			if err != nil || len(uuid) != 16 {
+				return dst, fmt.Errorf("invalid UUID %q", value)
+			}
+			return append(dst, uuid...), nil
+		}
+	default:
+		return dst, fmt.Errorf("unsupported column type %v", typ)
+	}
+	return dst, fmt.Errorf("cannot encode %T as type %v", value, typ)
+}
+
+// Get the time with the same date and clock reading in UTC.
+func wallClock(t time.Time) time.Time {
+	year, month, day := t.Date()
+	hour, min, sec := t.Clock()
+	return time.Date(year, month, day, hour, min, sec, t.Nanosecond(), time.UTC)
+}
+
+func textValue(value interface{}) (string, bool) {
+	switch value := value.(type) {
+	case string:
+		return value, true
+	case fmt.Stringer:
+		return value.String(), true
+	}
+	return "", false
+}
+
+// Get any integer as an int64, if it fits.
+func intValue(value interface{}) (int64, bool) {
+	switch value := value.(type) {
+	case int:
+		return int64(value), true
+	case int8:
+		return int64(value), true
+	case int16:
+		return int64(value), true
+	case int32:
+		return int64(value), true
+	case int64:
+		return value, true
+	case uint:
+		return int64(value), uint64(value) <= math.MaxInt64
+	case uint8:
+		return int64(value), true
+	case uint16:
+		return int64(value), true
+	case uint32:
+		return int64(value), true
+	case uint64:
+		return int64(value), value <= math.MaxInt64
+	}
+	return 0, false
+}
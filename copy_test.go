@@ -0,0 +1,255 @@
+package post
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+var copyInBinary = &CopyInResponse{CopyBinary, []DataFormat{BinaryFormat, BinaryFormat}}
+
+// Receive CopyData messages up to the CopyDone or CopyFail, and return
+// their data, how many there were, and the final message.
+func receiveCopy(t *testing.T, p *ProtoStream) ([]byte, int, FrontendMessage) {
+	var data []byte
+	for chunks := 0; ; chunks++ {
+		next, err := p.Next()
+		if err != nil {
+			t.Errorf("want nil err; got %v", err)
+			return data, chunks, nil
+		}
+		msg := newFrontendMessage(next)
+		err = p.receive(msg)
+		if err != nil {
+			t.Errorf("want nil err; got %v", err)
+		}
+		copyData, ok := msg.(*CopyData)
+		if !ok {
+			return data, chunks, msg
+		}
+		data = append(data, copyData.Data...)
+	}
+}
+
+func TestCopyFrom(t *testing.T) {
+	c, done := connectServing(t, func(p *ProtoStream) {
+		receiveAll(t, p, MsgQuery)
+		sendAll(t, p, copyInBinary)
+		data, _, end := receiveCopy(t, p)
+		if _, ok := end.(*CopyDone); !ok {
+			t.Errorf("want CopyDone; got %#v", end)
+		}
+		expected := append([]byte(nil), copyHeader...)
+		expected = append(expected,
+			0, 2, 0, 0, 0, 4, 0, 0, 0, 1, 0, 0, 0, 5, 'a', 'l', 'i', 'c', 'e',
+			0, 2, 0, 0, 0, 4, 0, 0, 0, 2, 0xff, 0xff, 0xff, 0xff,
+			0xff, 0xff)
+		if !bytes.Equal(expected, data) {
+			t.Errorf("want %x; got %x", expected, data)
+		}
+		sendAll(t, p, &CommandComplete{"COPY 2"}, testIdle)
+		p.ReceiveFrontendMessage()
+	})
+	defer func() { <-done }()
+	defer c.Close()
+
+	w, err := c.CopyFrom(context.Background(), "COPY t FROM STDIN (FORMAT binary)",
+		[]Oid{OidInt4, OidText})
+	if err != nil {
+		t.Fatalf("want nil err; got %v", err)
+	}
+	if err := w.WriteRow(1, "alice"); err != nil {
+		t.Errorf("want nil err; got %v", err)
+	}
+	if err := w.WriteRow(uint8(2), nil); err != nil {
+		t.Errorf("want nil err; got %v", err)
+	}
+	tag, err := w.Close()
+	if err != nil || tag != "COPY 2" {
+		t.Errorf("want COPY 2; got %v, %v", tag, err)
+	}
+}
+
+func TestCopyFromChunks(t *testing.T) {
+	row := strings.Repeat("x", 1000)
+	c, done := connectServing(t, func(p *ProtoStream) {
+		receiveAll(t, p, MsgQuery)
+		sendAll(t, p, &CopyInResponse{CopyBinary, []DataFormat{BinaryFormat}})
+		data, chunks, _ := receiveCopy(t, p)
+		if expected := len(copyHeader) + 1000*(2+4+len(row)) + 2; len(data) != expected {
+			t.Errorf("want %v bytes; got %v", expected, len(data))
+		}
+		// chunks of about copyChunkSize
+		if chunks < 10 || chunks > 20 {
+			t.Errorf("want 10 to 20 chunks; got %v", chunks)
+		}
+		sendAll(t, p, &CommandComplete{"COPY 1000"}, testIdle)
+		p.ReceiveFrontendMessage()
+	})
+	defer func() { <-done }()
+	defer c.Close()
+
+	w, err := c.CopyFrom(context.Background(), "COPY t FROM STDIN (FORMAT binary)",
+		[]Oid{OidText})
+	if err != nil {
+		t.Fatalf("want nil err; got %v", err)
+	}
+	for i := 0; i < 1000; i++ {
+		if err := w.WriteRow(row); err != nil {
+			t.Fatalf("want nil err; got %v", err)
+		}
+	}
+	if tag, err := w.Close(); err != nil || tag.RowsAffected() != 1000 {
+		t.Errorf("want COPY 1000; got %v, %v", tag, err)
+	}
+}
+
+var copyFailed = &PgError{Severity: "ERROR", Code: "57014", Message: "COPY from stdin failed"}
+
+func TestCopyFromAbort(t *testing.T) {
+	c, done := connectServing(t, func(p *ProtoStream) {
+		for i := 0; i < 3; i++ {
+			receiveAll(t, p, MsgQuery)
+			sendAll(t, p, copyInBinary)
+			_, _, end := receiveCopy(t, p)
+			if _, ok := end.(*CopyFail); !ok {
+				t.Errorf("%d: want CopyFail; got %#v", i, end)
+			}
+			sendAll(t, p, copyFailed, testIdle)
+		}
+		p.ReceiveFrontendMessage()
+	})
+	defer func() { <-done }()
+	defer c.Close()
+	ctx := context.Background()
+	types := []Oid{OidInt4, OidText}
+
+	w, err := c.CopyFrom(ctx, "COPY t FROM STDIN (FORMAT binary)", types)
+	if err != nil {
+		t.Fatalf("want nil err; got %v", err)
+	}
+	err = w.WriteRow("one", "alice")
+	if err == nil {
+		t.Error("want err; got nil")
+	}
+	if _, closeErr := w.Close(); closeErr != err {
+		t.Errorf("want %v; got %v", err, closeErr)
+	}
+
+	w, err = c.CopyFrom(ctx, "COPY t FROM STDIN (FORMAT binary)", types)
+	if err != nil {
+		t.Fatalf("want nil err; got %v", err)
+	}
+	if err := w.WriteRow(1); err == nil {
+		t.Error("want err for missing value; got nil")
+	}
+
+	w, err = c.CopyFrom(ctx, "COPY t FROM STDIN (FORMAT binary)", types)
+	if err != nil {
+		t.Fatalf("want nil err; got %v", err)
+	}
+	abortErr := errors.New("source failed")
+	if err := w.Abort(abortErr); err != nil {
+		t.Errorf("want nil err; got %v", err)
+	}
+	if err := w.WriteRow(1, "alice"); err != abortErr {
+		t.Errorf("want %v; got %v", abortErr, err)
+	}
+}
+
+func TestCopyFromNotBinary(t *testing.T) {
+	c, done := connectServing(t, func(p *ProtoStream) {
+		receiveAll(t, p, MsgQuery)
+		sendAll(t, p, &CopyInResponse{CopyText, []DataFormat{TextFormat, TextFormat}})
+		receiveAll(t, p, MsgCopyFail)
+		sendAll(t, p, copyFailed, testIdle)
+
+		receiveAll(t, p, MsgQuery)
+		sendAll(t, p, testErr, testIdle)
+		p.ReceiveFrontendMessage()
+	})
+	defer func() { <-done }()
+	defer c.Close()
+	ctx := context.Background()
+	types := []Oid{OidInt4, OidText}
+
+	if _, err := c.CopyFrom(ctx, "COPY t FROM STDIN", types); err == nil {
+		t.Error("want err; got nil")
+	}
+	_, err := c.CopyFrom(ctx, "COPY nope FROM STDIN (FORMAT binary)", types)
+	if pgErr, ok := err.(*PgError); !ok || pgErr.Code != "42P01" {
+		t.Errorf("want 42P01 error; got %v", err)
+	}
+}
+
+type stringer string
+
+func (s stringer) String() string { return string(s) }
+
+func TestAppendBinaryValue(t *testing.T) {
+	pst := time.FixedZone("", -8*3600)
+	var binaryTests = []struct {
+		typ      Oid
+		value    interface{}
+		expected []byte
+	}{
+		{OidInt4, nil, []byte{0xff, 0xff, 0xff, 0xff}},
+		{OidInt4, []byte{0, 0, 0, 7}, []byte{0, 0, 0, 4, 0, 0, 0, 7}},
+		{OidBool, true, []byte{0, 0, 0, 1, 1}},
+		{OidBytea, "ab", []byte{0, 0, 0, 2, 'a', 'b'}},
+		{OidVarchar, stringer("ab"), []byte{0, 0, 0, 2, 'a', 'b'}},
+		{OidJSONB, "{}", []byte{0, 0, 0, 3, 1, '{', '}'}},
+		{OidInt2, -2, []byte{0, 0, 0, 2, 0xff, 0xfe}},
+		{OidInt8, uint32(1 << 31), []byte{0, 0, 0, 8, 0, 0, 0, 0, 0x80, 0, 0, 0}},
+		{OidOid, 1 << 31, []byte{0, 0, 0, 4, 0x80, 0, 0, 0}},
+		{OidFloat4, 1.5, []byte{0, 0, 0, 4, 0x3f, 0xc0, 0, 0}},
+		{OidFloat8, 2, []byte{0, 0, 0, 8, 0x40, 0, 0, 0, 0, 0, 0, 0}},
+		{OidFloat4, 1 << 24, []byte{0, 0, 0, 4, 0x4b, 0x80, 0, 0}},
+		{OidDate, time.Date(2000, 1, 2, 23, 0, 0, 0, pst), []byte{0, 0, 0, 4, 0, 0, 0, 1}},
+		{OidDate, time.Date(1999, 12, 31, 12, 0, 0, 0, time.UTC), []byte{0, 0, 0, 4, 0xff, 0xff, 0xff, 0xff}},
+		{OidTimestamp, time.Date(2000, 1, 1, 0, 0, 1, 0, pst),
+			[]byte{0, 0, 0, 8, 0, 0, 0, 0, 0, 0x0f, 0x42, 0x40}},
+		{OidTimestamptz, time.Date(1999, 12, 31, 16, 0, 1, 0, pst),
+			[]byte{0, 0, 0, 8, 0, 0, 0, 0, 0, 0x0f, 0x42, 0x40}},
+		{OidUUID, "00010203-0405-0607-0809-0a0b0c0d0e0f",
+			[]byte{0, 0, 0, 16, 0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}},
+	}
+	for i, tt := range binaryTests {
+		actual, err := appendBinaryValue(nil, tt.typ, tt.value)
+		if err != nil {
+			t.Errorf("%d: want nil err; got %v", i, err)
+		}
+		if !bytes.Equal(tt.expected, actual) {
+			t.Errorf("%d: want %x; got %x", i, tt.expected, actual)
+		}
+	}
+
+	var errorTests = []struct {
+		typ   Oid
+		value interface{}
+	}{
+		{OidInt2, 1 << 15},
+		{OidInt4, "1"},
+		{OidOid, -1},
+		{OidInt8, uint64(1 << 63)},
+		{OidFloat4, 1<<24 + 1},
+		{OidFloat8, 1<<53 + 1},
+		{OidFloat8, math.MaxInt64},
+		{OidBool, 1},
+		{OidUUID, "nope"},
+		{Oid(1700), 1},
+	}
+	for i, tt := range errorTests {
+		actual, err := appendBinaryValue([]byte{1}, tt.typ, tt.value)
+		if err == nil {
+			t.Errorf("%d: want err; got nil", i)
+		}
+		if !bytes.Equal([]byte{1}, actual) {
+			t.Errorf("%d: want dst unchanged; got %x", i, actual)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package post
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Helpers for encoding and decoding message bodies held in memory, as
+// opposed to the Stream methods, which work directly on the wire.
+
+func appendInt16(dst []byte, val int16) []byte {
+	return append(dst, byte(val>>8), byte(val))
+}
+
+func appendInt32(dst []byte, val int32) []byte {
+	return append(dst, byte(val>>24), byte(val>>16), byte(val>>8), byte(val))
+}
+
+func appendInt64(dst []byte, val int64) []byte {
+	return appendInt32(appendInt32(dst, int32(val>>32)), int32(val))
+}
+
+func appendCString(dst []byte, val string) []byte {
+	dst = append(dst, val...)
+	return append(dst, 0)
+}
+
+// Start a message of the given type, leaving room for the length, which
+// is filled in by finishMessage. Returns the extended dst and the offset
+// of the length.
+func beginMessage(dst []byte, msgType MessageType) ([]byte, int) {
+	dst = append(dst, byte(msgType))
+	return append(dst, 0, 0, 0, 0), len(dst)
+}
+
+// Start a startup-phase message, which has no type byte.
+func beginUntypedMessage(dst []byte) ([]byte, int) {
+	return append(dst, 0, 0, 0, 0), len(dst)
+}
+
+// Fill in the length of a message begun at offset start.
+func finishMessage(dst []byte, start int) []byte {
+	be.PutUint32(dst[start:], uint32(len(dst)-start))
+	return dst
+}
+
+// A msgReader decodes a message body held in memory. The first error
+// sticks: later reads return zero values, and err reports it.
+type msgReader struct {
+	name string
+	src  []byte
+	err  error
+}
+
+func newMsgReader(name string, src []byte) *msgReader {
+	return &msgReader{name: name, src: src}
+}
+
+func (r *msgReader) fail(format string, args ...interface{}) {
+	if r.err == nil {
+		r.err = fmt.Errorf("post: invalid %v: %v", r.name, fmt.Sprintf(format, args...))
+	}
+}
+
+func (r *msgReader) byte1() byte {
+	b := r.bytes(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (r *msgReader) int16() int16 {
+	b := r.bytes(2)
+	if b == nil {
+		return 0
+	}
+	return int16(be.Uint16(b))
+}
+
+func (r *msgReader) int32() int32 {
+	b := r.bytes(4)
+	if b == nil {
+		return 0
+	}
+	return int32(be.Uint32(b))
+}
+
+func (r *msgReader) cstring() string {
+	if r.err != nil {
+		return ""
+	}
+	i := bytes.IndexByte(r.src, 0)
+	if i < 0 {
+		r.fail("unterminated string")
+		return ""
+	}
+	str := string(r.src[:i])
+	r.src = r.src[i+1:]
+	return str
+}
+
+// Read n bytes. The result aliases the source.
+func (r *msgReader) bytes(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(r.src) {
+		r.fail("need %v bytes; have %v", n, len(r.src))
+		return nil
+	}
+	b := r.src[:n:n]
+	r.src = r.src[n:]
+	return b
+}
+
+// Read a count of items that take at least size bytes each, making sure
+// it is plausible before anything is allocated for them.
+func (r *msgReader) count(size int) int {
+	n := int(r.int16())
+	if n < 0 || n*size > len(r.src) {
+		r.fail("bad count %v", n)
+		return 0
+	}
+	return n
+}
+
+// Read the rest of the body.
+func (r *msgReader) rest() []byte {
+	return r.bytes(len(r.src))
+}
+
+// Finish decoding, checking that the whole body was consumed.
+func (r *msgReader) finish() error {
+	if r.err == nil && len(r.src) > 0 {
+		r.fail("%v trailing bytes", len(r.src))
+	}
+	return r.err
+}
@@ -0,0 +1,116 @@
+package post
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// A PgError is an error reported by the server in an ErrorResponse. The
+// fields are described in the "Error and Notice Message Fields" section
+// of the protocol documentation; any may be empty if the server did not
+// send them.
+type PgError struct {
+	// The severity, e.g., ERROR or FATAL, possibly localized.
+	Severity string
+	// The severity, never localized. Only sent by 9.6 and newer servers.
+	SeverityNonLocalized string
+	// The SQLSTATE code; package sqlstate has constants for all codes.
+	Code string
+	// The primary human-readable error message.
+	Message string
+	Detail  string
+	Hint    string
+	// The 1-based character index of the error in the original query
+	// string, or 0 if not applicable.
+	Position int
+	// Like Position, but for an internally-generated query, which is
+	// given by InternalQuery.
+	InternalPosition int
+	InternalQuery    string
+	// The context in which the error occurred, e.g., a call stack of
+	// PL/pgSQL functions.
+	Where      string
+	Schema     string
+	Table      string
+	Column     string
+	DataType   string
+	Constraint string
+	// The location in the server source code where the error was
+	// reported.
+	File    string
+	Line    int
+	Routine string
+
+	// All fields exactly as sent by the server, including any not
+	// broken out above.
+	Fields map[ErrorField]string
+}
+
+// A Notice is a message from the server that is not an error, sent in a
+// NoticeResponse. It carries the same fields as a PgError.
+type Notice PgError
+
+// Build a PgError out of the fields of an ErrorResponse or a
+// NoticeResponse.
+func NewPgError(fields map[ErrorField]string) *PgError {
+	return &PgError{
+		Severity:             fields[Severity],
+		SeverityNonLocalized: fields[SeverityNonLocalized],
+		Code:                 fields[Code],
+		Message:              fields[Message],
+		Detail:               fields[Detail],
+		Hint:                 fields[Hint],
+		Position:             atoiOrZero(fields[Position]),
+		InternalPosition:     atoiOrZero(fields[InternalPosition]),
+		InternalQuery:        fields[InternalQuery],
+		Where:                fields[Where],
+		Schema:               fields[Schema],
+		Table:                fields[Table],
+		Column:               fields[Column],
+		DataType:             fields[DataType],
+		Constraint:           fields[Constraint],
+		File:                 fields[File],
+		Line:                 atoiOrZero(fields[Line]),
+		Routine:              fields[Routine],
+		Fields:               fields,
+	}
+}
+
+func (e *PgError) Error() string {
+	return e.Severity + ": " + e.Message + " (SQLSTATE " + e.Code + ")"
+}
+
+func atoiOrZero(val string) int {
+	i, err := strconv.Atoi(val)
+	if err != nil {
+		return 0
+	}
+	return i
+}
+
+// An UnexpectedMessageError is returned when the server sends a message
+// other than the one expected.
+type UnexpectedMessageError struct {
+	Expected MessageType
+	Actual   MessageType
+	// The server's error, if the unexpected message was an
+	// ErrorResponse.
+	Err *PgError
+}
+
+func (e *UnexpectedMessageError) Error() string {
+	msg := fmt.Sprintf("post: expected message type %q; got %q",
+		byte(e.Expected), byte(e.Actual))
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+// Unwrap returns the server's error, if any, for use with errors.As.
+func (e *UnexpectedMessageError) Unwrap() error {
+	if e.Err == nil {
+		return nil
+	}
+	return e.Err
+}
@@ -0,0 +1,81 @@
+package post
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestNewPgError(t *testing.T) {
+	fields := map[ErrorField]string{
+		Severity:             "ERROR",
+		SeverityNonLocalized: "ERROR",
+		Code:                 "23505",
+		Message:              "duplicate key value violates unique constraint \"users_pkey\"",
+		Detail:               "Key (id)=(1) already exists.",
+		Position:             "15",
+		Schema:               "public",
+		Table:                "users",
+		Constraint:           "users_pkey",
+		File:                 "nbtinsert.c",
+		Line:                 "664",
+		Routine:              "_bt_check_unique",
+		ErrorField('Z'):      "from the future",
+	}
+	pgErr := NewPgError(fields)
+	if pgErr.Severity != "ERROR" || pgErr.SeverityNonLocalized != "ERROR" {
+		t.Errorf("want severity ERROR; got %v, %v", pgErr.Severity, pgErr.SeverityNonLocalized)
+	}
+	if pgErr.Code != "23505" {
+		t.Errorf("want code 23505; got %v", pgErr.Code)
+	}
+	if pgErr.Position != 15 {
+		t.Errorf("want position 15; got %v", pgErr.Position)
+	}
+	if pgErr.Line != 664 {
+		t.Errorf("want line 664; got %v", pgErr.Line)
+	}
+	if pgErr.Schema != "public" || pgErr.Table != "users" || pgErr.Constraint != "users_pkey" {
+		t.Errorf("want public.users constraint users_pkey; got %v.%v constraint %v",
+			pgErr.Schema, pgErr.Table, pgErr.Constraint)
+	}
+	if pgErr.Routine != "_bt_check_unique" || pgErr.File != "nbtinsert.c" {
+		t.Errorf("want _bt_check_unique in nbtinsert.c; got %v in %v", pgErr.Routine, pgErr.File)
+	}
+	if extra := pgErr.Fields[ErrorField('Z')]; extra != "from the future" {
+		t.Errorf("want unknown field kept; got %#v", extra)
+	}
+}
+
+func TestNewPgErrorBadNumbers(t *testing.T) {
+	pgErr := NewPgError(map[ErrorField]string{Position: "x", Line: ""})
+	if pgErr.Position != 0 || pgErr.Line != 0 {
+		t.Errorf("want zero position and line; got %v, %v", pgErr.Position, pgErr.Line)
+	}
+	if pgErr.Fields[Position] != "x" {
+		t.Errorf("want raw position kept; got %#v", pgErr.Fields[Position])
+	}
+}
+
+func TestPgErrorError(t *testing.T) {
+	pgErr := NewPgError(map[ErrorField]string{
+		Severity: "FATAL",
+		Code:     "28000",
+		Message:  "role \"bob\" does not exist",
+	})
+	expected := "FATAL: role \"bob\" does not exist (SQLSTATE 28000)"
+	if msg := pgErr.Error(); msg != expected {
+		t.Errorf("want %v; got %v", expected, msg)
+	}
+}
+
+func TestPgErrorAs(t *testing.T) {
+	var err error = fmt.Errorf("connecting: %w", NewPgError(map[ErrorField]string{Code: "28000"}))
+	var pgErr *PgError
+	if !errors.As(err, &pgErr) {
+		t.Fatal("want errors.As to find PgError")
+	}
+	if pgErr.Code != "28000" {
+		t.Errorf("want code 28000; got %v", pgErr.Code)
+	}
+}
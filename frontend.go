@@ -0,0 +1,541 @@
+package post
+
+import (
+	"sort"
+)
+
+// Protocol versions for a StartupMessage: 3.0, requested by
+// SendStartupMessage, and 3.2, which allows longer secret keys for
+// cancel requests (PostgreSQL 18 and up).
+const (
+	ProtocolVersion30 = 3<<16 | 0
+	ProtocolVersion32 = 3<<16 | 2
+)
+
+// Codes sent in place of a protocol version for the special startup-phase
+// requests.
+const (
+	cancelRequestCode = 80877102
+	sslRequestCode    = 80877103
+	gssEncRequestCode = 80877104
+)
+
+// A FrontendMessage is a message sent by the client.
+//
+// Encode appends the complete message, including its type byte (if
+// any) and length, to dst and returns the result. Decode does the
+// reverse for the message body: the bytes after the type byte and the
+// length. Decoded byte slices alias src.
+type FrontendMessage interface {
+	Encode(dst []byte) []byte
+	Decode(src []byte) error
+}
+
+type StartupMessage struct {
+	ProtocolVersion int32
+	Parameters      map[string]string
+}
+
+type SSLRequest struct{}
+
+type GSSENCRequest struct{}
+
+type CancelRequest struct {
+	Pid       int32
+	SecretKey []byte
+}
+
+type Bind struct {
+	Portal           string
+	Statement        string
+	ParameterFormats []DataFormat
+	// The parameter values; a nil value is NULL.
+	Parameters    [][]byte
+	ResultFormats []DataFormat
+}
+
+type Close struct {
+	Kind TargetKind
+	Name string
+}
+
+type CopyFail struct {
+	Reason string
+}
+
+type Describe struct {
+	Kind TargetKind
+	Name string
+}
+
+type Execute struct {
+	Portal string
+	// The maximum number of rows to return, or 0 for no limit.
+	MaxRows int32
+}
+
+type Flush struct{}
+
+// A FunctionCall calls a function directly, outside of any query.
+type FunctionCall struct {
+	FunctionOid Oid
+	ArgFormats  []DataFormat
+	// The argument values; a nil value is NULL.
+	Arguments    [][]byte
+	ResultFormat DataFormat
+}
+
+// A GSSResponse carries the client's side of a GSSAPI or SSPI exchange.
+type GSSResponse struct {
+	Data []byte
+}
+
+type Parse struct {
+	Name           string
+	Query          string
+	ParameterTypes []Oid
+}
+
+type PasswordMessage struct {
+	Password string
+}
+
+type Query struct {
+	Query string
+}
+
+type SASLInitialResponse struct {
+	Mechanism string
+	// The initial client response; nil if there is none.
+	Data []byte
+}
+
+type SASLResponse struct {
+	Data []byte
+}
+
+type Sync struct{}
+
+type Terminate struct{}
+
+// Allocate the startup-phase message matching the code at the start of
+// body, where a StartupMessage has its protocol version.
+func newStartupMessage(body []byte) FrontendMessage {
+	var code int32
+	if len(body) >= 4 {
+		code = int32(be.Uint32(body))
+	}
+	switch code {
+	case sslRequestCode:
+		return &SSLRequest{}
+	case gssEncRequestCode:
+		return &GSSENCRequest{}
+	case cancelRequestCode:
+		return &CancelRequest{}
+	default:
+		return &StartupMessage{}
+	}
+}
+
+// Allocate the frontend message for the given type. Unknown types, and
+// the type shared by PasswordMessage, SASLInitialResponse, SASLResponse,
+// and GSSResponse, get an *UnknownMessage.
+func newFrontendMessage(msgType MessageType) FrontendMessage {
+	switch msgType {
+	case MsgBind:
+		return &Bind{}
+	case MsgClose:
+		return &Close{}
+	case MsgCopyData:
+		return &CopyData{}
+	case MsgCopyDone:
+		return &CopyDone{}
+	case MsgCopyFail:
+		return &CopyFail{}
+	case MsgDescribe:
+		return &Describe{}
+	case MsgExecute:
+		return &Execute{}
+	case MsgFlush:
+		return &Flush{}
+	case MsgFunctionCall:
+		return &FunctionCall{}
+	case MsgParse:
+		return &Parse{}
+	case MsgQuery:
+		return &Query{}
+	case MsgSync:
+		return &Sync{}
+	case MsgTerminate:
+		return &Terminate{}
+	default:
+		return &UnknownMessage{MsgType: msgType}
+	}
+}
+
+func (m *StartupMessage) Encode(dst []byte) []byte {
+	dst, start := beginUntypedMessage(dst)
+	dst = appendInt32(dst, m.ProtocolVersion)
+	// sort the parameters so the encoding is deterministic
+	keys := make([]string, 0, len(m.Parameters))
+	for key := range m.Parameters {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		dst = appendCString(dst, key)
+		dst = appendCString(dst, m.Parameters[key])
+	}
+	dst = append(dst, 0)
+	return finishMessage(dst, start)
+}
+
+func (m *StartupMessage) Decode(src []byte) error {
+	r := newMsgReader("StartupMessage", src)
+	m.ProtocolVersion = r.int32()
+	m.Parameters = make(map[string]string)
+	for r.err == nil {
+		key := r.cstring()
+		if key == "" {
+			break
+		}
+		m.Parameters[key] = r.cstring()
+	}
+	return r.finish()
+}
+
+func (m *SSLRequest) Encode(dst []byte) []byte {
+	return encodeRequestCode(dst, sslRequestCode)
+}
+
+func (m *SSLRequest) Decode(src []byte) error {
+	return decodeRequestCode("SSLRequest", src, sslRequestCode)
+}
+
+func (m *GSSENCRequest) Encode(dst []byte) []byte {
+	return encodeRequestCode(dst, gssEncRequestCode)
+}
+
+func (m *GSSENCRequest) Decode(src []byte) error {
+	return decodeRequestCode("GSSENCRequest", src, gssEncRequestCode)
+}
+
+func encodeRequestCode(dst []byte, code int32) []byte {
+	dst, start := beginUntypedMessage(dst)
+	dst = appendInt32(dst, code)
+	return finishMessage(dst, start)
+}
+
+func decodeRequestCode(name string, src []byte, code int32) error {
+	r := newMsgReader(name, src)
+	if actual := r.int32(); r.err == nil && actual != code {
+		r.fail("request code %v", actual)
+	}
+	return r.finish()
+}
+
+func (m *CancelRequest) Encode(dst []byte) []byte {
+	dst, start := beginUntypedMessage(dst)
+	dst = appendInt32(dst, cancelRequestCode)
+	dst = appendInt32(dst, m.Pid)
+	dst = append(dst, m.SecretKey...)
+	return finishMessage(dst, start)
+}
+
+func (m *CancelRequest) Decode(src []byte) error {
+	r := newMsgReader("CancelRequest", src)
+	if code := r.int32(); r.err == nil && code != cancelRequestCode {
+		r.fail("request code %v", code)
+	}
+	m.Pid = r.int32()
+	m.SecretKey = r.secretKey()
+	return r.finish()
+}
+
+func (m *Bind) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, MsgBind)
+	dst = appendCString(dst, m.Portal)
+	dst = appendCString(dst, m.Statement)
+	dst = appendFormats(dst, m.ParameterFormats)
+	dst = appendValues(dst, m.Parameters)
+	dst = appendFormats(dst, m.ResultFormats)
+	return finishMessage(dst, start)
+}
+
+func (m *Bind) Decode(src []byte) error {
+	r := newMsgReader("Bind", src)
+	m.Portal = r.cstring()
+	m.Statement = r.cstring()
+	m.ParameterFormats = r.formats()
+	m.Parameters = r.values()
+	m.ResultFormats = r.formats()
+	return r.finish()
+}
+
+// Append a count of values and the values, each preceded by its length,
+// or -1 for a nil (NULL) value.
+func appendValues(dst []byte, values [][]byte) []byte {
+	dst = appendInt16(dst, int16(len(values)))
+	for _, val := range values {
+		dst = appendValue(dst, val)
+	}
+	return dst
+}
+
+// Append a value preceded by its length, or -1 for a nil (NULL) value.
+func appendValue(dst []byte, val []byte) []byte {
+	if val == nil {
+		return appendInt32(dst, -1)
+	}
+	dst = appendInt32(dst, int32(len(val)))
+	return append(dst, val...)
+}
+
+func (r *msgReader) values() [][]byte {
+	values := make([][]byte, r.count(4))
+	for i := range values {
+		values[i] = r.value()
+	}
+	return values
+}
+
+// Read a value preceded by its length, where -1 is a nil (NULL) value.
+func (r *msgReader) value() []byte {
+	size := r.int32()
+	if size < 0 {
+		return nil
+	}
+	return r.bytes(int(size))
+}
+
+func appendFormats(dst []byte, formats []DataFormat) []byte {
+	dst = appendInt16(dst, int16(len(formats)))
+	for _, format := range formats {
+		dst = appendInt16(dst, int16(format))
+	}
+	return dst
+}
+
+func (r *msgReader) formats() []DataFormat {
+	formats := make([]DataFormat, r.count(2))
+	for i := range formats {
+		formats[i] = DataFormat(r.int16())
+	}
+	return formats
+}
+
+func (m *Close) Encode(dst []byte) []byte {
+	return encodeTarget(dst, MsgClose, m.Kind, m.Name)
+}
+
+func (m *Close) Decode(src []byte) error {
+	return decodeTarget("Close", src, &m.Kind, &m.Name)
+}
+
+func (m *Describe) Encode(dst []byte) []byte {
+	return encodeTarget(dst, MsgDescribe, m.Kind, m.Name)
+}
+
+func (m *Describe) Decode(src []byte) error {
+	return decodeTarget("Describe", src, &m.Kind, &m.Name)
+}
+
+func encodeTarget(dst []byte, msgType MessageType, kind TargetKind, name string) []byte {
+	dst, start := beginMessage(dst, msgType)
+	dst = append(dst, byte(kind))
+	dst = appendCString(dst, name)
+	return finishMessage(dst, start)
+}
+
+func decodeTarget(msgName string, src []byte, kind *TargetKind, name *string) error {
+	r := newMsgReader(msgName, src)
+	*kind = TargetKind(r.byte1())
+	*name = r.cstring()
+	return r.finish()
+}
+
+func (m *CopyData) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, MsgCopyData)
+	dst = append(dst, m.Data...)
+	return finishMessage(dst, start)
+}
+
+func (m *CopyData) Decode(src []byte) error {
+	m.Data = src
+	return nil
+}
+
+func (m *CopyDone) Encode(dst []byte) []byte {
+	return encodeEmpty(dst, MsgCopyDone)
+}
+
+func (m *CopyDone) Decode(src []byte) error {
+	return decodeEmpty("CopyDone", src)
+}
+
+func (m *CopyFail) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, MsgCopyFail)
+	dst = appendCString(dst, m.Reason)
+	return finishMessage(dst, start)
+}
+
+func (m *CopyFail) Decode(src []byte) error {
+	r := newMsgReader("CopyFail", src)
+	m.Reason = r.cstring()
+	return r.finish()
+}
+
+func (m *Execute) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, MsgExecute)
+	dst = appendCString(dst, m.Portal)
+	dst = appendInt32(dst, m.MaxRows)
+	return finishMessage(dst, start)
+}
+
+func (m *Execute) Decode(src []byte) error {
+	r := newMsgReader("Execute", src)
+	m.Portal = r.cstring()
+	m.MaxRows = r.int32()
+	return r.finish()
+}
+
+func (m *Flush) Encode(dst []byte) []byte {
+	return encodeEmpty(dst, MsgFlush)
+}
+
+func (m *Flush) Decode(src []byte) error {
+	return decodeEmpty("Flush", src)
+}
+
+func (m *FunctionCall) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, MsgFunctionCall)
+	dst = appendInt32(dst, int32(m.FunctionOid))
+	dst = appendFormats(dst, m.ArgFormats)
+	dst = appendValues(dst, m.Arguments)
+	dst = appendInt16(dst, int16(m.ResultFormat))
+	return finishMessage(dst, start)
+}
+
+func (m *FunctionCall) Decode(src []byte) error {
+	r := newMsgReader("FunctionCall", src)
+	m.FunctionOid = Oid(r.int32())
+	m.ArgFormats = r.formats()
+	m.Arguments = r.values()
+	m.ResultFormat = DataFormat(r.int16())
+	return r.finish()
+}
+
+func (m *GSSResponse) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, MsgGSSResponse)
+	dst = append(dst, m.Data...)
+	return finishMessage(dst, start)
+}
+
+func (m *GSSResponse) Decode(src []byte) error {
+	m.Data = src
+	return nil
+}
+
+func (m *Parse) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, MsgParse)
+	dst = appendCString(dst, m.Name)
+	dst = appendCString(dst, m.Query)
+	dst = appendInt16(dst, int16(len(m.ParameterTypes)))
+	for _, typ := range m.ParameterTypes {
+		dst = appendInt32(dst, int32(typ))
+	}
+	return finishMessage(dst, start)
+}
+
+func (m *Parse) Decode(src []byte) error {
+	r := newMsgReader("Parse", src)
+	m.Name = r.cstring()
+	m.Query = r.cstring()
+	m.ParameterTypes = make([]Oid, r.count(4))
+	for i := range m.ParameterTypes {
+		m.ParameterTypes[i] = Oid(r.int32())
+	}
+	return r.finish()
+}
+
+func (m *PasswordMessage) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, MsgPasswordMessage)
+	dst = appendCString(dst, m.Password)
+	return finishMessage(dst, start)
+}
+
+func (m *PasswordMessage) Decode(src []byte) error {
+	r := newMsgReader("PasswordMessage", src)
+	m.Password = r.cstring()
+	return r.finish()
+}
+
+func (m *Query) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, MsgQuery)
+	dst = appendCString(dst, m.Query)
+	return finishMessage(dst, start)
+}
+
+func (m *Query) Decode(src []byte) error {
+	r := newMsgReader("Query", src)
+	m.Query = r.cstring()
+	return r.finish()
+}
+
+func (m *SASLInitialResponse) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, MsgSASLInitialResponse)
+	dst = appendCString(dst, m.Mechanism)
+	if m.Data == nil {
+		dst = appendInt32(dst, -1)
+	} else {
+		dst = appendInt32(dst, int32(len(m.Data)))
+		dst = append(dst, m.Data...)
+	}
+	return finishMessage(dst, start)
+}
+
+func (m *SASLInitialResponse) Decode(src []byte) error {
+	r := newMsgReader("SASLInitialResponse", src)
+	m.Mechanism = r.cstring()
+	m.Data = nil
+	if size := r.int32(); size >= 0 {
+		m.Data = r.bytes(int(size))
+	}
+	return r.finish()
+}
+
+func (m *SASLResponse) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, MsgSASLResponse)
+	dst = append(dst, m.Data...)
+	return finishMessage(dst, start)
+}
+
+func (m *SASLResponse) Decode(src []byte) error {
+	m.Data = src
+	return nil
+}
+
+func (m *Sync) Encode(dst []byte) []byte {
+	return encodeEmpty(dst, MsgSync)
+}
+
+func (m *Sync) Decode(src []byte) error {
+	return decodeEmpty("Sync", src)
+}
+
+func (m *Terminate) Encode(dst []byte) []byte {
+	return encodeEmpty(dst, MsgTerminate)
+}
+
+func (m *Terminate) Decode(src []byte) error {
+	return decodeEmpty("Terminate", src)
+}
+
+func encodeEmpty(dst []byte, msgType MessageType) []byte {
+	dst, start := beginMessage(dst, msgType)
+	return finishMessage(dst, start)
+}
+
+func decodeEmpty(name string, src []byte) error {
+	return newMsgReader(name, src).finish()
+}
@@ -0,0 +1,92 @@
+package post
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+var frontendTests = []struct {
+	msg     FrontendMessage
+	untyped bool
+}{
+	{&StartupMessage{ProtocolVersion30, map[string]string{"user": "bob", "database": "db"}}, true},
+	{&SSLRequest{}, true},
+	{&GSSENCRequest{}, true},
+	{&StartupMessage{ProtocolVersion32, map[string]string{"user": "bob"}}, true},
+	{&CancelRequest{0x1234, []byte{0x77, 0x77, 0x77, 0x77}}, true},
+	{&CancelRequest{0x1234, bytes.Repeat([]byte{0x77}, 32)}, true},
+	{&Bind{"p", "s", []DataFormat{1}, [][]byte{[]byte("x"), nil, {}}, []DataFormat{0, 1}}, false},
+	{&Close{'S', "stmt"}, false},
+	{&CopyData{[]byte{0x1, 0x2}}, false},
+	{&CopyDone{}, false},
+	{&CopyFail{"nope"}, false},
+	{&Describe{'P', "portal"}, false},
+	{&Execute{"portal", 10}, false},
+	{&Flush{}, false},
+	{&FunctionCall{1598, []DataFormat{BinaryFormat}, [][]byte{{0x0, 0x1}, nil}, TextFormat}, false},
+	{&GSSResponse{[]byte{0x60, 0x1}}, false},
+	{&Parse{"stmt", "select $1", []Oid{23}}, false},
+	{&PasswordMessage{"secret"}, false},
+	{&Query{"select 1"}, false},
+	{&SASLInitialResponse{"SCRAM-SHA-256", []byte("n,,n=,r=abc")}, false},
+	{&SASLInitialResponse{"SCRAM-SHA-256", nil}, false},
+	{&SASLResponse{[]byte("c=biws")}, false},
+	{&Sync{}, false},
+	{&Terminate{}, false},
+}
+
+func TestFrontendRoundTrip(t *testing.T) {
+	for i, tt := range frontendTests {
+		encoded := tt.msg.Encode([]byte{0xff})
+		if encoded[0] != 0xff {
+			t.Errorf("%d: want dst prefix kept; got %v", i, encoded[0])
+		}
+		encoded = encoded[1:]
+		if !tt.untyped {
+			encoded = encoded[1:]
+		}
+		size := int(be.Uint32(encoded))
+		if size != len(encoded) {
+			t.Errorf("%d: want length %v; got %v", i, len(encoded), size)
+		}
+		decoded := reflect.New(reflect.TypeOf(tt.msg).Elem()).Interface().(FrontendMessage)
+		err := decoded.Decode(encoded[4:])
+		if err != nil {
+			t.Errorf("%d: want nil err; got %v", i, err)
+		}
+		if !reflect.DeepEqual(tt.msg, decoded) {
+			t.Errorf("%d: want %#v; got %#v", i, tt.msg, decoded)
+		}
+	}
+}
+
+func TestFrontendStartupSorted(t *testing.T) {
+	msg := &StartupMessage{ProtocolVersion30, map[string]string{"user": "bob", "database": "db"}}
+	expected := []byte{0x0, 0x0, 0x0, 0x1e, 0x0, 0x3, 0x0, 0x0,
+		'd', 'a', 't', 'a', 'b', 'a', 's', 'e', 0x0, 'd', 'b', 0x0,
+		'u', 's', 'e', 'r', 0x0, 'b', 'o', 'b', 0x0, 0x0}
+	compareBytes(t, expected, msg.Encode(nil))
+}
+
+var frontendDecodeErrorTests = []struct {
+	msg FrontendMessage
+	src []byte
+}{
+	{&Query{}, []byte("select 1")},                                                // unterminated
+	{&Query{}, []byte("select 1\x00x")},                                           // trailing bytes
+	{&Execute{}, []byte{0x0, 0x0, 0x0}},                                           // short
+	{&Sync{}, []byte{0x0}},                                                        // not empty
+	{&SSLRequest{}, []byte{0x4, 0xd2, 0x16, 0x2e}},                                // cancel code
+	{&Parse{}, []byte{0x0, 0x0, 0x0, 0x5, 0x0, 0x0}},                              // bad count
+	{&Bind{}, []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x1, 0x0, 0x0, 0x0, 0x5, 0x0, 0x0}}, // short param
+}
+
+func TestFrontendDecodeError(t *testing.T) {
+	for i, tt := range frontendDecodeErrorTests {
+		err := tt.msg.Decode(tt.src)
+		if err == nil {
+			t.Errorf("%d: want err; got nil", i)
+		}
+	}
+}
@@ -0,0 +1,30 @@
+// Package netutil holds small pieces shared by the proxy and replay
+// servers.
+package netutil
+
+import (
+	"context"
+	"io"
+)
+
+// The first byte of a TLS handshake record, which can never start a
+// startup-phase message.
+const TLSHandshake = 0x16
+
+// Close c when ctx is done, until the returned function is called.
+func CloseWhenDone(ctx context.Context, c io.Closer) (stop func()) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			c.Close()
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
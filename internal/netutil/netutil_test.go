@@ -0,0 +1,34 @@
+package netutil
+
+import (
+	"context"
+	"testing"
+)
+
+type closer chan struct{}
+
+func (c closer) Close() error {
+	close(c)
+	return nil
+}
+
+func TestCloseWhenDone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := make(closer)
+	stop := CloseWhenDone(ctx, c)
+	cancel()
+	<-c
+	stop()
+
+	// after stop, c is left alone
+	ctx, cancel = context.WithCancel(context.Background())
+	c = make(closer)
+	stop = CloseWhenDone(ctx, c)
+	stop()
+	cancel()
+	select {
+	case <-c:
+		t.Error("want open; got closed")
+	default:
+	}
+}
@@ -0,0 +1,33 @@
+// Package testquery runs queries for tests at the level of protocol
+// messages.
+package testquery
+
+import (
+	"testing"
+
+	"github.com/msakrejda/post"
+)
+
+// Run a simple query and collect everything the server sends back, up
+// to but not including the ReadyForQuery.
+func Run(t testing.TB, conn *post.Conn, sql string) []post.BackendMessage {
+	p := conn.ProtoStream()
+	err := p.SendQuery(sql)
+	if err == nil {
+		err = p.Flush()
+	}
+	if err != nil {
+		t.Fatalf("want nil err; got %v", err)
+	}
+	var msgs []post.BackendMessage
+	for {
+		msg, err := p.ReceiveMessage()
+		if err != nil {
+			t.Fatalf("want nil err; got %v", err)
+		}
+		if _, ok := msg.(*post.ReadyForQuery); ok {
+			return msgs
+		}
+		msgs = append(msgs, msg)
+	}
+}
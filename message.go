@@ -0,0 +1,173 @@
+package post
+
+// MessageType is the single byte identifying the type of a protocol
+// message. Frontend and backend messages share the same space of bytes,
+// so the same byte may stand for different messages depending on the
+// direction.
+type MessageType byte
+
+// Backend (server to client) message types
+const (
+	MsgAuthentication           MessageType = 'R'
+	MsgBackendKeyData           MessageType = 'K'
+	MsgBindComplete             MessageType = '2'
+	MsgCloseComplete            MessageType = '3'
+	MsgCommandComplete          MessageType = 'C'
+	MsgCopyInResponse           MessageType = 'G'
+	MsgCopyOutResponse          MessageType = 'H'
+	MsgCopyBothResponse         MessageType = 'W'
+	MsgDataRow                  MessageType = 'D'
+	MsgEmptyQueryResponse       MessageType = 'I'
+	MsgErrorResponse            MessageType = 'E'
+	MsgFunctionCallResponse     MessageType = 'V'
+	MsgNegotiateProtocolVersion MessageType = 'v'
+	MsgNoData                   MessageType = 'n'
+	MsgNoticeResponse           MessageType = 'N'
+	MsgNotificationResponse     MessageType = 'A'
+	MsgParameterDescription     MessageType = 't'
+	MsgParameterStatus          MessageType = 'S'
+	MsgParseComplete            MessageType = '1'
+	MsgPortalSuspended          MessageType = 's'
+	MsgReadyForQuery            MessageType = 'Z'
+	MsgRowDescription           MessageType = 'T'
+)
+
+// Frontend (client to server) message types. The startup-phase
+// messages (StartupMessage, SSLRequest, GSSENCRequest, and
+// CancelRequest) have no type byte.
+const (
+	MsgBind                MessageType = 'B'
+	MsgClose               MessageType = 'C'
+	MsgCopyFail            MessageType = 'f'
+	MsgDescribe            MessageType = 'D'
+	MsgExecute             MessageType = 'E'
+	MsgFlush               MessageType = 'H'
+	MsgFunctionCall        MessageType = 'F'
+	MsgGSSResponse         MessageType = 'p'
+	MsgParse               MessageType = 'P'
+	MsgPasswordMessage     MessageType = 'p'
+	MsgQuery               MessageType = 'Q'
+	MsgSASLInitialResponse MessageType = 'p'
+	MsgSASLResponse        MessageType = 'p'
+	MsgSync                MessageType = 'S'
+	MsgTerminate           MessageType = 'X'
+)
+
+// Message types used in both directions
+const (
+	MsgCopyData MessageType = 'd'
+	MsgCopyDone MessageType = 'c'
+)
+
+// An Encoder is a message that can be encoded for the wire, as all
+// frontend and backend messages can.
+type Encoder interface {
+	Encode(dst []byte) []byte
+}
+
+// A decoder is a message that can be decoded from a message body.
+type decoder interface {
+	Decode(src []byte) error
+}
+
+// A BackendMessage is a decoded message from the server, as returned by
+// ReceiveMessage. Use a type switch to tell the messages apart.
+type BackendMessage interface {
+	Type() MessageType
+}
+
+type BindComplete struct{}
+
+type CloseComplete struct{}
+
+type CommandComplete struct {
+	Tag CommandTag
+}
+
+type CopyData struct {
+	Data []byte
+}
+
+type CopyDone struct{}
+
+type CopyInResponse CopyResponse
+
+type CopyOutResponse CopyResponse
+
+type CopyBothResponse CopyResponse
+
+type DataRow struct {
+	// The column values; a nil value is NULL.
+	Values [][]byte
+}
+
+type EmptyQueryResponse struct{}
+
+type FunctionCallResponse struct {
+	// The function's result; nil if it is NULL.
+	Result []byte
+}
+
+// A NegotiateProtocolVersion is the server's answer to a StartupMessage
+// asking for a newer minor protocol version than it supports, or for
+// protocol options it does not recognize. The connection carries on with
+// the older version and without those options.
+type NegotiateProtocolVersion struct {
+	// The newest minor version of the major version requested that
+	// the server supports.
+	NewestMinor int32
+	// The "_pq_." options requested that the server does not
+	// recognize.
+	UnrecognizedOptions []string
+}
+
+type NoData struct{}
+
+type ParameterDescription struct {
+	Types []Oid
+}
+
+type ParseComplete struct{}
+
+type PortalSuspended struct{}
+
+type ReadyForQuery struct {
+	Status TransactionStatus
+}
+
+type RowDescription struct {
+	Fields []FieldDescription
+}
+
+// An UnknownMessage is a message ReceiveMessage does not know how to
+// decode. Its body is read in full so the stream stays in sync.
+type UnknownMessage struct {
+	MsgType MessageType
+	Body    []byte
+}
+
+func (*AuthResponse) Type() MessageType             { return MsgAuthentication }
+func (*BackendKeyData) Type() MessageType           { return MsgBackendKeyData }
+func (*BindComplete) Type() MessageType             { return MsgBindComplete }
+func (*CloseComplete) Type() MessageType            { return MsgCloseComplete }
+func (*CommandComplete) Type() MessageType          { return MsgCommandComplete }
+func (*CopyData) Type() MessageType                 { return MsgCopyData }
+func (*CopyDone) Type() MessageType                 { return MsgCopyDone }
+func (*CopyInResponse) Type() MessageType           { return MsgCopyInResponse }
+func (*CopyOutResponse) Type() MessageType          { return MsgCopyOutResponse }
+func (*CopyBothResponse) Type() MessageType         { return MsgCopyBothResponse }
+func (*DataRow) Type() MessageType                  { return MsgDataRow }
+func (*EmptyQueryResponse) Type() MessageType       { return MsgEmptyQueryResponse }
+func (*PgError) Type() MessageType                  { return MsgErrorResponse }
+func (*FunctionCallResponse) Type() MessageType     { return MsgFunctionCallResponse }
+func (*NegotiateProtocolVersion) Type() MessageType { return MsgNegotiateProtocolVersion }
+func (*NoData) Type() MessageType                   { return MsgNoData }
+func (*Notice) Type() MessageType                   { return MsgNoticeResponse }
+func (*Notification) Type() MessageType             { return MsgNotificationResponse }
+func (*ParameterDescription) Type() MessageType     { return MsgParameterDescription }
+func (*ParameterStatus) Type() MessageType          { return MsgParameterStatus }
+func (*ParseComplete) Type() MessageType            { return MsgParseComplete }
+func (*PortalSuspended) Type() MessageType          { return MsgPortalSuspended }
+func (*ReadyForQuery) Type() MessageType            { return MsgReadyForQuery }
+func (*RowDescription) Type() MessageType           { return MsgRowDescription }
+func (m *UnknownMessage) Type() MessageType         { return m.MsgType }
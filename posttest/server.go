@@ -0,0 +1,563 @@
+// Package posttest provides a fake server for testing code that talks
+// to Postgres, without a network or a real database.
+//
+// A Server follows a script of expected queries and canned responses.
+// It accepts any startup message without authentication, answers each
+// scripted query in order, and reports anything unexpected through the
+// test's Errorf, answering it with an ErrorResponse so the client does
+// not hang. Queries may be run with the simple or the extended query
+// protocol; in the latter, a query is taken from the script when it is
+// executed.
+package posttest
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/msakrejda/post"
+	"github.com/msakrejda/post/sqlstate"
+)
+
+// A Server is a fake server following a script of expected queries.
+type Server struct {
+	t testing.TB
+
+	mu       sync.Mutex
+	params   map[string]string
+	script   []*Response
+	nextPid  int32
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	closed   bool
+	wg       sync.WaitGroup
+}
+
+// Create a new Server reporting to t. The Server does not listen until
+// Listen is called, but Pipe and Config work right away. The Server is
+// closed automatically when the test finishes.
+func NewServer(t testing.TB) *Server {
+	s := &Server{
+		t: t,
+		params: map[string]string{
+			"server_version":              "17.0",
+			"server_encoding":             "UTF8",
+			"client_encoding":             "UTF8",
+			"DateStyle":                   "ISO, MDY",
+			"integer_datetimes":           "on",
+			"standard_conforming_strings": "on",
+		},
+		conns: make(map[net.Conn]struct{}),
+	}
+	t.Cleanup(s.Close)
+	return s
+}
+
+// Set a run-time parameter reported to clients with ParameterStatus
+// during startup.
+func (s *Server) SetParameter(name, value string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.params[name] = value
+}
+
+// Listen for connections on a local address, e.g., "tcp" and
+// "127.0.0.1:0", or "unix" and a socket path.
+func (s *Server) Listen(network, address string) error {
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	if s.closed || s.listener != nil {
+		s.mu.Unlock()
+		listener.Close()
+		return errors.New("posttest: server closed or already listening")
+	}
+	s.listener = listener
+	s.wg.Add(1)
+	s.mu.Unlock()
+	go s.accept(listener)
+	return nil
+}
+
+// Get the address the Server is listening on, or nil if it is not.
+func (s *Server) Addr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+func (s *Server) accept(listener net.Listener) {
+	defer s.wg.Done()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		s.serveConn(conn)
+	}
+}
+
+// Get the client end of an in-memory connection to the Server.
+func (s *Server) Pipe() net.Conn {
+	client, server := net.Pipe()
+	s.serveConn(server)
+	return client
+}
+
+// Get a configuration for connecting to the Server: over the listener
+// if the Server is listening, or else over a Pipe.
+func (s *Server) Config() post.Config {
+	return post.Config{
+		User:    "posttest",
+		SSLMode: post.SSLModeDisable,
+		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			addr := s.Addr()
+			if addr == nil {
+				return s.Pipe(), nil
+			}
+			var d net.Dialer
+			return d.DialContext(ctx, addr.Network(), addr.String())
+		},
+	}
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		conn.Close()
+		return
+	}
+	s.conns[conn] = struct{}{}
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer s.forget(conn)
+		err := s.serve(conn)
+		if err != nil && !errors.Is(err, io.EOF) && !s.isClosed() {
+			s.t.Errorf("posttest: %v", err)
+		}
+	}()
+}
+
+func (s *Server) forget(conn net.Conn) {
+	conn.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, conn)
+}
+
+func (s *Server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// Stop listening, close all connections, and report any scripted
+// queries that were never run.
+func (s *Server) Close() {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	for _, resp := range s.script {
+		s.t.Errorf("posttest: expected query %q was not run", resp.query)
+	}
+}
+
+// Add a query to the script and return its Response, which answers
+// with just CommandComplete until set up otherwise. Queries are
+// expected in the order they are added, and must match exactly.
+func (s *Server) OnQuery(query string) *Response {
+	resp := &Response{query: query}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.script = append(s.script, resp)
+	return resp
+}
+
+// Take the next step of the script, if it matches the given query.
+func (s *Server) next(query string) (*Response, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.script) == 0 {
+		return nil, fmt.Errorf("unexpected query %q", query)
+	}
+	resp := s.script[0]
+	if resp.query != query {
+		return nil, fmt.Errorf("unexpected query %q; want %q", query, resp.query)
+	}
+	s.script = s.script[1:]
+	return resp, nil
+}
+
+// Get the first Response scripted for query, if any, without taking it
+// from the script.
+func (s *Server) peek(query string) *Response {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, resp := range s.script {
+		if resp.query == query {
+			return resp
+		}
+	}
+	return nil
+}
+
+// A Response is the scripted answer to a query. Its methods return the
+// Response itself so calls can be chained.
+type Response struct {
+	query  string
+	fields []post.FieldDescription
+	rows   [][][]byte
+	tag    string
+	err    *post.PgError
+}
+
+// Answer with a RowDescription of text columns with the given names.
+func (r *Response) Columns(names ...string) *Response {
+	for _, name := range names {
+		r.fields = append(r.fields, post.FieldDescription{
+			Name:      name,
+			TypeOid:   25, // text
+			TypLen:    -1,
+			AttTypMod: -1,
+			Format:    post.TextFormat,
+		})
+	}
+	return r
+}
+
+// Answer with a RowDescription of the given fields.
+func (r *Response) Fields(fields ...post.FieldDescription) *Response {
+	r.fields = append(r.fields, fields...)
+	return r
+}
+
+// Answer with a DataRow of the given values, which may be strings,
+// byte slices, or nil for NULL; anything else is formatted with
+// fmt.Sprint.
+func (r *Response) Row(values ...interface{}) *Response {
+	row := make([][]byte, len(values))
+	for i, val := range values {
+		switch val := val.(type) {
+		case nil:
+		case []byte:
+			row[i] = val
+		case string:
+			row[i] = []byte(val)
+		default:
+			row[i] = []byte(fmt.Sprint(val))
+		}
+	}
+	r.rows = append(r.rows, row)
+	return r
+}
+
+// Set the command tag, e.g., "INSERT 0 1". It defaults to "SELECT n"
+// for queries returning rows, where n is the number of rows.
+func (r *Response) Tag(tag string) *Response {
+	r.tag = tag
+	return r
+}
+
+// Answer with an ErrorResponse, after any rows, instead of
+// CommandComplete.
+func (r *Response) Error(err *post.PgError) *Response {
+	r.err = err
+	return r
+}
+
+func (r *Response) send(p *post.ProtoStream) (err error) {
+	if r.fields != nil {
+		err = p.SendRowDescription(r.fields)
+		if err != nil {
+			return err
+		}
+	}
+	return r.sendRows(p)
+}
+
+// Send the rows and what ends them, without a RowDescription, as for an
+// Execute.
+func (r *Response) sendRows(p *post.ProtoStream) (err error) {
+	for _, row := range r.rows {
+		err = p.SendDataRow(row)
+		if err != nil {
+			return err
+		}
+	}
+	switch {
+	case r.err != nil:
+		return p.SendErrorResponse(r.err)
+	case r.query == "":
+		return p.SendEmptyQueryResponse()
+	case r.tag == "" && r.fields != nil:
+		return p.SendCommandComplete("SELECT " + strconv.Itoa(len(r.rows)))
+	default:
+		return p.SendCommandComplete(r.tag)
+	}
+}
+
+// Serve a single connection until the client terminates it.
+func (s *Server) serve(conn net.Conn) (err error) {
+	p := post.NewProtoStreamConn(conn)
+	err = s.startup(p)
+	if err != nil {
+		return err
+	}
+	ext := &prepared{
+		statements: make(map[string]*statement),
+		portals:    make(map[string]*statement),
+	}
+	// after an error in the extended protocol, the server discards
+	// messages until Sync
+	skipping := false
+	for {
+		msg, err := p.ReceiveFrontendMessage()
+		if err != nil {
+			return err
+		}
+		switch msg := msg.(type) {
+		case *post.Query:
+			err = s.respond(p, msg.Query)
+		case *post.Sync:
+			skipping = false
+			err = p.SendReadyForQuery(post.Idle)
+		case *post.Terminate:
+			return nil
+		default:
+			if skipping {
+				continue
+			}
+			var ok bool
+			ok, err = s.extended(p, ext, msg)
+			skipping = !ok
+		}
+		if err == nil {
+			err = p.Flush()
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// A statement prepared with Parse.
+type statement struct {
+	query string
+	types []post.Oid
+}
+
+// The statements and portals of a connection, by name.
+type prepared struct {
+	statements map[string]*statement
+	portals    map[string]*statement
+}
+
+// Answer a message of the extended query protocol. It reports false if
+// the answer is an error, after which messages are skipped until Sync.
+func (s *Server) extended(p *post.ProtoStream, ext *prepared, msg post.FrontendMessage) (ok bool, err error) {
+	switch msg := msg.(type) {
+	case *post.Parse:
+		stmt := &statement{query: msg.Query}
+		// the server would infer the types left unspecified; call
+		// them text
+		for i := 0; i < countParameters(msg.Query); i++ {
+			typ := post.Oid(25)
+			if i < len(msg.ParameterTypes) && msg.ParameterTypes[i] != 0 {
+				typ = msg.ParameterTypes[i]
+			}
+			stmt.types = append(stmt.types, typ)
+		}
+		ext.statements[msg.Name] = stmt
+		return true, p.SendParseComplete()
+	case *post.Bind:
+		stmt, ok := ext.statements[msg.Statement]
+		if !ok {
+			return false, s.unexpected(p, fmt.Sprintf("unknown statement %q", msg.Statement))
+		}
+		ext.portals[msg.Portal] = stmt
+		return true, p.SendBindComplete()
+	case *post.Describe:
+		stmt, ok := ext.statements[msg.Name]
+		if msg.Kind == post.Portal {
+			stmt, ok = ext.portals[msg.Name]
+		}
+		if !ok {
+			return false, s.unexpected(p, fmt.Sprintf("unknown %c %q", msg.Kind, msg.Name))
+		}
+		if msg.Kind == post.Statement {
+			err = p.SendParameterDescription(stmt.types)
+			if err != nil {
+				return false, err
+			}
+		}
+		if resp := s.peek(stmt.query); resp != nil && resp.fields != nil {
+			return true, p.SendRowDescription(resp.fields)
+		}
+		return true, p.SendNoData()
+	case *post.Execute:
+		stmt, ok := ext.portals[msg.Portal]
+		if !ok {
+			return false, s.unexpected(p, fmt.Sprintf("unknown portal %q", msg.Portal))
+		}
+		resp, err := s.next(stmt.query)
+		if err != nil {
+			return false, s.unexpected(p, err.Error())
+		}
+		return resp.err == nil, resp.sendRows(p)
+	case *post.Close:
+		if msg.Kind == post.Portal {
+			delete(ext.portals, msg.Name)
+		} else {
+			delete(ext.statements, msg.Name)
+		}
+		return true, p.SendCloseComplete()
+	case *post.Flush:
+		return true, nil
+	}
+	return false, s.unexpected(p, fmt.Sprintf("unexpected %T message", msg))
+}
+
+// Count the parameters of a query: the highest $n it refers to.
+func countParameters(query string) int {
+	count := 0
+	for i := 0; i < len(query); i++ {
+		if query[i] != '$' {
+			continue
+		}
+		j := i + 1
+		for j < len(query) && query[j] >= '0' && query[j] <= '9' {
+			j++
+		}
+		if n, err := strconv.Atoi(query[i+1 : j]); err == nil && n > count {
+			count = n
+		}
+	}
+	return count
+}
+
+func (s *Server) startup(p *post.ProtoStream) (err error) {
+	var startup *post.StartupMessage
+	for {
+		msg, err := p.ReceiveStartupMessage()
+		if err != nil {
+			return err
+		}
+		var ok bool
+		if startup, ok = msg.(*post.StartupMessage); ok {
+			if startup.ProtocolVersion>>16 != 3 {
+				return fmt.Errorf("unsupported protocol version %v", startup.ProtocolVersion)
+			}
+			break
+		}
+		if _, ok := msg.(*post.CancelRequest); ok {
+			return io.EOF
+		}
+		// no TLS or GSSAPI encryption here
+		err = p.SendSSLResponse(post.SSLRejected)
+		if err == nil {
+			err = p.Flush()
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	s.nextPid++
+	pid := s.nextPid
+	names := make([]string, 0, len(s.params))
+	for name := range s.params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	values := make([]string, len(names))
+	for i, name := range names {
+		values[i] = s.params[name]
+	}
+	s.mu.Unlock()
+
+	// speak only protocol 3.0, without any extensions
+	var unrecognized []string
+	for name := range startup.Parameters {
+		if strings.HasPrefix(name, "_pq_.") {
+			unrecognized = append(unrecognized, name)
+		}
+	}
+	sort.Strings(unrecognized)
+	if startup.ProtocolVersion&0xFFFF != 0 || len(unrecognized) > 0 {
+		err = p.SendNegotiateProtocolVersion(0, unrecognized)
+		if err != nil {
+			return err
+		}
+	}
+	err = p.SendAuthResponse(post.AuthenticationOk, nil)
+	if err != nil {
+		return err
+	}
+	for i, name := range names {
+		err = p.SendParameterStatus(name, values[i])
+		if err != nil {
+			return err
+		}
+	}
+	key := make([]byte, 4)
+	binary.BigEndian.PutUint32(key, uint32(pid*7919))
+	err = p.SendBackendKeyData(pid, key)
+	if err != nil {
+		return err
+	}
+	err = p.SendReadyForQuery(post.Idle)
+	if err != nil {
+		return err
+	}
+	return p.Flush()
+}
+
+func (s *Server) respond(p *post.ProtoStream, query string) (err error) {
+	resp, err := s.next(query)
+	if err != nil {
+		err = s.unexpected(p, err.Error())
+	} else {
+		err = resp.send(p)
+	}
+	if err != nil {
+		return err
+	}
+	return p.SendReadyForQuery(post.Idle)
+}
+
+// Report a problem to the test and to the client.
+func (s *Server) unexpected(p *post.ProtoStream, problem string) error {
+	s.t.Errorf("posttest: %v", problem)
+	return p.SendErrorResponse(&post.PgError{
+		Severity: "ERROR",
+		Code:     sqlstate.FeatureNotSupported,
+		Message:  "posttest: " + problem,
+	})
+}
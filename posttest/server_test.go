@@ -0,0 +1,218 @@
+package posttest
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/msakrejda/post"
+	"github.com/msakrejda/post/internal/testquery"
+)
+
+// A testing.TB that records errors instead of failing the test.
+type recorder struct {
+	testing.TB
+	errors []string
+}
+
+func (r *recorder) Errorf(format string, args ...interface{}) {
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+func connect(t *testing.T, s *Server) *post.Conn {
+	conn, err := post.Connect(context.Background(), s.Config())
+	if err != nil {
+		t.Fatalf("want nil err; got %v", err)
+	}
+	return conn
+}
+
+func TestServerQuery(t *testing.T) {
+	s := NewServer(t)
+	s.SetParameter("application_name", "test")
+	s.OnQuery("select id, name from users").
+		Columns("id", "name").
+		Row(1, "alice").
+		Row(2, nil)
+	s.OnQuery("delete from users").Tag("DELETE 2")
+
+	conn := connect(t, s)
+	defer conn.Close()
+	if actual := conn.ParameterStatus("application_name"); actual != "test" {
+		t.Errorf("want application_name test; got %v", actual)
+	}
+
+	msgs := testquery.Run(t, conn, "select id, name from users")
+	if len(msgs) != 4 {
+		t.Fatalf("want 4 messages; got %v", len(msgs))
+	}
+	desc, ok := msgs[0].(*post.RowDescription)
+	if !ok || len(desc.Fields) != 2 || desc.Fields[1].Name != "name" {
+		t.Errorf("want RowDescription of id, name; got %#v", msgs[0])
+	}
+	expectedRows := []*post.DataRow{
+		{Values: [][]byte{[]byte("1"), []byte("alice")}},
+		{Values: [][]byte{[]byte("2"), nil}},
+	}
+	for i, expected := range expectedRows {
+		if !reflect.DeepEqual(expected, msgs[i+1]) {
+			t.Errorf("%d: want %#v; got %#v", i, expected, msgs[i+1])
+		}
+	}
+	if cc, ok := msgs[3].(*post.CommandComplete); !ok || cc.Tag != "SELECT 2" {
+		t.Errorf("want CommandComplete SELECT 2; got %#v", msgs[3])
+	}
+
+	msgs = testquery.Run(t, conn, "delete from users")
+	if len(msgs) != 1 {
+		t.Fatalf("want 1 message; got %v", len(msgs))
+	}
+	if cc, ok := msgs[0].(*post.CommandComplete); !ok || cc.Tag != "DELETE 2" {
+		t.Errorf("want CommandComplete DELETE 2; got %#v", msgs[0])
+	}
+}
+
+func TestServerError(t *testing.T) {
+	s := NewServer(t)
+	s.OnQuery("select * from nope").Error(&post.PgError{
+		Severity: "ERROR", Code: "42P01", Message: "relation \"nope\" does not exist"})
+	conn := connect(t, s)
+	defer conn.Close()
+	msgs := testquery.Run(t, conn, "select * from nope")
+	if len(msgs) != 1 {
+		t.Fatalf("want 1 message; got %v", len(msgs))
+	}
+	if pgErr, ok := msgs[0].(*post.PgError); !ok || pgErr.Code != "42P01" {
+		t.Errorf("want 42P01 error; got %#v", msgs[0])
+	}
+}
+
+func TestServerExtended(t *testing.T) {
+	s := NewServer(t)
+	s.OnQuery("select name from users where id = $1").Columns("name").Row("alice")
+	s.OnQuery("insert into users values ($1, $2)").Tag("INSERT 0 1")
+	s.OnQuery("select * from nope").Error(&post.PgError{
+		Severity: "ERROR", Code: "42P01", Message: "relation \"nope\" does not exist"})
+	conn := connect(t, s)
+	defer conn.Close()
+	ctx := context.Background()
+
+	stmt, err := conn.Prepare(ctx, "s", "select name from users where id = $1")
+	if err != nil {
+		t.Fatalf("want nil err; got %v", err)
+	}
+	if len(stmt.Parameters) != 1 || len(stmt.Fields) != 1 || stmt.Fields[0].Name != "name" {
+		t.Errorf("want one parameter and field name; got %#v", stmt)
+	}
+	r, err := stmt.Query(ctx, 1)
+	if err != nil {
+		t.Fatalf("want nil err; got %v", err)
+	}
+	if !r.NextResult() || !r.Next() || string(r.Values()[0]) != "alice" {
+		t.Errorf("want alice; got %q, %v", r.Values(), r.Err())
+	}
+	if r.Next() || r.Tag() != "SELECT 1" {
+		t.Errorf("want SELECT 1 after one row; got %v", r.Tag())
+	}
+	if err := r.Close(); err != nil {
+		t.Errorf("want nil err; got %v", err)
+	}
+
+	b := &post.Batch{}
+	b.Queue("insert into users values ($1, $2)", 2, "bob")
+	b.Queue("select * from nope")
+	b.Queue("select 1")
+	results, err := conn.SendBatch(ctx, b)
+	if err != nil {
+		t.Fatalf("want nil err; got %v", err)
+	}
+	if results[0].Tag != "INSERT 0 1" || results[0].Err != nil {
+		t.Errorf("want INSERT 0 1; got %#v", results[0])
+	}
+	if pgErr, ok := results[1].Err.(*post.PgError); !ok || pgErr.Code != "42P01" {
+		t.Errorf("want 42P01 error; got %v", results[1].Err)
+	}
+	if results[2].Err != post.ErrSkipped {
+		t.Errorf("want %v; got %v", post.ErrSkipped, results[2].Err)
+	}
+}
+
+func TestServerUnexpected(t *testing.T) {
+	rec := &recorder{TB: t}
+	s := NewServer(rec)
+	s.OnQuery("select 1")
+	s.OnQuery("select 2")
+	conn := connect(t, s)
+	msgs := testquery.Run(t, conn, "select 3")
+	if len(msgs) != 1 {
+		t.Fatalf("want 1 message; got %v", len(msgs))
+	}
+	if _, ok := msgs[0].(*post.PgError); !ok {
+		t.Errorf("want error; got %#v", msgs[0])
+	}
+	conn.Close()
+	s.Close()
+
+	expected := []string{
+		`posttest: unexpected query "select 3"; want "select 1"`,
+		`posttest: expected query "select 1" was not run`,
+		`posttest: expected query "select 2" was not run`,
+	}
+	if !reflect.DeepEqual(expected, rec.errors) {
+		t.Errorf("want errors %q; got %q", expected, rec.errors)
+	}
+}
+
+func TestServerNegotiateProtocolVersion(t *testing.T) {
+	s := NewServer(t)
+	config := s.Config()
+	config.ProtocolVersion = post.ProtocolVersion32
+	config.ProtocolOptions = map[string]string{"_pq_.foo": "on"}
+	conn, err := post.Connect(context.Background(), config)
+	if err != nil {
+		t.Fatalf("want nil err; got %v", err)
+	}
+	defer conn.Close()
+	if version := conn.ProtocolVersion(); version != post.ProtocolVersion30 {
+		t.Errorf("want version %x; got %x", post.ProtocolVersion30, version)
+	}
+	expected := []string{"_pq_.foo"}
+	if actual := conn.UnrecognizedProtocolOptions(); !reflect.DeepEqual(expected, actual) {
+		t.Errorf("want %v; got %v", expected, actual)
+	}
+}
+
+func TestServerListen(t *testing.T) {
+	var listenTests = []struct {
+		network string
+		address string
+	}{
+		{"tcp", "127.0.0.1:0"},
+		{"unix", filepath.Join(t.TempDir(), "pg.sock")},
+	}
+	for i, tt := range listenTests {
+		s := NewServer(t)
+		err := s.Listen(tt.network, tt.address)
+		if err != nil {
+			if strings.Contains(err.Error(), "not permitted") {
+				t.Logf("%d: skipping: %v", i, err)
+				continue
+			}
+			t.Fatalf("%d: want nil err; got %v", i, err)
+		}
+		if addr := s.Addr(); addr == nil || addr.Network() != tt.network {
+			t.Errorf("%d: want %v address; got %v", i, tt.network, addr)
+		}
+		s.OnQuery("select 1").Columns("?column?").Row(1)
+		conn := connect(t, s)
+		msgs := testquery.Run(t, conn, "select 1")
+		if len(msgs) != 3 {
+			t.Errorf("%d: want 3 messages; got %v", i, len(msgs))
+		}
+		conn.Close()
+		s.Close()
+	}
+}
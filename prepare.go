@@ -0,0 +1,198 @@
+package post
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// A PreparedStatement is a statement parsed and described by the
+// server, ready to run with the extended query protocol.
+type PreparedStatement struct {
+	// The name of the statement, or empty for the unnamed statement,
+	// which only lasts until the next statement without a name is
+	// prepared.
+	Name string
+	SQL  string
+	// The types of the parameters, as given in the ParameterDescription.
+	Parameters []Oid
+	// The fields of the rows returned, as given in the RowDescription,
+	// or nil if the statement does not return rows.
+	Fields []FieldDescription
+
+	c *Conn
+}
+
+// Parse and describe sql as a prepared statement with the given name.
+// The types of its parameters are left for the server to infer.
+func (c *Conn) Prepare(ctx context.Context, name, sql string) (*PreparedStatement, error) {
+	r, err := c.startQuery(ctx, func(p *ProtoStream) (err error) {
+		err = p.SendParse(name, sql, nil)
+		if err == nil {
+			err = p.SendDescribe(Statement, name)
+		}
+		if err == nil {
+			err = p.SendSync()
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	stmt := &PreparedStatement{Name: name, SQL: sql, c: c}
+	for !r.done {
+		msg := r.receive()
+		switch msg := msg.(type) {
+		case nil, *ParseComplete, *NoData:
+		case *ParameterDescription:
+			stmt.Parameters = msg.Types
+		case *RowDescription:
+			stmt.Fields = msg.Fields
+		default:
+			r.unexpected(msg)
+		}
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return stmt, nil
+}
+
+// Run the statement with the given parameters, and return Results for
+// reading the single result. Parameters may be nil for NULL, strings,
+// integers, floats, bools, times, or values with a String method, which
+// are sent in text format, or byte slices, which are sent as is in
+// binary format, e.g., for bytea.
+func (s *PreparedStatement) Query(ctx context.Context, args ...interface{}) (*Results, error) {
+	if len(args) != len(s.Parameters) {
+		return nil, fmt.Errorf("post: statement takes %v parameters; got %v",
+			len(s.Parameters), len(args))
+	}
+	params, formats, err := encodeParameters(args)
+	if err != nil {
+		return nil, fmt.Errorf("post: %w", err)
+	}
+	r, err := s.c.startQuery(ctx, func(p *ProtoStream) (err error) {
+		err = p.Send(&Bind{Statement: s.Name, ParameterFormats: formats, Parameters: params})
+		if err == nil {
+			err = p.SendExecute("", 0)
+		}
+		if err == nil {
+			err = p.SendSync()
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	r.prepared = s.Fields
+	return r, nil
+}
+
+// Run the statement with the given parameters, as for Query, and return
+// its command tag, discarding any rows.
+func (s *PreparedStatement) Exec(ctx context.Context, args ...interface{}) (tag CommandTag, err error) {
+	r, err := s.Query(ctx, args...)
+	if err != nil {
+		return "", err
+	}
+	for r.NextResult() {
+		for r.Next() {
+		}
+		tag = r.Tag()
+	}
+	return tag, r.Close()
+}
+
+// Close the statement on the server.
+func (s *PreparedStatement) Close(ctx context.Context) error {
+	r, err := s.c.startQuery(ctx, func(p *ProtoStream) (err error) {
+		err = p.SendClose(Statement, s.Name)
+		if err == nil {
+			err = p.SendSync()
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	for !r.done {
+		msg := r.receive()
+		switch msg := msg.(type) {
+		case nil, *CloseComplete:
+		default:
+			r.unexpected(msg)
+		}
+	}
+	return r.err
+}
+
+// Format parameters, and get the format of each for a Bind: binary for
+// byte slices, and otherwise text. The formats are nil if all are text.
+func encodeParameters(args []interface{}) (params [][]byte, formats []DataFormat, err error) {
+	params = make([][]byte, len(args))
+	for i, arg := range args {
+		params[i], err = encodeParameter(arg)
+		if err != nil {
+			return nil, nil, fmt.Errorf("parameter %d: %w", i+1, err)
+		}
+		if arg, ok := arg.([]byte); ok && arg != nil {
+			if formats == nil {
+				formats = make([]DataFormat, len(args))
+			}
+			formats[i] = BinaryFormat
+		}
+	}
+	return params, formats, nil
+}
+
+// Format a parameter in text format, or a byte slice in binary format
+// as is.
+func encodeParameter(arg interface{}) ([]byte, error) {
+	switch arg := arg.(type) {
+	case nil:
+		return nil, nil
+	case []byte:
+		if arg == nil {
+			return nil, nil
+		}
+		return arg, nil
+	case string:
+		return []byte(arg), nil
+	case bool:
+		if arg {
+			return []byte("t"), nil
+		}
+		return []byte("f"), nil
+	case int:
+		return strconv.AppendInt(nil, int64(arg), 10), nil
+	case int8:
+		return strconv.AppendInt(nil, int64(arg), 10), nil
+	case int16:
+		return strconv.AppendInt(nil, int64(arg), 10), nil
+	case int32:
+		return strconv.AppendInt(nil, int64(arg), 10), nil
+	case int64:
+		return strconv.AppendInt(nil, arg, 10), nil
+	case uint:
+		return strconv.AppendUint(nil, uint64(arg), 10), nil
+	case uint8:
+		return strconv.AppendUint(nil, uint64(arg), 10), nil
+	case uint16:
+		return strconv.AppendUint(nil, uint64(arg), 10), nil
+	case uint32:
+		return strconv.AppendUint(nil, uint64(arg), 10), nil
+	case uint64:
+		return strconv.AppendUint(nil, arg, 10), nil
+	case float32:
+		return strconv.AppendFloat(nil, float64(arg), 'g', -1, 32), nil
+	case float64:
+		return strconv.AppendFloat(nil, arg, 'g', -1, 64), nil
+	case time.Time:
+		return arg.AppendFormat(nil, "2006-01-02 15:04:05.999999999Z07:00"), nil
+	case fmt.Stringer:
+		return []byte(arg.String()), nil
+	}
+	return nil, fmt.Errorf("unsupported type %T", arg)
+}
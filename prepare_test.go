@@ -0,0 +1,189 @@
+package post
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Receive frontend messages, failing the test unless they have the
+// given types.
+func receiveAll(t *testing.T, p *ProtoStream, types ...MessageType) []FrontendMessage {
+	var msgs []FrontendMessage
+	for _, msgType := range types {
+		next, err := p.Next()
+		if err != nil {
+			t.Errorf("want nil err; got %v", err)
+			return msgs
+		}
+		if next != msgType {
+			t.Errorf("want message type %q; got %q", msgType, next)
+		}
+		msg := newFrontendMessage(next)
+		err = p.receive(msg)
+		if err != nil {
+			t.Errorf("want nil err; got %v", err)
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs
+}
+
+func TestPrepare(t *testing.T) {
+	c, done := connectServing(t, func(p *ProtoStream) {
+		msgs := receiveAll(t, p, MsgParse, MsgDescribe, MsgSync)
+		if parse := msgs[0].(*Parse); parse.Name != "s" || parse.Query != "select $1, $2" {
+			t.Errorf("want Parse of s; got %#v", parse)
+		}
+		sendAll(t, p, &ParseComplete{}, &ParameterDescription{[]Oid{23, 25}},
+			testFields, testIdle)
+
+		msgs = receiveAll(t, p, MsgBind, MsgExecute, MsgSync)
+		expected := [][]byte{[]byte("42"), nil}
+		if bind := msgs[0].(*Bind); bind.Statement != "s" ||
+			!reflect.DeepEqual(expected, bind.Parameters) {
+			t.Errorf("want Bind of s with %q; got %#v", expected, bind)
+		}
+		sendAll(t, p, &BindComplete{}, testRow, &CommandComplete{"SELECT 1"}, testIdle)
+
+		receiveAll(t, p, MsgBind, MsgExecute, MsgSync)
+		sendAll(t, p, testErr, testIdle)
+
+		receiveAll(t, p, MsgClose, MsgSync)
+		sendAll(t, p, &CloseComplete{}, testIdle)
+		p.ReceiveFrontendMessage()
+	})
+	defer func() { <-done }()
+	defer c.Close()
+	ctx := context.Background()
+
+	stmt, err := c.Prepare(ctx, "s", "select $1, $2")
+	if err != nil {
+		t.Fatalf("want nil err; got %v", err)
+	}
+	if !reflect.DeepEqual([]Oid{23, 25}, stmt.Parameters) {
+		t.Errorf("want parameters [23 25]; got %v", stmt.Parameters)
+	}
+	if len(stmt.Fields) != 2 || stmt.Fields[0].Name != "a" {
+		t.Errorf("want fields a, b; got %#v", stmt.Fields)
+	}
+
+	r, err := stmt.Query(ctx, 42, nil)
+	if err != nil {
+		t.Fatalf("want nil err; got %v", err)
+	}
+	expected := []queryResult{{[]string{"a", "b"}, [][]string{{"1", "NULL"}}, "SELECT 1"}}
+	if actual := readResults(r); !reflect.DeepEqual(expected, actual) {
+		t.Errorf("want %#v; got %#v", expected, actual)
+	}
+	if err := r.Close(); err != nil {
+		t.Errorf("want nil err; got %v", err)
+	}
+
+	if _, err := stmt.Exec(ctx, 1); err == nil {
+		t.Error("want err for missing parameter; got nil")
+	}
+	_, err = stmt.Exec(ctx, 1, "x")
+	if pgErr, ok := err.(*PgError); !ok || pgErr.Code != "42P01" {
+		t.Errorf("want 42P01 error; got %v", err)
+	}
+
+	if err := stmt.Close(ctx); err != nil {
+		t.Errorf("want nil err; got %v", err)
+	}
+}
+
+func TestPrepareError(t *testing.T) {
+	c, done := connectServing(t, func(p *ProtoStream) {
+		receiveAll(t, p, MsgParse, MsgDescribe, MsgSync)
+		sendAll(t, p, testErr, testIdle)
+
+		receiveAll(t, p, MsgParse, MsgDescribe, MsgSync)
+		sendAll(t, p, &ParseComplete{}, &ParameterDescription{}, &NoData{}, testIdle)
+
+		receiveAll(t, p, MsgBind, MsgExecute, MsgSync)
+		sendAll(t, p, &BindComplete{}, &CommandComplete{"INSERT 0 1"}, testIdle)
+		p.ReceiveFrontendMessage()
+	})
+	defer func() { <-done }()
+	defer c.Close()
+	ctx := context.Background()
+
+	_, err := c.Prepare(ctx, "", "select * from nope")
+	if pgErr, ok := err.(*PgError); !ok || pgErr.Code != "42P01" {
+		t.Errorf("want 42P01 error; got %v", err)
+	}
+	// the connection recovers
+	stmt, err := c.Prepare(ctx, "", "insert into t values (1)")
+	if err != nil {
+		t.Fatalf("want nil err; got %v", err)
+	}
+	if stmt.Fields != nil {
+		t.Errorf("want no fields; got %#v", stmt.Fields)
+	}
+	tag, err := stmt.Exec(ctx)
+	if err != nil || tag != "INSERT 0 1" {
+		t.Errorf("want INSERT 0 1; got %v, %v", tag, err)
+	}
+}
+
+func TestPrepareBinaryParameter(t *testing.T) {
+	value := []byte("a\\b\x00\xff")
+	c, done := connectServing(t, func(p *ProtoStream) {
+		msgs := receiveAll(t, p, MsgBind, MsgExecute, MsgSync)
+		bind := msgs[0].(*Bind)
+		if !reflect.DeepEqual([]DataFormat{BinaryFormat, TextFormat, TextFormat}, bind.ParameterFormats) {
+			t.Errorf("want binary, text, text; got %v", bind.ParameterFormats)
+		}
+		if !reflect.DeepEqual([][]byte{value, []byte("7"), nil}, bind.Parameters) {
+			t.Errorf("want %q, 7, NULL; got %q", value, bind.Parameters)
+		}
+		sendAll(t, p, &BindComplete{}, &CommandComplete{"INSERT 0 1"}, testIdle)
+		p.ReceiveFrontendMessage()
+	})
+	defer func() { <-done }()
+	defer c.Close()
+
+	stmt := &PreparedStatement{Name: "s", Parameters: []Oid{OidBytea, OidInt4, OidBytea}, c: c}
+	tag, err := stmt.Exec(context.Background(), value, 7, []byte(nil))
+	if err != nil || tag != "INSERT 0 1" {
+		t.Errorf("want INSERT 0 1; got %v, %v", tag, err)
+	}
+}
+
+func TestEncodeParameter(t *testing.T) {
+	var paramTests = []struct {
+		arg      interface{}
+		expected []byte
+	}{
+		{nil, nil},
+		{[]byte(nil), nil},
+		{[]byte("abc"), []byte("abc")},
+		{"abc", []byte("abc")},
+		{true, []byte("t")},
+		{false, []byte("f")},
+		{-42, []byte("-42")},
+		{int16(7), []byte("7")},
+		{uint64(1 << 63), []byte("9223372036854775808")},
+		{1.5, []byte("1.5")},
+		{float32(0.1), []byte("0.1")},
+		{time.Date(2024, 2, 29, 12, 30, 0, 500000000, time.UTC),
+			[]byte("2024-02-29 12:30:00.5Z")},
+		{time.Date(2024, 2, 29, 12, 30, 0, 0, time.FixedZone("", -7*3600)),
+			[]byte("2024-02-29 12:30:00-07:00")},
+		{time.Second, []byte("1s")},
+	}
+	for i, tt := range paramTests {
+		actual, err := encodeParameter(tt.arg)
+		if err != nil {
+			t.Errorf("%d: want nil err; got %v", i, err)
+		}
+		if !reflect.DeepEqual(tt.expected, actual) {
+			t.Errorf("%d: want %q; got %q", i, tt.expected, actual)
+		}
+	}
+	if _, err := encodeParameter(struct{}{}); err == nil {
+		t.Error("want err; got nil")
+	}
+}
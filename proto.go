@@ -1,8 +1,13 @@
 package post
 
 import (
+	"bytes"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
+	"net"
+	"sync"
 )
 
 type AuthResponseType int32
@@ -16,6 +21,9 @@ const (
 	AuthenticationGSS               AuthResponseType = 7
 	AuthenticationSSPI              AuthResponseType = 9
 	AuthenticationGSSContinue       AuthResponseType = 8
+	AuthenticationSASL              AuthResponseType = 10
+	AuthenticationSASLContinue      AuthResponseType = 11
+	AuthenticationSASLFinal         AuthResponseType = 12
 )
 
 type ServerSSL byte
@@ -52,8 +60,9 @@ type AuthResponse struct {
 }
 
 type BackendKeyData struct {
-	Pid       int32
-	SecretKey int32
+	Pid int32
+	// The key is 4 bytes under protocol 3.0, and up to 256 under 3.2.
+	SecretKey []byte
 }
 
 type CopyResponse struct {
@@ -77,23 +86,24 @@ type Oid uint32
 type ErrorField byte
 
 const (
-	Severity         ErrorField = 'S'
-	Code             ErrorField = 'C'
-	Message          ErrorField = 'M'
-	Detail           ErrorField = 'D'
-	Hint             ErrorField = 'H'
-	Position         ErrorField = 'P'
-	InternalPosition ErrorField = 'p'
-	InternalQuery    ErrorField = 'q'
-	Where            ErrorField = 'W'
-	Schema           ErrorField = 's'
-	Table            ErrorField = 't'
-	Column           ErrorField = 'c'
-	DataType         ErrorField = 'd'
-	Constraint       ErrorField = 'n'
-	File             ErrorField = 'F'
-	Line             ErrorField = 'L'
-	Routine          ErrorField = 'R'
+	Severity             ErrorField = 'S'
+	SeverityNonLocalized ErrorField = 'V'
+	Code                 ErrorField = 'C'
+	Message              ErrorField = 'M'
+	Detail               ErrorField = 'D'
+	Hint                 ErrorField = 'H'
+	Position             ErrorField = 'P'
+	InternalPosition     ErrorField = 'p'
+	InternalQuery        ErrorField = 'q'
+	Where                ErrorField = 'W'
+	Schema               ErrorField = 's'
+	Table                ErrorField = 't'
+	Column               ErrorField = 'c'
+	DataType             ErrorField = 'd'
+	Constraint           ErrorField = 'n'
+	File                 ErrorField = 'F'
+	Line                 ErrorField = 'L'
+	Routine              ErrorField = 'R'
 )
 
 type TransactionStatus byte
@@ -116,662 +126,417 @@ type FieldDescription struct {
 
 type ProtoStream struct {
 	str  *Stream
-	next byte
+	next MessageType
+	// scratch space for encoding outgoing messages
+	buf []byte
+	// whether this is the server's end, i.e., it has received a
+	// startup message
+	server bool
+	tracer Tracer
+	// held while tracing, since messages may be sent and received at
+	// the same time, as by SendBatch
+	traceMu sync.Mutex
+}
+
+// Create a new ProtoStream on top of the given Stream.
+func NewProtoStream(str *Stream) *ProtoStream {
+	return &ProtoStream{str: str}
+}
+
+// Create a new ProtoStream on top of the given connection.
+func NewProtoStreamConn(conn net.Conn) *ProtoStream {
+	return NewProtoStream(NewStream(conn))
+}
+
+// Create a new ProtoStream on top of an arbitrary io.ReadWriter. This
+// makes it possible to speak the protocol over pipes, Unix sockets, TLS
+// wrappers, or in-memory buffers.
+func NewProtoStreamReadWriter(rw io.ReadWriter) *ProtoStream {
+	return NewProtoStream(NewStreamReadWriter(rw))
 }
 
 // Read the next message type from the stream.
-func (p *ProtoStream) Next() (msgType byte, err error) {
-	p.next, err = p.str.ReadByte()
+func (p *ProtoStream) Next() (msgType MessageType, err error) {
+	next, err := p.str.ReadByte()
 	if err != nil {
 		return 0, err
 	}
+	p.next = MessageType(next)
 	return p.next, nil
 }
 
-// Read the next message type from the stream. Panic if it's not the
-// expected message type.
-func (p *ProtoStream) Expect(expected byte) (err error) {
-	p.next, err = p.str.ReadByte()
+// Read the next message type from the stream. If it's not the expected
+// message type, return an *UnexpectedMessageError. An unexpected
+// ErrorResponse is read in full and attached to that error; the body
+// of any other unexpected message is left unread.
+func (p *ProtoStream) Expect(expected MessageType) (err error) {
+	_, err = p.Next()
 	if err != nil {
 		return err
 	}
-	if p.next != expected {
-		panic(fmt.Sprintf("expected message type %v; got %v",
-			expected, p.next))
+	if p.next == expected {
+		return nil
 	}
-	return nil
+	unexpected := &UnexpectedMessageError{Expected: expected, Actual: p.next}
+	if p.next == MsgErrorResponse {
+		unexpected.Err, err = p.ReceiveErrorResponse()
+		if err != nil {
+			return err
+		}
+	}
+	return unexpected
 }
 
-func (p *ProtoStream) SendStartupMessage(params map[string]string) (err error) {
-	var msgSize int32 = 4 /* size itself */ + 4 /* protocol header */
-	for key, val := range params {
-		msgSize += int32(len(key)) + 1 + int32(len(val)) + 1
-	}
-	msgSize += 1 // the trailing zero byte
-	_, err = p.str.WriteInt32(msgSize)
+// Read the next message from the stream and decode it according to its
+// type. Messages without a dedicated type are returned as an
+// *UnknownMessage.
+func (p *ProtoStream) ReceiveMessage() (msg BackendMessage, err error) {
+	msgType, err := p.Next()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	// the protocol version number
-	_, err = p.str.WriteInt32(196608)
+	msg, err = p.receiveBody(msgType)
 	if err != nil {
-		return err
-	}
-	for key, val := range params {
-		_, err = p.str.WriteCString(key)
-		if err != nil {
-			return err
-		}
-		_, err = p.str.WriteCString(val)
-		if err != nil {
-			return err
-		}
+		// don't hand back a typed nil
+		return nil, err
 	}
-	_, err = p.str.WriteByte(0)
-	return err
+	return msg, nil
+}
+
+func (p *ProtoStream) receiveBody(msgType MessageType) (msg BackendMessage, err error) {
+	msg = newBackendMessage(msgType)
+	return msg, p.receive(msg.(decoder))
+}
+
+func (p *ProtoStream) SendStartupMessage(params map[string]string) (err error) {
+	return p.SendStartupMessageVersion(ProtocolVersion30, params)
+}
+
+// Send a StartupMessage requesting the given protocol version, e.g.,
+// ProtocolVersion32.
+func (p *ProtoStream) SendStartupMessageVersion(version int32, params map[string]string) (err error) {
+	return p.Send(&StartupMessage{version, params})
 }
 
 func (p *ProtoStream) SendSSLRequest() (err error) {
-	_, err = p.str.WriteInt32(8)
-	if err != nil {
-		return err
-	}
-	_, err = p.str.WriteInt32(80877103)
-	return err
+	return p.Send(&SSLRequest{})
 }
 
 func (p *ProtoStream) SendTerminate() (err error) {
-	return p.sendEmpty('X')
+	return p.Send(&Terminate{})
 }
 
 func (p *ProtoStream) SendBind(portal string, statement string,
 	formats []int16, params [][]byte, resultFormats []int16) (err error) {
-	_, err = p.str.WriteByte('B')
-	if err != nil {
-		return err
-	}
-	msgSize := 4 + (len(portal) + 1) + (len(statement) + 1) +
-		(2 + len(formats)*2) +
-		2 + // param count; we account for actual params below
-		(2 + len(resultFormats)*2)
-	for _, param := range params {
-		msgSize += 4 + len(param)
-	}
-	_, err = p.str.WriteInt32(int32(msgSize))
-	if err != nil {
-		return err
-	}
-	_, err = p.str.WriteCString(portal)
-	if err != nil {
-		return err
-	}
-	_, err = p.str.WriteCString(statement)
-	if err != nil {
-		return err
-	}
-	_, err = p.str.WriteInt16(int16(len(formats)))
-	if err != nil {
-		return err
-	}
-	for _, fmt := range formats {
-		_, err = p.str.WriteInt16(fmt)
-		if err != nil {
-			return err
-		}
-	}
-	_, err = p.str.WriteInt16(int16(len(params)))
-	for _, param := range params {
-		_, err = p.str.WriteInt32(int32(len(param)))
-		if err != nil {
-			return err
-		}
-		_, err := p.str.Write(param)
-		if err != nil {
-			return err
-		}
-	}
-	_, err = p.str.WriteInt16(int16(len(resultFormats)))
-	if err != nil {
-		return err
-	}
-	for _, fmt := range resultFormats {
-		_, err = p.str.WriteInt16(fmt)
-		if err != nil {
-			return err
-		}
-	}
-	return nil
+	return p.Send(&Bind{
+		Portal:           portal,
+		Statement:        statement,
+		ParameterFormats: dataFormats(formats),
+		Parameters:       params,
+		ResultFormats:    dataFormats(resultFormats),
+	})
 }
 
-func (p *ProtoStream) SendCancelRequest(pid, secretKey int32) (err error) {
-	_, err = p.str.WriteInt32(16)
-	if err != nil {
-		return err
-	}
-	_, err = p.str.WriteInt32(80877102)
-	if err != nil {
-		return err
-	}
-	_, err = p.str.WriteInt32(pid)
-	if err != nil {
-		return err
+func dataFormats(formats []int16) []DataFormat {
+	result := make([]DataFormat, len(formats))
+	for i, format := range formats {
+		result[i] = DataFormat(format)
 	}
-	_, err = p.str.WriteInt32(secretKey)
-	return err
+	return result
+}
+
+func (p *ProtoStream) SendCancelRequest(pid int32, secretKey []byte) (err error) {
+	return p.Send(&CancelRequest{pid, secretKey})
 }
 
 func (p *ProtoStream) SendClose(targetType TargetKind, target string) (err error) {
-	msgSize := int32(4 + 1 + len(target) + 1)
-	_, err = p.str.WriteInt32(msgSize)
-	if err != nil {
-		return err
-	}
-	_, err = p.str.WriteByte(byte(targetType))
-	if err != nil {
-		return err
-	}
-	_, err = p.str.WriteCString(target)
-	return err
+	return p.Send(&Close{targetType, target})
 }
 
 func (p *ProtoStream) SendCopyData(data []byte) (err error) {
-	_, err = p.str.WriteByte('d')
-	if err != nil {
-		return err
-	}
-	_, err = p.str.WriteInt32(4 + int32(len(data)))
-	if err != nil {
-		return err
-	}
-	_, err = p.str.Write(data)
-	return err
+	return p.Send(&CopyData{data})
 }
 
 func (p *ProtoStream) SendCopyDone() (err error) {
-	return p.sendEmpty('c')
+	return p.Send(&CopyDone{})
 }
 
 func (p *ProtoStream) SendCopyFail(reason string) (err error) {
-	_, err = p.str.WriteByte('f')
-	if err != nil {
-		return err
-	}
-	_, err = p.str.WriteInt32(4 + int32(len(reason)) + 1)
-	if err != nil {
-		return err
-	}
-	_, err = p.str.WriteCString(reason)
-	return err
+	return p.Send(&CopyFail{reason})
 }
 
 func (p *ProtoStream) SendDescribe(kind TargetKind, name string) (err error) {
-	_, err = p.str.WriteByte('D')
-	if err != nil {
-		return err
-	}
-	_, err = p.str.WriteInt32(4 + 1 + int32(len(name)) + 1)
-	if err != nil {
-		return err
-	}
-	_, err = p.str.WriteByte(byte(kind))
-	if err != nil {
-		return err
-	}
-	_, err = p.str.WriteCString(name)
-	return err
+	return p.Send(&Describe{kind, name})
 }
 
 func (p *ProtoStream) SendExecute(portal string, maxRows int32) (err error) {
-	_, err = p.str.WriteByte('E')
-	if err != nil {
-		return err
-	}
-	_, err = p.str.WriteInt32(4 + int32(len(portal)) + 1 + 4)
-	if err != nil {
-		return err
-	}
-	_, err = p.str.WriteCString(portal)
-	if err != nil {
-		return err
-	}
-	_, err = p.str.WriteInt32(maxRows)
-	return err
+	return p.Send(&Execute{portal, maxRows})
 }
 
 func (p *ProtoStream) SendFlush() (err error) {
-	return p.sendEmpty('H')
+	return p.Send(&Flush{})
 }
 
 func (p *ProtoStream) SendParse(statement, query string, paramTypes []Oid) (err error) {
-	_, err = p.str.WriteByte('P')
-	if err != nil {
-		return err
-	}
-	_, err = p.str.WriteInt32(4 + int32(len(statement)) + 1 +
-		int32(len(query)) + 1 + 2 + 4 * int32(len(paramTypes)))
-	if err != nil {
-		return err
-	}
-	_, err = p.str.WriteCString(statement)
-	if err != nil {
-		return err
-	}
-	_, err = p.str.WriteCString(query)
-	if err != nil {
-		return err
-	}
-	_, err = p.str.WriteInt16(int16(len(paramTypes)))
-	if err != nil {
-		return err
-	}
-	for _, paramType := range paramTypes {
-		_, err = p.str.WriteInt32(int32(paramType))
-		if err != nil {
-			return err
-		}
-	}
-	return nil
+	return p.Send(&Parse{statement, query, paramTypes})
 }
 
 func (p *ProtoStream) SendPasswordMessage(password string) (err error) {
-	_, err = p.str.WriteByte('p')
-	if err != nil {
-		return err
-	}
-	_, err = p.str.WriteInt32(4 + int32(len(password)) + 1)
-	if err != nil {
-		return err
-	}
-	_, err = p.str.WriteCString(password)
-	return err
+	return p.Send(&PasswordMessage{password})
+}
+
+// Send a SASLInitialResponse, selecting a SASL mechanism from those
+// offered by the server. A nil data means no initial response.
+func (p *ProtoStream) SendSASLInitialResponse(mechanism string, data []byte) (err error) {
+	return p.Send(&SASLInitialResponse{mechanism, data})
+}
+
+// Send a SASLResponse with the next step of the SASL exchange.
+func (p *ProtoStream) SendSASLResponse(data []byte) (err error) {
+	return p.Send(&SASLResponse{data})
 }
 
 func (p *ProtoStream) SendQuery(query string) (err error) {
-	_, err = p.str.WriteByte('Q')
-	if err != nil {
-		return err
-	}
-	_, err = p.str.WriteInt32(4 + int32(len(query)) + 1)
-	if err != nil {
-		return err
-	}
-	_, err = p.str.WriteCString(query)
-	return err
+	return p.Send(&Query{query})
 }
 
 func (p *ProtoStream) SendSync() (err error) {
-	return p.sendEmpty('S')
+	return p.Send(&Sync{})
+}
+
+// Encode a message and write it to the stream. Like the other Send
+// methods, this only buffers the message; call Flush to send it.
+func (p *ProtoStream) Send(msg Encoder) (err error) {
+	p.buf = msg.Encode(p.buf[:0])
+	if p.buf[0] == 0 {
+		// a startup-phase message, with no type byte
+		p.traceSent(0, p.buf[4:])
+	} else {
+		p.traceSent(MessageType(p.buf[0]), p.buf[5:])
+	}
+	_, err = p.str.Write(p.buf)
+	return err
 }
 
 func (p *ProtoStream) Flush() error {
 	return p.str.Flush()
 }
 
+// Get the number of bytes received but not yet consumed. When this is
+// zero, reading the next message may block, so it is a good time to
+// Flush anything pending.
+func (p *ProtoStream) Buffered() int {
+	return p.str.Buffered()
+}
+
 func (p *ProtoStream) ReceiveAuthResponse() (response *AuthResponse, err error) {
-	size, err := p.str.ReadInt32()
+	response = &AuthResponse{}
+	err = p.receive(response)
 	if err != nil {
 		return nil, err
 	}
-	subtype, err := p.str.ReadInt32()
-	if err != nil {
-		return nil, err
-	}
-	var rest []byte
-	if size-8 > 0 {
-		rest = make([]byte, size-8)
-		_, err = p.str.Read(rest)
-		if err != nil {
-			return nil, err
-		}
-	}
-	return &AuthResponse{AuthResponseType(subtype), rest}, nil
+	return response, nil
 }
 
 func (p *ProtoStream) ReceiveBackendKeyData() (keyData *BackendKeyData, err error) {
-	size, err := p.str.ReadInt32()
-	if err != nil {
-		return nil, err
-	}
-	if size != 12 {
-		return nil, fmt.Errorf("post: expected 12 byte BackendKeyData; got %v", size)
-	}
-	pid, err := p.str.ReadInt32()
+	keyData = &BackendKeyData{}
+	err = p.receive(keyData)
 	if err != nil {
 		return nil, err
 	}
-	key, err := p.str.ReadInt32()
-	if err != nil {
-		return nil, err
-	}
-	return &BackendKeyData{pid, key}, nil
+	return keyData, nil
 }
 
 func (p *ProtoStream) ReceiveBindComplete() (err error) {
-	return p.receiveEmpty("BindComplete")
+	return p.receive(&BindComplete{})
 }
 
 func (p *ProtoStream) ReceiveCloseComplete() (err error) {
-	return p.receiveEmpty("CloseComplete")
+	return p.receive(&CloseComplete{})
 }
 
-func (p *ProtoStream) ReceiveCommandComplete() (tag string, err error) {
-	size, err := p.str.ReadInt32()
-	if err != nil {
-		return "", err
-	}
-	tag, err = p.str.ReadCString()
-	if int32(4+len(tag)+1) != size {
-		return "", fmt.Errorf("post: expected %v byte CommandComplete; got %v",
-			size, 4+len(tag)+1)
-	}
-	return tag, err
+func (p *ProtoStream) ReceiveCommandComplete() (tag CommandTag, err error) {
+	msg := &CommandComplete{}
+	err = p.receive(msg)
+	return msg.Tag, err
 }
 
 func (p *ProtoStream) ReceiveCopyData() (data io.Reader, err error) {
-	size, err := p.str.ReadInt32()
+	msg := &CopyData{}
+	err = p.receive(msg)
 	if err != nil {
 		return nil, err
 	}
-	return io.LimitReader(p.str, int64(size-4)), nil
+	return bytes.NewReader(msg.Data), nil
+}
+
+func (p *ProtoStream) ReceiveCopyDone() (err error) {
+	return p.receive(&CopyDone{})
 }
 
 func (p *ProtoStream) ReceiveCopyInResponse() (response *CopyResponse, err error) {
-	return p.receiveCopyResponse()
+	msg := &CopyInResponse{}
+	return p.receiveCopyResponse(msg, (*CopyResponse)(msg))
 }
 
 func (p *ProtoStream) ReceiveCopyOutResponse() (response *CopyResponse, err error) {
-	return p.receiveCopyResponse()
+	msg := &CopyOutResponse{}
+	return p.receiveCopyResponse(msg, (*CopyResponse)(msg))
 }
 
 func (p *ProtoStream) ReceiveCopyBothResponse() (response *CopyResponse, err error) {
-	return p.receiveCopyResponse()
+	msg := &CopyBothResponse{}
+	return p.receiveCopyResponse(msg, (*CopyResponse)(msg))
 }
 
-func (p *ProtoStream) receiveCopyResponse() (response *CopyResponse, err error) {
-	size, err := p.str.ReadInt32()
+func (p *ProtoStream) receiveCopyResponse(msg decoder, response *CopyResponse) (*CopyResponse, error) {
+	err := p.receive(msg)
 	if err != nil {
 		return nil, err
 	}
-	format, err := p.str.ReadByte()
-	if err != nil {
-		return nil, err
-	}
-	colCount, err := p.str.ReadInt16()
-	if err != nil {
-		return nil, err
-	}
-	colFormats := make([]DataFormat, colCount)
-	for i, _ := range colFormats {
-		fmt, err := p.str.ReadInt16()
-		if err != nil {
-			return nil, err
-		}
-		colFormats[i] = DataFormat(fmt)
-	}
-	read := 4 + 1 + 2 + (2 * int32(colCount))
-	if read != size {
-		return nil, fmt.Errorf("post: expected %v byte CopyInResponse; got %v",
-			size, read)
-	}
-	return &CopyResponse{CopyFormat(format), colFormats}, nil
+	return response, nil
 }
 
 func (p *ProtoStream) ReceiveDataRow() (data [][]byte, err error) {
-	size, err := p.str.ReadInt32()
-	if err != nil {
-		return nil, err
-	}
-	var totRead int32 = 4
-	colCount, err := p.str.ReadInt16()
-	if err != nil {
-		return nil, err
-	}
-	totRead += 2
-	// TODO: avoid allocations here
-	data = make([][]byte, colCount)
-	for i := int16(0); i < colCount; i++ {
-		fieldSize, err := p.str.ReadInt32()
-		if err != nil {
-			return nil, err
-		}
-		totRead += 4
-		if fieldSize > -1 {
-			data[i] = make([]byte, fieldSize)
-			_, err = io.ReadFull(p.str, data[i])
-			if err != nil {
-				return nil, err
-			}
-			totRead += fieldSize
-		}
-	}
-	if totRead == size {
-		return data, nil
-	} else {
-		return nil, fmt.Errorf("post: expected %v byte DataRow; got %v", size, totRead)
-	}
+	msg := &DataRow{}
+	err = p.receive(msg)
+	return msg.Values, err
 }
 
 func (p *ProtoStream) ReceiveEmptyQueryResponse() (err error) {
-	return p.receiveEmpty("EmptyQueryResponse")
+	return p.receive(&EmptyQueryResponse{})
 }
 
-func (p *ProtoStream) ReceiveErrorResponse() (response map[ErrorField]string, err error) {
-	// literally the same thing
-	return p.ReceiveNoticeResponse()
-}
-
-func (p *ProtoStream) ReceiveNoticeResponse() (response map[ErrorField]string, err error) {
-	size, err := p.str.ReadInt32()
+func (p *ProtoStream) ReceiveErrorResponse() (pgErr *PgError, err error) {
+	pgErr = &PgError{}
+	err = p.receive(pgErr)
 	if err != nil {
 		return nil, err
 	}
-	response = make(map[ErrorField]string)
-	var totRead int32 = 4
-	for code, err := p.str.ReadByte(); err == nil && code != 0x0; code, err = p.str.ReadByte() {
-		str, err := p.str.ReadCString()
-		if err != nil {
-			return nil, err
-		}
+	return pgErr, nil
+}
 
-		response[ErrorField(code)] = str
-		totRead += 1 /* for code */ + int32(len(str)) + 1
-	}
+func (p *ProtoStream) ReceiveNoticeResponse() (notice *Notice, err error) {
+	// literally the same thing as an ErrorResponse
+	notice = &Notice{}
+	err = p.receive(notice)
 	if err != nil {
 		return nil, err
 	}
-	totRead += 1 // for last code
-	if totRead == size {
-		return response, nil
-	} else {
-		return nil, fmt.Errorf("post: expected %v byte ErrorResponse; got %v", size, totRead)
-	}
+	return notice, nil
 }
 
 func (p *ProtoStream) ReceiveNoData() (err error) {
-	return p.receiveEmpty("NoData")
+	return p.receive(&NoData{})
 }
 
 func (p *ProtoStream) ReceiveNotificationResponse() (notif *Notification, err error) {
-	size, err := p.str.ReadInt32()
-	if err != nil {
-		return nil, err
-	}
-	var totRead int32 = 4
-	pid, err := p.str.ReadInt32()
-	if err != nil {
-		return nil, err
-	}
-	totRead += 4
-	channel, err := p.str.ReadCString()
+	notif = &Notification{}
+	err = p.receive(notif)
 	if err != nil {
 		return nil, err
 	}
-	totRead += int32(len(channel)) + 1
-	payload, err := p.str.ReadCString()
+	return notif, nil
+}
+
+func (p *ProtoStream) ReceiveNegotiateProtocolVersion() (negotiate *NegotiateProtocolVersion, err error) {
+	negotiate = &NegotiateProtocolVersion{}
+	err = p.receive(negotiate)
 	if err != nil {
 		return nil, err
 	}
-	totRead += int32(len(payload)) + 1
-	if size == totRead {
-		return &Notification{pid, channel, payload}, nil
-	} else {
-		return nil, fmt.Errorf("post: expected %v byte Notification; got %v", size, totRead)
-	}
+	return negotiate, nil
 }
 
 func (p *ProtoStream) ReceiveParameterDescription() (desc []Oid, err error) {
-	size, err := p.str.ReadInt32()
-	if err != nil {
-		return nil, err
-	}
-	var totRead int32 = 4
-	count, err := p.str.ReadInt16()
-	if err != nil {
-		return nil, err
-	}
-	totRead += 2
-	desc = make([]Oid, count)
-	for i := int16(0); i < count; i++ {
-		param, err := p.str.ReadInt32()
-		if err != nil {
-			return nil, err
-		}
-		desc[i] = Oid(param)
-		totRead += 4
-	}
-	if size == totRead {
-		return desc, nil
-	} else {
-		return nil, fmt.Errorf("post: expected %v byte ParameterDescription; got %v",
-			size, totRead)
-	}
+	msg := &ParameterDescription{}
+	err = p.receive(msg)
+	return msg.Types, err
 }
 
 func (p *ProtoStream) ReceiveParameterStatus() (status *ParameterStatus, err error) {
-	size, err := p.str.ReadInt32()
-	if err != nil {
-		return nil, err
-	}
-	var totRead int32 = 4
-	param, err := p.str.ReadCString()
-	if err != nil {
-		return nil, err
-	}
-	totRead += int32(len(param)) + 1
-	value, err := p.str.ReadCString()
+	status = &ParameterStatus{}
+	err = p.receive(status)
 	if err != nil {
 		return nil, err
 	}
-	totRead += int32(len(value)) + 1
-	if size == totRead {
-		return &ParameterStatus{param, value}, nil
-	} else {
-		return nil, fmt.Errorf("post: expected %v byte ParameterStatus; got %v",
-			size, totRead)
-	}
+	return status, nil
 }
 
 func (p *ProtoStream) ReceiveParseComplete() (err error) {
-	return p.receiveEmpty("ParseComplete")
+	return p.receive(&ParseComplete{})
 }
 
 func (p *ProtoStream) ReceivePortalSuspended() (err error) {
-	return p.receiveEmpty("PortalSuspended")
+	return p.receive(&PortalSuspended{})
 }
 
 func (p *ProtoStream) ReceiveReadyForQuery() (status TransactionStatus, err error) {
-	size, err := p.str.ReadInt32()
-	if err != nil {
-		return 0x0, err
-	} else if size != 5 {
-		return 0x0, fmt.Errorf("post: expected 5 byte ReadyForQuery; got %v", size)
-	}
-	st, err := p.str.ReadByte()
-	return TransactionStatus(st), err
+	msg := &ReadyForQuery{}
+	err = p.receive(msg)
+	return msg.Status, err
 }
 
 func (p *ProtoStream) ReceiveRowDescription() (descs []FieldDescription, err error) {
-	size, err := p.str.ReadInt32()
+	msg := &RowDescription{}
+	err = p.receive(msg)
+	return msg.Fields, err
+}
+
+func (p *ProtoStream) ReceiveSSLResponse() (ServerSSL, error) {
+	ssl, err := p.str.ReadByte()
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
-	var totRead int32 = 4
-	count, err := p.str.ReadInt16()
-	if err != nil {
-		return nil, err
+	p.traceReceived(0, []byte{ssl})
+	return ServerSSL(ssl), nil
+}
+
+// Upgrade the stream to TLS in place, acting as the client. This is
+// meant to be called after the server answers an SSLRequest with
+// SSLAccepted; the stream must be running over a net.Conn.
+func (p *ProtoStream) StartTLS(config *tls.Config) (*tls.Conn, error) {
+	conn, ok := p.str.ReadWriter().(net.Conn)
+	if !ok {
+		return nil, errors.New("post: TLS requires a stream over a net.Conn")
 	}
-	totRead += 2
-	descs = make([]FieldDescription, count)
-	for i := int16(0); i < count; i++ {
-		desc := &descs[i]
-		desc.Name, err = p.str.ReadCString()
-		if err != nil {
-			return nil, err
-		}
-		totRead += int32(len(desc.Name)) + 1
-		tableOid, err := p.str.ReadInt32()
-		if err != nil {
-			return nil, err
-		}
-		totRead += 4
-		desc.TableOid = Oid(tableOid)
-		desc.TableAttNo, err = p.str.ReadInt16()
-		if err != nil {
-			return nil, err
-		}
-		totRead += 2
-		typ, err := p.str.ReadInt32()
-		if err != nil {
-			return nil, err
-		}
-		totRead += 4
-		desc.TypeOid = Oid(typ)
-		desc.TypLen, err = p.str.ReadInt16()
-		if err != nil {
-			return nil, err
-		}
-		totRead += 2
-		desc.AttTypMod, err = p.str.ReadInt32()
-		if err != nil {
-			return nil, err
-		}
-		totRead += 4
-		format, err := p.str.ReadInt16()
-		if err != nil {
-			return nil, err
-		}
-		desc.Format = DataFormat(format)
-		totRead += 2
+	if p.str.Buffered() > 0 {
+		// anything the server sent along with its SSLRequest response
+		// was not encrypted and could have been injected
+		return nil, errors.New("post: received unencrypted data after SSLRequest response")
 	}
-	if size == totRead {
-		return descs, nil
-	} else {
-		return nil, fmt.Errorf("post: expected %v byte RowDescription; got %v",
-			size, totRead)
+	tlsConn := tls.Client(conn, config)
+	err := tlsConn.Handshake()
+	if err != nil {
+		return nil, err
 	}
+	return tlsConn, p.str.Reset(tlsConn)
 }
 
-func (p *ProtoStream) ReceiveSSLResponse() (ServerSSL, error) {
-	ssl, err := p.str.ReadByte()
-	return ServerSSL(ssl), err
+func (p *ProtoStream) receiveUnknown(msgType MessageType) (msg *UnknownMessage, err error) {
+	msg = &UnknownMessage{MsgType: msgType}
+	err = p.receive(msg)
+	if err != nil {
+		return nil, err
+	}
+	return msg, nil
 }
 
-func (p *ProtoStream) receiveEmpty(name string) error {
+// Read the length and body of the current message, trace it, and decode
+// the body into msg.
+func (p *ProtoStream) receive(msg decoder) error {
 	size, err := p.str.ReadInt32()
 	if err != nil {
 		return err
-	} else if size != 4 {
-		return fmt.Errorf("post: expected 4 byte %v; got %v", name, size)
-	} else {
-		return nil
 	}
-}
-
-func (p *ProtoStream) sendEmpty(code byte) (err error) {
-	_, err = p.str.WriteByte(code)
+	if size < 4 || size > maxMessageSize {
+		return fmt.Errorf("post: invalid message length %v", size)
+	}
+	body := make([]byte, size-4)
+	_, err = io.ReadFull(p.str, body)
 	if err != nil {
 		return err
 	}
-	_, err = p.str.WriteInt32(4) // message size
-	return err
+	p.traceReceived(p.next, body)
+	return msg.Decode(body)
 }
@@ -2,7 +2,10 @@ package post
 
 import (
 	"bytes"
+	"errors"
 	"io"
+	"net"
+	"reflect"
 	"testing"
 )
 
@@ -90,6 +93,60 @@ func newProtoStreamContent(content []byte) *ProtoStream {
 	return &ProtoStream{str: s}
 }
 
+func TestNewProtoStream(t *testing.T) {
+	var buf bytes.Buffer
+	s := NewProtoStream(NewStreamReadWriter(&buf))
+	err := s.SendSync()
+	if err != nil {
+		t.Errorf("want nil err; got %v", err)
+	}
+	err = s.Flush()
+	if err != nil {
+		t.Errorf("want nil err; got %v", err)
+	}
+	compareBytes(t, []byte{'S', 0x0, 0x0, 0x0, 0x4}, buf.Bytes())
+}
+
+func TestNewProtoStreamConn(t *testing.T) {
+	s := NewProtoStreamConn(newFakeConnBytes([]byte{'Z', 0x0, 0x0, 0x0, 0x5, 'I'}))
+	err := s.Expect('Z')
+	if err != nil {
+		t.Errorf("want nil err; got %v", err)
+	}
+	status, err := s.ReceiveReadyForQuery()
+	if err != nil {
+		t.Errorf("want nil err; got %v", err)
+	}
+	if status != Idle {
+		t.Errorf("want %v; got %v", Idle, status)
+	}
+}
+
+func TestNewProtoStreamReadWriter(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		defer server.Close()
+		// trickle the message out to exercise short reads
+		for _, b := range []byte{'K', 0x0, 0x0, 0x0, 0xc, 0x0, 0x0, 0x0, 0x7, 0x0, 0x0, 0x0, 0x9} {
+			server.Write([]byte{b})
+		}
+	}()
+	s := NewProtoStreamReadWriter(client)
+	err := s.Expect('K')
+	if err != nil {
+		t.Errorf("want nil err; got %v", err)
+	}
+	keyData, err := s.ReceiveBackendKeyData()
+	if err != nil {
+		t.Errorf("want nil err; got %v", err)
+	}
+	expected := &BackendKeyData{7, []byte{0, 0, 0, 9}}
+	if !reflect.DeepEqual(expected, keyData) {
+		t.Errorf("want %#v; got %#v", expected, keyData)
+	}
+}
+
 func TestExpectExpected(t *testing.T) {
 	defer func() {
 		if err := recover(); err != nil {
@@ -112,13 +169,54 @@ func TestExpectError(t *testing.T) {
 }
 
 func TestExpectUnexpected(t *testing.T) {
-	defer func() {
-		if err := recover(); err == nil {
-			t.Error("want panic; got nil")
-		}
-	}()
 	s := newProtoStreamContent([]byte{'x'})
-	s.Expect('y')
+	err := s.Expect('y')
+	unexpected, ok := err.(*UnexpectedMessageError)
+	if !ok {
+		t.Fatalf("want *UnexpectedMessageError; got %#v", err)
+	}
+	if unexpected.Expected != 'y' || unexpected.Actual != 'x' {
+		t.Errorf("want expected 'y', actual 'x'; got %q, %q",
+			unexpected.Expected, unexpected.Actual)
+	}
+	if unexpected.Err != nil {
+		t.Errorf("want nil server error; got %v", unexpected.Err)
+	}
+	if errors.Unwrap(err) != nil {
+		t.Errorf("want nil unwrapped error; got %v", errors.Unwrap(err))
+	}
+}
+
+func TestExpectUnexpectedErrorResponse(t *testing.T) {
+	s := newProtoStreamContent([]byte{'E',
+		0x0, 0x0, 0x0, 0xf, // length
+		byte(Code), '4', '0', 'P', '0', '1', 0x0,
+		byte(Message), 'x', 0x0,
+		0x0})
+	err := s.Expect('Z')
+	unexpected, ok := err.(*UnexpectedMessageError)
+	if !ok {
+		t.Fatalf("want *UnexpectedMessageError; got %#v", err)
+	}
+	if unexpected.Actual != 'E' {
+		t.Errorf("want actual 'E'; got %q", unexpected.Actual)
+	}
+	var pgErr *PgError
+	if !errors.As(err, &pgErr) {
+		t.Fatalf("want errors.As to find PgError in %v", err)
+	}
+	if pgErr.Code != "40P01" || pgErr.Message != "x" {
+		t.Errorf("want code 40P01 and message x; got %v", pgErr)
+	}
+}
+
+func TestExpectUnexpectedErrorResponseTruncated(t *testing.T) {
+	s := newProtoStreamContent([]byte{'E', 0x0, 0x0, 0x0, 0xf,
+		byte(Code), '4', '0'})
+	err := s.Expect('Z')
+	if _, ok := err.(*UnexpectedMessageError); ok || err == nil {
+		t.Errorf("want read error; got %#v", err)
+	}
 }
 
 func TextNext(t *testing.T) {
@@ -257,23 +355,31 @@ func TestSendBind(t *testing.T) {
 
 var cancelTests = []struct {
 	pid       int32
-	secretKey int32
+	secretKey []byte
 	msgBytes  []byte
 }{
-	{0x1, 0x2, []byte{
+	{0x1, []byte{0x0, 0x0, 0x0, 0x2}, []byte{
 		0x0, 0x0, 0x0, 0x10, // length
 		0x4, 0xd2, 0x16, 0x2e, // CancelRequest code
 		0x0, 0x0, 0x0, 0x1, // pid
 		0x0, 0x0, 0x0, 0x2, // secret key
 	},
 	},
-	{0xFFFF, 0x77777777, []byte{
+	{0xFFFF, []byte{0x77, 0x77, 0x77, 0x77}, []byte{
 		0x0, 0x0, 0x0, 0x10, // length
 		0x4, 0xd2, 0x16, 0x2e, // CancelRequest code
 		0x0, 0x0, 0xFF, 0xFF, // pid
 		0x77, 0x77, 0x77, 0x77, // secret key
 	},
 	},
+	// protocol 3.2 allows longer keys
+	{0x2, []byte{0x1, 0x2, 0x3, 0x4, 0x5, 0x6, 0x7, 0x8}, []byte{
+		0x0, 0x0, 0x0, 0x14, // length
+		0x4, 0xd2, 0x16, 0x2e, // CancelRequest code
+		0x0, 0x0, 0x0, 0x2, // pid
+		0x1, 0x2, 0x3, 0x4, 0x5, 0x6, 0x7, 0x8, // secret key
+	},
+	},
 }
 
 func TestSendCancelRequest(t *testing.T) {
@@ -296,10 +402,10 @@ var closeTests = []struct {
 	target   string
 	msgBytes []byte
 }{
-	{'C', "", []byte{0x0, 0x0, 0x0, 0x6, 'C', 0x0}},
-	{'C', "hello", []byte{0x0, 0x0, 0x0, 0xb, 'C', 'h', 'e', 'l', 'l', 'o', 0x0}},
-	{'P', "", []byte{0x0, 0x0, 0x0, 0x6, 'P', 0x0}},
-	{'P', "yo", []byte{0x0, 0x0, 0x0, 0x8, 'P', 'y', 'o', 0x0}},
+	{'C', "", []byte{'C', 0x0, 0x0, 0x0, 0x6, 'C', 0x0}},
+	{'C', "hello", []byte{'C', 0x0, 0x0, 0x0, 0xb, 'C', 'h', 'e', 'l', 'l', 'o', 0x0}},
+	{'P', "", []byte{'C', 0x0, 0x0, 0x0, 0x6, 'P', 0x0}},
+	{'P', "yo", []byte{'C', 0x0, 0x0, 0x0, 0x8, 'P', 'y', 'o', 0x0}},
 }
 
 func TestSendClose(t *testing.T) {
@@ -506,6 +612,58 @@ func TestSendPasswordMessage(t *testing.T) {
 	}
 }
 
+var saslInitialResponseTests = []struct {
+	mechanism string
+	data      []byte
+	msgBytes  []byte
+}{
+	{"PLAIN", nil, []byte{'p', 0x0, 0x0, 0x0, 0xe,
+		'P', 'L', 'A', 'I', 'N', 0x0,
+		0xff, 0xff, 0xff, 0xff}},
+	{"SCRAM-SHA-256", []byte("n,,n=,r=x"), []byte{'p', 0x0, 0x0, 0x0, 0x1f,
+		'S', 'C', 'R', 'A', 'M', '-', 'S', 'H', 'A', '-', '2', '5', '6', 0x0,
+		0x0, 0x0, 0x0, 0x9,
+		'n', ',', ',', 'n', '=', ',', 'r', '=', 'x'}},
+}
+
+func TestSendSASLInitialResponse(t *testing.T) {
+	for i, tt := range saslInitialResponseTests {
+		s, buf := newProtoStream()
+		err := s.SendSASLInitialResponse(tt.mechanism, tt.data)
+		if err != nil {
+			t.Errorf("%d: want nil err; got %v", i, err)
+		}
+		err = s.Flush()
+		if err != nil {
+			t.Errorf("%d: want nil err; got %v", i, err)
+		}
+		compareBytesN(i, t, tt.msgBytes, buf.Bytes())
+	}
+}
+
+var saslResponseTests = []struct {
+	data     []byte
+	msgBytes []byte
+}{
+	{[]byte{}, []byte{'p', 0x0, 0x0, 0x0, 0x4}},
+	{[]byte("c=biws"), []byte{'p', 0x0, 0x0, 0x0, 0xa, 'c', '=', 'b', 'i', 'w', 's'}},
+}
+
+func TestSendSASLResponse(t *testing.T) {
+	for i, tt := range saslResponseTests {
+		s, buf := newProtoStream()
+		err := s.SendSASLResponse(tt.data)
+		if err != nil {
+			t.Errorf("%d: want nil err; got %v", i, err)
+		}
+		err = s.Flush()
+		if err != nil {
+			t.Errorf("%d: want nil err; got %v", i, err)
+		}
+		compareBytesN(i, t, tt.msgBytes, buf.Bytes())
+	}
+}
+
 var queryTests = []struct {
 	query string
 	msgBytes []byte
@@ -585,8 +743,39 @@ func TestReceiveBackendKeyData(t *testing.T) {
 	if keyData.Pid != 0x102 {
 		t.Errorf("want pid 0x102; got %x", keyData.Pid)
 	}
-	if keyData.SecretKey != 0x03040506 {
-		t.Errorf("want secret 0x03040506; got %x", keyData.SecretKey)
+	if !bytes.Equal(keyData.SecretKey, []byte{0x3, 0x4, 0x5, 0x6}) {
+		t.Errorf("want secret 03040506; got %x", keyData.SecretKey)
+	}
+}
+
+func TestReceiveBackendKeyDataLength(t *testing.T) {
+	var keyLengthTests = []struct {
+		length int
+		valid  bool
+	}{
+		{0, false},
+		{3, false},
+		{4, true},
+		{32, true},
+		{256, true},
+		{257, false},
+	}
+	for i, tt := range keyLengthTests {
+		key := bytes.Repeat([]byte{0xAB}, tt.length)
+		msg := (&BackendKeyData{42, key}).Encode(nil)
+		s := newProtoStreamContent(msg[1:])
+		keyData, err := s.ReceiveBackendKeyData()
+		if !tt.valid {
+			if err == nil {
+				t.Errorf("%d: want err; got nil", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%d: want nil err; got %v", i, err)
+		} else if keyData.Pid != 42 || !bytes.Equal(key, keyData.SecretKey) {
+			t.Errorf("%d: want %#v; got %#v", i, &BackendKeyData{42, key}, keyData)
+		}
 	}
 }
 
@@ -607,7 +796,7 @@ func TestReceiveCloseComplete(t *testing.T) {
 }
 
 var commandCompleteTests = []struct {
-	tag      string
+	tag      CommandTag
 	msgBytes []byte
 }{
 	{"INSERT 1 0", []byte{0x0, 0x0, 0x0, 0xF, 'I', 'N', 'S', 'E', 'R', 'T', ' ', '1', ' ', '0', 0x0}},
@@ -797,7 +986,14 @@ func TestReceiveErrorResponse(t *testing.T) {
 	for i, tt := range errorResponseTests {
 		s := newProtoStreamContent(tt.msgBytes)
 		response, err := s.ReceiveErrorResponse()
-		validateErrOrNoticeRespone(i, t, err, response, tt.fields)
+		if err != nil {
+			t.Errorf("%d: want nil err; got %v", i, err)
+			continue
+		}
+		validateErrOrNoticeRespone(i, t, err, response.Fields, tt.fields)
+		if response.Message != tt.fields[Message] {
+			t.Errorf("%d: want message %v; got %v", i, tt.fields[Message], response.Message)
+		}
 	}
 }
 
@@ -806,7 +1002,22 @@ func TestReceiveNoticeResponse(t *testing.T) {
 	for i, tt := range errorResponseTests {
 		s := newProtoStreamContent(tt.msgBytes)
 		response, err := s.ReceiveNoticeResponse()
-		validateErrOrNoticeRespone(i, t, err, response, tt.fields)
+		if err != nil {
+			t.Errorf("%d: want nil err; got %v", i, err)
+			continue
+		}
+		validateErrOrNoticeRespone(i, t, err, response.Fields, tt.fields)
+	}
+}
+
+func TestReceiveErrorResponseTruncated(t *testing.T) {
+	s := newProtoStreamContent([]byte{
+		0x0, 0x0, 0x0, 0xC, // length
+		byte(Message), 'h', 'e', 'l', 'l', 'o', 0x0, // field 1
+	})
+	_, err := s.ReceiveErrorResponse()
+	if err == nil {
+		t.Error("want error; got nil")
 	}
 }
 
@@ -1057,3 +1268,94 @@ func TestReceiveSSLResponse(t *testing.T) {
 		}
 	}
 }
+
+var receiveMessageTests = []struct {
+	msgBytes []byte
+	msg      BackendMessage
+}{
+	{[]byte{'R', 0x0, 0x0, 0x0, 0x8, 0x0, 0x0, 0x0, 0x0},
+		&AuthResponse{AuthenticationOk, nil}},
+	{[]byte{'K', 0x0, 0x0, 0x0, 0xc, 0x0, 0x0, 0x0, 0x1, 0x0, 0x0, 0x0, 0x2},
+		&BackendKeyData{1, []byte{0, 0, 0, 2}}},
+	{[]byte{'2', 0x0, 0x0, 0x0, 0x4}, &BindComplete{}},
+	{[]byte{'3', 0x0, 0x0, 0x0, 0x4}, &CloseComplete{}},
+	{[]byte{'C', 0x0, 0x0, 0x0, 0xd, 'S', 'E', 'L', 'E', 'C', 'T', ' ', '1', 0x0},
+		&CommandComplete{"SELECT 1"}},
+	{[]byte{'d', 0x0, 0x0, 0x0, 0x6, 'h', 'i'}, &CopyData{[]byte("hi")}},
+	{[]byte{'c', 0x0, 0x0, 0x0, 0x4}, &CopyDone{}},
+	{[]byte{'G', 0x0, 0x0, 0x0, 0x9, 0x0, 0x0, 0x1, 0x0, 0x0},
+		&CopyInResponse{CopyText, []DataFormat{TextFormat}}},
+	{[]byte{'H', 0x0, 0x0, 0x0, 0x7, 0x1, 0x0, 0x0},
+		&CopyOutResponse{CopyBinary, []DataFormat{}}},
+	{[]byte{'W', 0x0, 0x0, 0x0, 0x9, 0x1, 0x0, 0x1, 0x0, 0x1},
+		&CopyBothResponse{CopyBinary, []DataFormat{BinaryFormat}}},
+	{[]byte{'D', 0x0, 0x0, 0x0, 0xf, 0x0, 0x2,
+		0x0, 0x0, 0x0, 0x1, 'x',
+		0xff, 0xff, 0xff, 0xff},
+		&DataRow{[][]byte{[]byte("x"), nil}}},
+	{[]byte{'I', 0x0, 0x0, 0x0, 0x4}, &EmptyQueryResponse{}},
+	{[]byte{'E', 0x0, 0x0, 0x0, 0x8, byte(Message), 'x', 0x0, 0x0},
+		NewPgError(map[ErrorField]string{Message: "x"})},
+	{[]byte{'n', 0x0, 0x0, 0x0, 0x4}, &NoData{}},
+	{[]byte{'N', 0x0, 0x0, 0x0, 0x8, byte(Message), 'x', 0x0, 0x0},
+		(*Notice)(NewPgError(map[ErrorField]string{Message: "x"}))},
+	{[]byte{'A', 0x0, 0x0, 0x0, 0xc, 0x0, 0x0, 0x0, 0x7, 'c', 0x0, 'p', 0x0},
+		&Notification{7, "c", "p"}},
+	{[]byte{'t', 0x0, 0x0, 0x0, 0xa, 0x0, 0x1, 0x0, 0x0, 0x0, 0x17},
+		&ParameterDescription{[]Oid{23}}},
+	{[]byte{'S', 0x0, 0x0, 0x0, 0x8, 'a', 0x0, 'b', 0x0},
+		&ParameterStatus{"a", "b"}},
+	{[]byte{'1', 0x0, 0x0, 0x0, 0x4}, &ParseComplete{}},
+	{[]byte{'s', 0x0, 0x0, 0x0, 0x4}, &PortalSuspended{}},
+	{[]byte{'Z', 0x0, 0x0, 0x0, 0x5, 'T'}, &ReadyForQuery{InTransaction}},
+	{[]byte{'T', 0x0, 0x0, 0x0, 0x1a, 0x0, 0x1,
+		'x', 0x0,
+		0x0, 0x0, 0x0, 0x0, // table oid
+		0x0, 0x0, // attribute number
+		0x0, 0x0, 0x0, 0x17, // type oid
+		0x0, 0x4, // type length
+		0xff, 0xff, 0xff, 0xff, // type modifier
+		0x0, 0x0}, // format
+		&RowDescription{[]FieldDescription{{"x", 0, 0, 23, 4, -1, TextFormat}}}},
+	{[]byte{'V', 0x0, 0x0, 0x0, 0xa, 0x0, 0x0, 0x0, 0x2, 0x1, 0x2},
+		&FunctionCallResponse{[]byte{0x1, 0x2}}},
+	{[]byte{'V', 0x0, 0x0, 0x0, 0x8, 0xff, 0xff, 0xff, 0xff}, &FunctionCallResponse{}},
+	{[]byte{'?', 0x0, 0x0, 0x0, 0x6, 0x1, 0x2},
+		&UnknownMessage{'?', []byte{0x1, 0x2}}},
+}
+
+func TestReceiveMessage(t *testing.T) {
+	for i, tt := range receiveMessageTests {
+		s := newProtoStreamContent(tt.msgBytes)
+		msg, err := s.ReceiveMessage()
+		if err != nil {
+			t.Errorf("%d: want nil err; got %v", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(tt.msg, msg) {
+			t.Errorf("%d: want %#v; got %#v", i, tt.msg, msg)
+		}
+		if msg.Type() != MessageType(tt.msgBytes[0]) {
+			t.Errorf("%d: want type %q; got %q", i, tt.msgBytes[0], byte(msg.Type()))
+		}
+	}
+}
+
+func TestReceiveMessageError(t *testing.T) {
+	s := newProtoStreamContent([]byte{'Z', 0x0, 0x0, 0x0, 0x6, 'I'})
+	msg, err := s.ReceiveMessage()
+	if err == nil {
+		t.Error("want error; got nil")
+	}
+	if msg != nil {
+		t.Errorf("want nil message; got %#v", msg)
+	}
+}
+
+func TestReceiveCopyDone(t *testing.T) {
+	s := newProtoStreamContent([]byte{0x0, 0x0, 0x0, 0x4})
+	err := s.ReceiveCopyDone()
+	if err != nil {
+		t.Errorf("want nil err; got %v", err)
+	}
+}
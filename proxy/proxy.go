@@ -0,0 +1,592 @@
+// Package proxy implements a protocol-aware proxy that sits between
+// clients and a server, passing every message through hooks that can
+// log, rewrite, or reject it.
+//
+// A hook is any value implementing one or more of the hook interfaces
+// below. Hooks may modify the message they are given in place; the
+// modified message is what gets forwarded. Frontend hooks run on the
+// goroutine reading from the client and backend hooks on the one
+// reading from the server, so the two kinds may run concurrently.
+//
+// If a frontend hook returns a *post.PgError, the message is not
+// forwarded, and the client receives the error as if the server had
+// reported it. In the extended query protocol, the rest of the messages
+// up to the next Sync are discarded as well, just as the server would
+// after an error. Any other error from a hook ends the session.
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/msakrejda/post"
+	"github.com/msakrejda/post/internal/netutil"
+	"github.com/msakrejda/post/sqlstate"
+)
+
+// A Hook is a value implementing any of the hook interfaces.
+type Hook interface{}
+
+// A FrontendHook sees every message from the client after startup.
+type FrontendHook interface {
+	OnFrontendMessage(s *Session, msg post.FrontendMessage) error
+}
+
+// A BackendHook sees every message from the server.
+type BackendHook interface {
+	OnBackendMessage(s *Session, msg post.BackendMessage) error
+}
+
+// A QueryHook sees simple-protocol queries.
+type QueryHook interface {
+	OnQuery(s *Session, msg *post.Query) error
+}
+
+// A ParseHook sees the queries of extended-protocol Parse messages.
+type ParseHook interface {
+	OnParse(s *Session, msg *post.Parse) error
+}
+
+// A DataRowHook sees every row sent by the server.
+type DataRowHook interface {
+	OnDataRow(s *Session, msg *post.DataRow) error
+}
+
+// An ErrorResponseHook sees every error sent by the server.
+type ErrorResponseHook interface {
+	OnErrorResponse(s *Session, msg *post.PgError) error
+}
+
+// A Session is a single client connection and the server connection
+// serving it.
+type Session struct {
+	// The connections as accepted and dialed, underneath any TLS.
+	Client net.Conn
+	Server net.Conn
+	// The parameters of the client's StartupMessage, e.g., "user" and
+	// "database".
+	Parameters map[string]string
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// Record the server connection, unless the session is already closed.
+func (s *Session) setServer(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		conn.Close()
+		return false
+	}
+	s.Server = conn
+	return true
+}
+
+func (s *Session) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	s.Client.Close()
+	if s.Server != nil {
+		s.Server.Close()
+	}
+}
+
+// A Proxy accepts client connections and relays them to a server.
+type Proxy struct {
+	// Dial opens a connection to the server.
+	Dial func(ctx context.Context) (net.Conn, error)
+	// TLSConfig, if set, is used to accept TLS from clients, with an
+	// SSLRequest or directly. Otherwise, clients are refused TLS.
+	TLSConfig *tls.Config
+	// ServerTLSConfig, if set, is used to start TLS with the server.
+	//
+	// SCRAM authentication cannot be relayed for clients that also use
+	// TLS: they see no channel binding offered, since it cannot reach
+	// through the proxy, and tell the server so, which the server then
+	// takes for a downgrade attack. Such sessions end with an error as
+	// soon as the server asks for SASL.
+	ServerTLSConfig *tls.Config
+	// The hooks to run, in order.
+	Hooks []Hook
+	// ErrorLog, if set, is called with any error ending a session
+	// served by Serve.
+	ErrorLog func(err error)
+}
+
+// Accept connections from listener and serve each in its own goroutine
+// until the listener fails or ctx is done.
+func (p *Proxy) Serve(ctx context.Context, listener net.Listener) error {
+	stop := netutil.CloseWhenDone(ctx, listener)
+	defer stop()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		go func() {
+			err := p.ServeConn(ctx, conn)
+			if err != nil && p.ErrorLog != nil {
+				p.ErrorLog(err)
+			}
+		}()
+	}
+}
+
+// Serve a single client connection until either side closes it or ctx
+// is done. The connection is closed on return.
+func (p *Proxy) ServeConn(ctx context.Context, conn net.Conn) (err error) {
+	sess := &Session{Client: conn}
+	defer sess.close()
+	stop := netutil.CloseWhenDone(ctx, closerFunc(sess.close))
+	defer stop()
+
+	client, first, clientTLS, err := p.acceptClient(conn)
+	if err != nil {
+		return err
+	}
+	switch msg := first.(type) {
+	case *post.CancelRequest:
+		return p.forwardCancel(ctx, msg)
+	case *post.StartupMessage:
+		sess.Parameters = msg.Parameters
+	}
+
+	serverConn, err := p.Dial(ctx)
+	if err != nil {
+		return err
+	}
+	if !sess.setServer(serverConn) {
+		return ctx.Err()
+	}
+	server, err := p.connectServer(serverConn)
+	if err != nil {
+		return err
+	}
+	err = server.Send(first)
+	if err == nil {
+		err = server.Flush()
+	}
+	if err != nil {
+		return err
+	}
+
+	pump := &pump{
+		proxy:     p,
+		sess:      sess,
+		client:    client,
+		server:    server,
+		clientTLS: clientTLS,
+		// the server ends startup with a ReadyForQuery
+		pending: []*post.PgError{nil},
+	}
+	return pump.run(sess)
+}
+
+// Handle the client's startup-phase requests, starting TLS if asked,
+// until it sends a StartupMessage or CancelRequest. Also report whether
+// the client uses TLS.
+func (p *Proxy) acceptClient(conn net.Conn) (*post.ProtoStream, post.FrontendMessage, bool, error) {
+	// read a single byte, so nothing sent after it is buffered where TLS
+	// could not see it
+	var first [1]byte
+	_, err := io.ReadFull(conn, first[:])
+	if err != nil {
+		return nil, nil, false, err
+	}
+	conn = &prefixConn{conn, first[:]}
+	encrypted := false
+	if first[0] == netutil.TLSHandshake {
+		conn, err = p.acceptDirectTLS(conn)
+		if err != nil {
+			return nil, nil, false, err
+		}
+		encrypted = true
+	}
+	proto := post.NewProtoStreamConn(conn)
+	for {
+		msg, err := proto.ReceiveStartupMessage()
+		if err != nil {
+			return nil, nil, false, err
+		}
+		switch msg.(type) {
+		case *post.SSLRequest:
+			if p.TLSConfig == nil || encrypted {
+				err = rejectEncryption(proto)
+				break
+			}
+			err = proto.SendSSLResponse(post.SSLAccepted)
+			if err == nil {
+				err = proto.Flush()
+			}
+			if err == nil {
+				_, err = proto.AcceptTLS(p.TLSConfig)
+			}
+			encrypted = true
+		case *post.GSSENCRequest:
+			err = rejectEncryption(proto)
+		default:
+			return proto, msg, encrypted, nil
+		}
+		if err != nil {
+			return nil, nil, false, err
+		}
+	}
+}
+
+func rejectEncryption(proto *post.ProtoStream) error {
+	err := proto.SendSSLResponse(post.SSLRejected)
+	if err != nil {
+		return err
+	}
+	return proto.Flush()
+}
+
+// Accept a TLS connection started without an SSLRequest. As with the
+// server, the client must ask for the "postgresql" ALPN protocol.
+func (p *Proxy) acceptDirectTLS(conn net.Conn) (net.Conn, error) {
+	if p.TLSConfig == nil {
+		return nil, errors.New("proxy: client started direct TLS, but TLS is not configured")
+	}
+	config := p.TLSConfig.Clone()
+	config.NextProtos = []string{"postgresql"}
+	tlsConn := tls.Server(conn, config)
+	err := tlsConn.Handshake()
+	if err != nil {
+		return nil, err
+	}
+	if tlsConn.ConnectionState().NegotiatedProtocol != "postgresql" {
+		return nil, errors.New("proxy: client did not request ALPN protocol \"postgresql\" for direct TLS")
+	}
+	return tlsConn, nil
+}
+
+// Start the protocol with the server, negotiating TLS if configured.
+func (p *Proxy) connectServer(conn net.Conn) (*post.ProtoStream, error) {
+	proto := post.NewProtoStreamConn(conn)
+	if p.ServerTLSConfig == nil {
+		return proto, nil
+	}
+	err := proto.SendSSLRequest()
+	if err == nil {
+		err = proto.Flush()
+	}
+	if err != nil {
+		return nil, err
+	}
+	resp, err := proto.ReceiveSSLResponse()
+	if err != nil {
+		return nil, err
+	}
+	if resp != post.SSLAccepted {
+		return nil, fmt.Errorf("proxy: server refused TLS (%q)", byte(resp))
+	}
+	_, err = proto.StartTLS(p.ServerTLSConfig)
+	if err != nil {
+		return nil, err
+	}
+	return proto, nil
+}
+
+// Pass a CancelRequest on to the server over a connection of its own.
+// The client learned the key from the server through the proxy, so the
+// request needs no translation.
+func (p *Proxy) forwardCancel(ctx context.Context, msg *post.CancelRequest) error {
+	conn, err := p.Dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	proto, err := p.connectServer(conn)
+	if err != nil {
+		return err
+	}
+	err = proto.Send(msg)
+	if err != nil {
+		return err
+	}
+	return proto.Flush()
+}
+
+// The two directions of a session in progress.
+type pump struct {
+	proxy  *Proxy
+	sess   *Session
+	client *post.ProtoStream
+	server *post.ProtoStream
+	// whether the client connection uses TLS
+	clientTLS bool
+
+	mu sync.Mutex
+	// One entry for each ReadyForQuery the server is expected to send,
+	// holding the error to report to the client before it, if any.
+	pending []*post.PgError
+}
+
+func (p *pump) run(sess *Session) error {
+	errc := make(chan error, 2)
+	go func() { errc <- p.frontend() }()
+	go func() { errc <- p.backend() }()
+	// a nil error means the client sent Terminate; give the server a
+	// chance to finish up before closing
+	err := <-errc
+	if err == nil {
+		err = <-errc
+		sess.close()
+	} else {
+		sess.close()
+		// one side hanging up may be the result of the other failing,
+		// e.g., the client leaving after an authentication error
+		if other := <-errc; hungUp(err) && other != nil && !hungUp(other) {
+			err = other
+		}
+	}
+	if hungUp(err) {
+		return nil
+	}
+	return err
+}
+
+// Report whether err is just the connection being closed.
+func hungUp(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) ||
+		errors.Is(err, io.ErrClosedPipe)
+}
+
+// Expect a ReadyForQuery, to be preceded by pgErr if it is not nil.
+func (p *pump) expect(pgErr *post.PgError) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pending = append(p.pending, pgErr)
+}
+
+func (p *pump) nextPending() *post.PgError {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.pending) == 0 {
+		return nil
+	}
+	pgErr := p.pending[0]
+	p.pending = p.pending[1:]
+	return pgErr
+}
+
+// Relay messages from the client to the server.
+func (p *pump) frontend() (err error) {
+	// the error rejecting an extended-protocol message, while skipping
+	// to the next Sync
+	var rejected *post.PgError
+	for {
+		msg, err := p.client.ReceiveFrontendMessage()
+		if err != nil {
+			return err
+		}
+		_, terminate := msg.(*post.Terminate)
+		_, isSync := msg.(*post.Sync)
+		switch {
+		case terminate:
+			err = p.server.Send(msg)
+		case rejected != nil && !isSync:
+			continue
+		case rejected != nil:
+			p.expect(rejected)
+			rejected = nil
+			err = p.server.Send(msg)
+		default:
+			err = p.proxy.runFrontendHooks(p.sess, msg)
+			pgErr, isPgErr := err.(*post.PgError)
+			switch {
+			case isPgErr && pgErr != nil:
+				switch msg.(type) {
+				case *post.Query, *post.Sync:
+				default:
+					rejected = pgErr
+					continue
+				}
+				// the server answers a Sync with a ReadyForQuery, which
+				// the error can go in front of
+				p.expect(pgErr)
+				err = p.server.Send(&post.Sync{})
+			case err != nil:
+				return err
+			default:
+				if readyForQueryAfter(msg) {
+					p.expect(nil)
+				}
+				err = p.server.Send(msg)
+			}
+		}
+		if err == nil && (terminate || p.client.Buffered() == 0) {
+			err = p.server.Flush()
+		}
+		if err != nil || terminate {
+			return err
+		}
+	}
+}
+
+// Whether the server ends its response to msg with a ReadyForQuery.
+func readyForQueryAfter(msg post.FrontendMessage) bool {
+	switch msg.(type) {
+	case *post.Query, *post.Sync, *post.FunctionCall:
+		return true
+	default:
+		return false
+	}
+}
+
+// Relay messages from the server to the client.
+func (p *pump) backend() (err error) {
+	for {
+		msg, err := p.server.ReceiveMessage()
+		if err != nil {
+			return err
+		}
+		if auth, ok := msg.(*post.AuthResponse); ok && auth.Subtype == post.AuthenticationSASL {
+			if p.clientTLS && p.proxy.ServerTLSConfig != nil {
+				return p.refuseSASL()
+			}
+			auth.Payload = withoutChannelBinding(auth.Payload)
+		}
+		err = p.proxy.runBackendHooks(p.sess, msg)
+		if err != nil {
+			return err
+		}
+		if _, ok := msg.(*post.ReadyForQuery); ok {
+			if pgErr := p.nextPending(); pgErr != nil {
+				err = p.client.Send(pgErr)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		encoder, ok := msg.(post.Encoder)
+		if !ok {
+			return fmt.Errorf("proxy: cannot encode %T", msg)
+		}
+		err = p.client.Send(encoder)
+		if err == nil && p.server.Buffered() == 0 {
+			err = p.client.Flush()
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+var errSASLOverTLS = errors.New("proxy: cannot relay SCRAM authentication with TLS to both client and server")
+
+// Tell the client SCRAM cannot work through the proxy, and end the
+// session; see Proxy.ServerTLSConfig.
+func (p *pump) refuseSASL() error {
+	err := p.client.Send(&post.PgError{
+		Severity: "FATAL",
+		Code:     sqlstate.InvalidAuthorizationSpecification,
+		Message:  errSASLOverTLS.Error(),
+	})
+	if err == nil {
+		err = p.client.Flush()
+	}
+	if err != nil {
+		return err
+	}
+	return errSASLOverTLS
+}
+
+// Remove the channel binding SASL mechanisms from those offered by the
+// server: the client's TLS session ends at the proxy, so binding to it
+// could never succeed.
+func withoutChannelBinding(payload []byte) []byte {
+	var result []byte
+	for _, mechanism := range bytes.Split(payload, []byte{0}) {
+		if len(mechanism) == 0 || strings.HasSuffix(string(mechanism), "-PLUS") {
+			continue
+		}
+		result = append(result, mechanism...)
+		result = append(result, 0)
+	}
+	return append(result, 0)
+}
+
+func (p *Proxy) runFrontendHooks(s *Session, msg post.FrontendMessage) (err error) {
+	for _, hook := range p.Hooks {
+		if h, ok := hook.(FrontendHook); ok {
+			err = h.OnFrontendMessage(s, msg)
+			if err != nil {
+				return err
+			}
+		}
+		switch msg := msg.(type) {
+		case *post.Query:
+			if h, ok := hook.(QueryHook); ok {
+				err = h.OnQuery(s, msg)
+			}
+		case *post.Parse:
+			if h, ok := hook.(ParseHook); ok {
+				err = h.OnParse(s, msg)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *Proxy) runBackendHooks(s *Session, msg post.BackendMessage) (err error) {
+	for _, hook := range p.Hooks {
+		if h, ok := hook.(BackendHook); ok {
+			err = h.OnBackendMessage(s, msg)
+			if err != nil {
+				return err
+			}
+		}
+		switch msg := msg.(type) {
+		case *post.DataRow:
+			if h, ok := hook.(DataRowHook); ok {
+				err = h.OnDataRow(s, msg)
+			}
+		case *post.PgError:
+			if h, ok := hook.(ErrorResponseHook); ok {
+				err = h.OnErrorResponse(s, msg)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// A net.Conn that returns the given prefix before reading any more.
+type prefixConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func (c *prefixConn) Read(b []byte) (int, error) {
+	if len(c.prefix) > 0 {
+		n := copy(b, c.prefix)
+		c.prefix = c.prefix[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+type closerFunc func()
+
+func (f closerFunc) Close() error {
+	f()
+	return nil
+}
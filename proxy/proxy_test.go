@@ -0,0 +1,397 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/msakrejda/post"
+	"github.com/msakrejda/post/internal/testcert"
+	"github.com/msakrejda/post/posttest"
+)
+
+// Connect a client through a proxy in front of a posttest server.
+func connect(t *testing.T, p *Proxy, config post.Config) *post.Conn {
+	ctx := context.Background()
+	config.Dial = func(ctx context.Context, _, _ string) (net.Conn, error) {
+		client, server := net.Pipe()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			err := p.ServeConn(ctx, server)
+			if err != nil {
+				t.Errorf("want nil err from proxy; got %v", err)
+			}
+		}()
+		t.Cleanup(func() { <-done })
+		return client, nil
+	}
+	conn, err := post.Connect(ctx, config)
+	if err != nil {
+		t.Fatalf("want nil err; got %v", err)
+	}
+	return conn
+}
+
+func newProxy(s *posttest.Server, hooks ...Hook) *Proxy {
+	return &Proxy{
+		Dial: func(ctx context.Context) (net.Conn, error) {
+			return s.Pipe(), nil
+		},
+		Hooks: hooks,
+	}
+}
+
+// Send messages and collect everything the server sends back up to
+// ReadyForQuery.
+func roundTrip(t *testing.T, conn *post.Conn, msgs ...post.FrontendMessage) []post.BackendMessage {
+	p := conn.ProtoStream()
+	for _, msg := range msgs {
+		err := p.Send(msg)
+		if err != nil {
+			t.Fatalf("want nil err; got %v", err)
+		}
+	}
+	err := p.Flush()
+	if err != nil {
+		t.Fatalf("want nil err; got %v", err)
+	}
+	var result []post.BackendMessage
+	for {
+		msg, err := p.ReceiveMessage()
+		if err != nil {
+			t.Fatalf("want nil err; got %v", err)
+		}
+		result = append(result, msg)
+		if _, ok := msg.(*post.ReadyForQuery); ok {
+			return result
+		}
+	}
+}
+
+func messageTypes(msgs []post.BackendMessage) string {
+	var types []byte
+	for _, msg := range msgs {
+		types = append(types, byte(msg.Type()))
+	}
+	return string(types)
+}
+
+type rewriteHook struct{}
+
+func (rewriteHook) OnQuery(s *Session, msg *post.Query) error {
+	msg.Query = strings.Replace(msg.Query, "secrets", "public_secrets", 1)
+	return nil
+}
+
+func (rewriteHook) OnDataRow(s *Session, msg *post.DataRow) error {
+	for i := range msg.Values {
+		if msg.Values[i] != nil {
+			msg.Values[i] = bytes.ToUpper(msg.Values[i])
+		}
+	}
+	return nil
+}
+
+type blockHook struct{}
+
+func (blockHook) OnQuery(s *Session, msg *post.Query) error {
+	return block(msg.Query)
+}
+
+func (blockHook) OnParse(s *Session, msg *post.Parse) error {
+	return block(msg.Query)
+}
+
+func block(query string) error {
+	if strings.HasPrefix(query, "drop") {
+		return &post.PgError{Severity: "ERROR", Code: "42501", Message: "blocked"}
+	}
+	return nil
+}
+
+type errorHook struct {
+	codes []string
+}
+
+func (h *errorHook) OnErrorResponse(s *Session, msg *post.PgError) error {
+	h.codes = append(h.codes, msg.Code)
+	return nil
+}
+
+func TestProxyRewrite(t *testing.T) {
+	s := posttest.NewServer(t)
+	s.OnQuery("select * from public_secrets").Columns("name").Row("alice").Row(nil)
+	conn := connect(t, newProxy(s, rewriteHook{}), s.Config())
+	defer conn.Close()
+
+	msgs := roundTrip(t, conn, &post.Query{Query: "select * from secrets"})
+	if types := messageTypes(msgs); types != "TDDCZ" {
+		t.Fatalf("want TDDCZ; got %v", types)
+	}
+	row := msgs[1].(*post.DataRow)
+	if string(row.Values[0]) != "ALICE" {
+		t.Errorf("want ALICE; got %s", row.Values[0])
+	}
+	row = msgs[2].(*post.DataRow)
+	if row.Values[0] != nil {
+		t.Errorf("want NULL; got %s", row.Values[0])
+	}
+}
+
+func TestProxyBlockQuery(t *testing.T) {
+	s := posttest.NewServer(t)
+	s.OnQuery("select 1").Columns("?column?").Row(1)
+	errHook := &errorHook{}
+	conn := connect(t, newProxy(s, blockHook{}, errHook), s.Config())
+	defer conn.Close()
+
+	msgs := roundTrip(t, conn, &post.Query{Query: "drop table users"})
+	if types := messageTypes(msgs); types != "EZ" {
+		t.Fatalf("want EZ; got %v", types)
+	}
+	if pgErr := msgs[0].(*post.PgError); pgErr.Message != "blocked" {
+		t.Errorf("want blocked; got %v", pgErr.Message)
+	}
+	// the session carries on as normal
+	msgs = roundTrip(t, conn, &post.Query{Query: "select 1"})
+	if types := messageTypes(msgs); types != "TDCZ" {
+		t.Errorf("want TDCZ; got %v", types)
+	}
+	// errors made up by the proxy never came from the server
+	if len(errHook.codes) != 0 {
+		t.Errorf("want no server errors; got %v", errHook.codes)
+	}
+}
+
+func TestProxyBlockParse(t *testing.T) {
+	s := posttest.NewServer(t)
+	conn := connect(t, newProxy(s, blockHook{}), s.Config())
+	defer conn.Close()
+
+	msgs := roundTrip(t, conn,
+		&post.Parse{Query: "drop table users"},
+		&post.Bind{},
+		&post.Execute{},
+		&post.Sync{},
+	)
+	if types := messageTypes(msgs); types != "EZ" {
+		t.Fatalf("want EZ; got %v", types)
+	}
+}
+
+type syncHook struct{}
+
+func (syncHook) OnFrontendMessage(s *Session, msg post.FrontendMessage) error {
+	if _, ok := msg.(*post.Sync); ok {
+		return &post.PgError{Severity: "ERROR", Code: "42501", Message: "blocked"}
+	}
+	return nil
+}
+
+func TestProxyBlockSync(t *testing.T) {
+	p := &Proxy{
+		Dial: func(ctx context.Context) (net.Conn, error) {
+			client, server := net.Pipe()
+			go func() {
+				defer server.Close()
+				proto := post.NewProtoStreamConn(server)
+				proto.ReceiveStartupMessage()
+				proto.SendAuthResponse(post.AuthenticationOk, nil)
+				proto.SendReadyForQuery(post.Idle)
+				proto.Flush()
+				// the Sync is still sent, so the server's answer
+				// carries the error
+				msg, err := proto.ReceiveFrontendMessage()
+				if _, ok := msg.(*post.Sync); !ok {
+					t.Errorf("want Sync; got %#v, %v", msg, err)
+				}
+				proto.SendReadyForQuery(post.Idle)
+				proto.Flush()
+				proto.ReceiveFrontendMessage()
+			}()
+			return client, nil
+		},
+		Hooks: []Hook{syncHook{}},
+	}
+	conn := connect(t, p, post.Config{User: "bob", SSLMode: post.SSLModeDisable})
+	defer conn.Close()
+
+	msgs := roundTrip(t, conn, &post.Sync{})
+	if types := messageTypes(msgs); types != "EZ" {
+		t.Fatalf("want EZ; got %v", types)
+	}
+}
+
+func TestProxyServerError(t *testing.T) {
+	s := posttest.NewServer(t)
+	s.OnQuery("select x").Error(&post.PgError{Severity: "ERROR", Code: "42703",
+		Message: "column \"x\" does not exist"})
+	errHook := &errorHook{}
+	conn := connect(t, newProxy(s, errHook), s.Config())
+	defer conn.Close()
+
+	msgs := roundTrip(t, conn, &post.Query{Query: "select x"})
+	if types := messageTypes(msgs); types != "EZ" {
+		t.Fatalf("want EZ; got %v", types)
+	}
+	if len(errHook.codes) != 1 || errHook.codes[0] != "42703" {
+		t.Errorf("want [42703]; got %v", errHook.codes)
+	}
+}
+
+func TestProxyCancel(t *testing.T) {
+	received := make(chan post.FrontendMessage, 1)
+	p := &Proxy{
+		Dial: func(ctx context.Context) (net.Conn, error) {
+			client, server := net.Pipe()
+			go func() {
+				defer server.Close()
+				msg, err := post.NewProtoStreamConn(server).ReceiveStartupMessage()
+				if err != nil {
+					t.Errorf("want nil err; got %v", err)
+				}
+				received <- msg
+			}()
+			return client, nil
+		},
+	}
+	client, server := net.Pipe()
+	go func() {
+		proto := post.NewProtoStreamConn(client)
+		proto.SendCancelRequest(42, []byte{1, 2, 3, 4})
+		proto.Flush()
+	}()
+	err := p.ServeConn(context.Background(), server)
+	if err != nil {
+		t.Errorf("want nil err; got %v", err)
+	}
+	select {
+	case msg := <-received:
+		cancel, ok := msg.(*post.CancelRequest)
+		if !ok || cancel.Pid != 42 || !bytes.Equal(cancel.SecretKey, []byte{1, 2, 3, 4}) {
+			t.Errorf("want CancelRequest{42, 1234}; got %#v", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("want CancelRequest; got nothing")
+	}
+}
+
+func TestProxyTLS(t *testing.T) {
+	cert, clientTLS := testcert.New(t)
+	var tlsTests = []struct {
+		mode        post.SSLMode
+		negotiation post.SSLNegotiation
+	}{
+		{post.SSLModeVerifyFull, post.SSLNegotiationPostgres},
+		{post.SSLModeVerifyFull, post.SSLNegotiationDirect},
+	}
+	for i, tt := range tlsTests {
+		s := posttest.NewServer(t)
+		s.OnQuery("select 1")
+		p := newProxy(s)
+		p.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+		config := s.Config()
+		config.SSLMode = tt.mode
+		config.SSLNegotiation = tt.negotiation
+		config.TLSConfig = clientTLS
+		conn := connect(t, p, config)
+		msgs := roundTrip(t, conn, &post.Query{Query: "select 1"})
+		if types := messageTypes(msgs); types != "CZ" {
+			t.Errorf("%d: want CZ; got %v", i, types)
+		}
+		conn.Close()
+	}
+}
+
+func TestProxyTLSSASL(t *testing.T) {
+	cert, clientTLS := testcert.New(t)
+	serverTLS := &tls.Config{Certificates: []tls.Certificate{cert}}
+	p := &Proxy{
+		Dial: func(ctx context.Context) (net.Conn, error) {
+			client, server := net.Pipe()
+			go func() {
+				defer server.Close()
+				proto := post.NewProtoStreamConn(server)
+				proto.ReceiveStartupMessage()
+				proto.SendSSLResponse(post.SSLAccepted)
+				proto.Flush()
+				_, err := proto.AcceptTLS(serverTLS)
+				if err != nil {
+					t.Errorf("want nil err; got %v", err)
+					return
+				}
+				proto.ReceiveStartupMessage()
+				proto.SendAuthResponse(post.AuthenticationSASL,
+					[]byte("SCRAM-SHA-256-PLUS\x00SCRAM-SHA-256\x00\x00"))
+				proto.Flush()
+				proto.ReceiveFrontendMessage()
+			}()
+			return client, nil
+		},
+		TLSConfig:       serverTLS,
+		ServerTLSConfig: clientTLS.Clone(),
+	}
+	p.ServerTLSConfig.ServerName = "localhost"
+	errc := make(chan error, 1)
+	config := post.Config{
+		User:      "bob",
+		Password:  "secret",
+		SSLMode:   post.SSLModeVerifyFull,
+		TLSConfig: clientTLS,
+		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			client, server := net.Pipe()
+			go func() { errc <- p.ServeConn(ctx, server) }()
+			return client, nil
+		},
+	}
+	_, err := post.Connect(context.Background(), config)
+	if pgErr, ok := err.(*post.PgError); !ok || pgErr.Code != "28000" {
+		t.Errorf("want 28000 error; got %v", err)
+	}
+	if err := <-errc; err != errSASLOverTLS {
+		t.Errorf("want %v; got %v", errSASLOverTLS, err)
+	}
+}
+
+func TestProxyHookError(t *testing.T) {
+	s := posttest.NewServer(t)
+	p := newProxy(s, failHook{})
+	client, server := net.Pipe()
+	done := make(chan error, 1)
+	go func() { done <- p.ServeConn(context.Background(), server) }()
+	config := s.Config()
+	config.Dial = func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return client, nil
+	}
+	conn, err := post.Connect(context.Background(), config)
+	if err != nil {
+		t.Fatalf("want nil err; got %v", err)
+	}
+	conn.ProtoStream().SendQuery("select 1")
+	conn.ProtoStream().Flush()
+	err = <-done
+	if err == nil || err.Error() != "nope" {
+		t.Errorf("want nope; got %v", err)
+	}
+	conn.Close()
+}
+
+type failHook struct{}
+
+func (failHook) OnQuery(s *Session, msg *post.Query) error {
+	return errors.New("nope")
+}
+
+func TestWithoutChannelBinding(t *testing.T) {
+	payload := []byte("SCRAM-SHA-256-PLUS\x00SCRAM-SHA-256\x00\x00")
+	expected := []byte("SCRAM-SHA-256\x00\x00")
+	if actual := withoutChannelBinding(payload); !bytes.Equal(expected, actual) {
+		t.Errorf("want %q; got %q", expected, actual)
+	}
+}
@@ -0,0 +1,227 @@
+package post
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Run sql with the simple query protocol. The string may hold several
+// statements separated by semicolons, each producing a result; the
+// server stops at the first statement that fails. The Results must be
+// read to the end or closed before the Conn is used for anything else.
+// If ctx is done while they are being read, the server is asked to
+// cancel the query, and the Results end with ctx's error once it stops.
+func (c *Conn) SimpleQuery(ctx context.Context, sql string) (*Results, error) {
+	return c.startQuery(ctx, func(p *ProtoStream) error {
+		return p.SendQuery(sql)
+	})
+}
+
+// Send the messages of a query with send, and return Results for
+// reading the response.
+func (c *Conn) startQuery(ctx context.Context, send func(p *ProtoStream) error) (*Results, error) {
+	if c.busy {
+		return nil, errors.New("post: connection busy with unread results")
+	}
+	r := &Results{c: c, ctx: ctx, stop: c.watchQuery(ctx)}
+	c.busy = true
+	err := send(c.proto)
+	if err == nil {
+		err = c.proto.Flush()
+	}
+	if err != nil {
+		r.fail(err)
+		return nil, r.err
+	}
+	return r, nil
+}
+
+// Results iterates over the results of a query, one for each statement,
+// and over the rows of each result in turn:
+//
+//	for results.NextResult() {
+//		fields := results.Fields()
+//		for results.Next() {
+//			values := results.Values()
+//		}
+//		rows := results.Tag().RowsAffected()
+//	}
+//	err := results.Close()
+//
+// Results for empty statements are skipped. COPY statements are not
+// supported: data sent by COPY TO STDOUT is discarded, and COPY FROM
+// STDIN fails; use CopyFrom for that instead.
+type Results struct {
+	c      *Conn
+	ctx    context.Context
+	stop   func()
+	fields []FieldDescription
+	// the fields of a prepared statement, whose rows come without a
+	// RowDescription
+	prepared []FieldDescription
+	values   [][]byte
+	tag      CommandTag
+	// whether rows of the current result may follow
+	inResult bool
+	// whether the query is over, and the Conn ready for another
+	done bool
+	err  error
+}
+
+// Advance to the next result, skipping any rows left in the current
+// one. It returns false once there are no more results or an error
+// ends the query; check Err or Close to tell which.
+func (r *Results) NextResult() bool {
+	for r.Next() {
+	}
+	r.fields, r.values, r.tag = nil, nil, ""
+	for !r.done {
+		msg := r.receive()
+		switch msg := msg.(type) {
+		case nil:
+		case *RowDescription:
+			r.fields = msg.Fields
+			r.inResult = true
+			return true
+		case *BindComplete:
+			if r.prepared != nil {
+				r.fields = r.prepared
+				r.inResult = true
+				return true
+			}
+		case *CommandComplete:
+			r.tag = msg.Tag
+			return true
+		case *EmptyQueryResponse:
+		case *CopyInResponse:
+			err := r.c.proto.SendCopyFail("post: COPY FROM STDIN is not supported here")
+			if err == nil {
+				err = r.c.proto.Flush()
+			}
+			if err != nil {
+				r.fail(err)
+			}
+		case *CopyOutResponse, *CopyData, *CopyDone:
+		default:
+			r.unexpected(msg)
+		}
+	}
+	return false
+}
+
+// Advance to the next row of the current result. It returns false
+// after the last row, or if an error ends the query.
+func (r *Results) Next() bool {
+	for r.inResult && !r.done {
+		msg := r.receive()
+		switch msg := msg.(type) {
+		case nil:
+		case *DataRow:
+			r.values = msg.Values
+			return true
+		case *CommandComplete:
+			r.tag = msg.Tag
+			r.inResult = false
+		default:
+			r.inResult = false
+			r.unexpected(msg)
+		}
+	}
+	r.values = nil
+	return false
+}
+
+// Get the fields of the current result, or nil if the statement does
+// not return rows.
+func (r *Results) Fields() []FieldDescription {
+	return r.fields
+}
+
+// Get the values of the current row, with nil for NULL. They are only
+// valid until the next call to Next.
+func (r *Results) Values() [][]byte {
+	return r.values
+}
+
+// Get the command tag of the current result, e.g., "SELECT 2" or
+// "INSERT 0 1", which gives the command and the number of rows it
+// affected. For a result with rows, it is only set once Next has
+// returned false.
+func (r *Results) Tag() CommandTag {
+	return r.tag
+}
+
+// Get the error that ended the query, if any. Errors reported by the
+// server are returned as a *PgError.
+func (r *Results) Err() error {
+	return r.err
+}
+
+// Read and discard the rest of the results, and return Err.
+func (r *Results) Close() error {
+	for r.NextResult() {
+	}
+	return r.err
+}
+
+// Receive the next message of the query, handling anything not specific
+// to the current result. It returns nil if there is nothing for the
+// caller to do.
+func (r *Results) receive() BackendMessage {
+	msg, err := r.c.proto.ReceiveMessage()
+	if err != nil {
+		r.fail(err)
+		return nil
+	}
+	if r.c.handleAsync(msg) {
+		return nil
+	}
+	switch msg := msg.(type) {
+	case *PgError:
+		// the server skips the rest of the query
+		if r.err == nil {
+			r.err = msg
+		}
+		r.inResult = false
+	case *ReadyForQuery:
+		r.c.txStatus = msg.Status
+		r.finish()
+	default:
+		return msg
+	}
+	return nil
+}
+
+// Note a message out of place in the query, which carries on to the
+// ReadyForQuery all the same.
+func (r *Results) unexpected(msg BackendMessage) {
+	if r.err == nil {
+		r.err = fmt.Errorf("post: unexpected message type %q during query",
+			byte(msg.Type()))
+	}
+}
+
+// End the query after an I/O error, which leaves the connection
+// unusable.
+func (r *Results) fail(err error) {
+	if r.ctx.Err() != nil {
+		err = r.ctx.Err()
+	}
+	r.err = err
+	r.finish()
+}
+
+func (r *Results) finish() {
+	if r.done {
+		return
+	}
+	r.done = true
+	r.inResult = false
+	r.stop()
+	r.c.busy = false
+	// a query failing because it was cancelled reports why
+	if r.err != nil && r.ctx.Err() != nil {
+		r.err = r.ctx.Err()
+	}
+}
@@ -0,0 +1,193 @@
+package post
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+// Connect to a fake backend that completes startup and then hands the
+// server end of the connection to serve.
+func connectServing(t *testing.T, serve func(p *ProtoStream)) (*Conn, <-chan struct{}) {
+	config, done := pipeConfig(t, func(b *fakeBackend) {
+		b.readStartup()
+		b.write(authOkMsg)
+		b.write(readyForQueryMsg)
+		serve(NewProtoStreamConn(b.Conn))
+	})
+	c, err := Connect(context.Background(), config)
+	if err != nil {
+		t.Fatalf("want nil err; got %v", err)
+	}
+	return c, done
+}
+
+// Send backend messages, failing the test on error.
+func sendAll(t *testing.T, p *ProtoStream, msgs ...Encoder) {
+	for _, msg := range msgs {
+		err := p.Send(msg)
+		if err != nil {
+			t.Errorf("want nil err; got %v", err)
+		}
+	}
+	err := p.Flush()
+	if err != nil {
+		t.Errorf("want nil err; got %v", err)
+	}
+}
+
+type queryResult struct {
+	fields []string
+	rows   [][]string
+	tag    string
+}
+
+func readResults(r *Results) []queryResult {
+	var results []queryResult
+	for r.NextResult() {
+		var result queryResult
+		for _, field := range r.Fields() {
+			result.fields = append(result.fields, field.Name)
+		}
+		for r.Next() {
+			var row []string
+			for _, val := range r.Values() {
+				if val == nil {
+					row = append(row, "NULL")
+				} else {
+					row = append(row, string(val))
+				}
+			}
+			result.rows = append(result.rows, row)
+		}
+		result.tag = string(r.Tag())
+		results = append(results, result)
+	}
+	return results
+}
+
+var (
+	testFields = &RowDescription{Fields: []FieldDescription{
+		{Name: "a", TypeOid: 25, TypLen: -1, AttTypMod: -1},
+		{Name: "b", TypeOid: 25, TypLen: -1, AttTypMod: -1},
+	}}
+	testRow  = &DataRow{Values: [][]byte{[]byte("1"), nil}}
+	testErr  = &PgError{Severity: "ERROR", Code: "42P01", Message: "nope"}
+	testIdle = &ReadyForQuery{Status: Idle}
+)
+
+func TestSimpleQuery(t *testing.T) {
+	var queryTests = []struct {
+		responses []Encoder
+		expected  []queryResult
+		err       bool
+	}{
+		{
+			[]Encoder{testFields, testRow, testRow, &CommandComplete{"SELECT 2"},
+				&CommandComplete{"INSERT 0 1"}, &EmptyQueryResponse{}, testIdle},
+			[]queryResult{
+				{[]string{"a", "b"}, [][]string{{"1", "NULL"}, {"1", "NULL"}}, "SELECT 2"},
+				{nil, nil, "INSERT 0 1"},
+			},
+			false,
+		},
+		{
+			[]Encoder{&ParameterStatus{"TimeZone", "UTC"}, &Notice{Fields: map[ErrorField]string{
+				Severity: "NOTICE", Code: "00000", Message: "hi"}},
+				testFields, &CommandComplete{"SELECT 0"}, testIdle},
+			[]queryResult{{[]string{"a", "b"}, nil, "SELECT 0"}},
+			false,
+		},
+		{
+			[]Encoder{testFields, testRow, testErr, testIdle},
+			[]queryResult{{[]string{"a", "b"}, [][]string{{"1", "NULL"}}, ""}},
+			true,
+		},
+		{
+			[]Encoder{&EmptyQueryResponse{}, testIdle},
+			nil,
+			false,
+		},
+	}
+	for i, tt := range queryTests {
+		c, done := connectServing(t, func(p *ProtoStream) {
+			if _, err := p.ReceiveFrontendMessage(); err != nil {
+				t.Errorf("%d: want nil err; got %v", i, err)
+			}
+			sendAll(t, p, tt.responses...)
+			p.ReceiveFrontendMessage()
+		})
+		r, err := c.SimpleQuery(context.Background(), "select 1")
+		if err != nil {
+			t.Fatalf("%d: want nil err; got %v", i, err)
+		}
+		actual := readResults(r)
+		if !reflect.DeepEqual(tt.expected, actual) {
+			t.Errorf("%d: want %#v; got %#v", i, tt.expected, actual)
+		}
+		err = r.Close()
+		if tt.err != (err != nil) {
+			t.Errorf("%d: want err %v; got %v", i, tt.err, err)
+		}
+		c.Close()
+		<-done
+	}
+}
+
+func TestSimpleQuerySkipRows(t *testing.T) {
+	c, done := connectServing(t, func(p *ProtoStream) {
+		p.ReceiveFrontendMessage()
+		sendAll(t, p, testFields, testRow, testRow, &CommandComplete{"SELECT 2"},
+			&ParameterStatus{"TimeZone", "UTC"}, &CommandComplete{"DELETE 3"}, testIdle)
+		p.ReceiveFrontendMessage()
+	})
+	defer func() { <-done }()
+	defer c.Close()
+	r, err := c.SimpleQuery(context.Background(), "select 1; delete from t")
+	if err != nil {
+		t.Fatalf("want nil err; got %v", err)
+	}
+	if !r.NextResult() || !r.NextResult() {
+		t.Fatalf("want two results; got error %v", r.Err())
+	}
+	if tag := r.Tag(); tag.Command() != "DELETE" || tag.RowsAffected() != 3 {
+		t.Errorf("want DELETE of 3 rows; got %v", tag)
+	}
+	if _, err := c.SimpleQuery(context.Background(), "select 2"); err == nil {
+		t.Error("want err while busy; got nil")
+	}
+	if r.NextResult() {
+		t.Error("want no more results; got another")
+	}
+	if err := r.Close(); err != nil {
+		t.Errorf("want nil err; got %v", err)
+	}
+	if tz := c.ParameterStatus("TimeZone"); tz != "UTC" {
+		t.Errorf("want TimeZone UTC; got %v", tz)
+	}
+}
+
+func TestSimpleQueryCopyIn(t *testing.T) {
+	c, done := connectServing(t, func(p *ProtoStream) {
+		p.ReceiveFrontendMessage()
+		sendAll(t, p, &CopyInResponse{})
+		msg, err := p.ReceiveFrontendMessage()
+		if _, ok := msg.(*CopyFail); !ok || err != nil {
+			t.Errorf("want CopyFail; got %#v, %v", msg, err)
+		}
+		sendAll(t, p, testErr, testIdle)
+		p.ReceiveFrontendMessage()
+	})
+	defer func() { <-done }()
+	defer c.Close()
+	r, err := c.SimpleQuery(context.Background(), "copy t from stdin")
+	if err != nil {
+		t.Fatalf("want nil err; got %v", err)
+	}
+	if r.NextResult() {
+		t.Error("want no results; got one")
+	}
+	if pgErr, ok := r.Close().(*PgError); !ok || pgErr.Code != "42P01" {
+		t.Errorf("want 42P01 error; got %v", r.Err())
+	}
+}
@@ -0,0 +1,402 @@
+package replay
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/msakrejda/post"
+	"github.com/msakrejda/post/internal/netutil"
+)
+
+// Link-layer header types, as found in pcap file headers.
+const (
+	linkNull      = 0
+	linkEthernet  = 1
+	linkRawAlt    = 12
+	linkRaw       = 101
+	linkLoop      = 108
+	linkLinuxSLL  = 113
+	linkLinuxSLL2 = 276
+)
+
+// TCP flags.
+const (
+	tcpSYN = 0x02
+	tcpACK = 0x10
+)
+
+// The largest packet accepted in a pcap file.
+const maxPacketSize = 1 << 18
+
+// Read the sessions in a pcap file of traffic to and from a server
+// listening on port, ordered by when their connections started. Only
+// the classic pcap format is supported, not pcapng. Connections that
+// started before the capture did, and those using TLS or GSSAPI
+// encryption, are skipped, since they cannot be replayed.
+func ReadPcap(r io.Reader, port int) ([]Session, error) {
+	var header [24]byte
+	_, err := io.ReadFull(r, header[:])
+	if err != nil {
+		return nil, err
+	}
+	var order binary.ByteOrder
+	nanos := false
+	switch binary.BigEndian.Uint32(header[:4]) {
+	case 0xa1b2c3d4:
+		order = binary.BigEndian
+	case 0xa1b23c4d:
+		order, nanos = binary.BigEndian, true
+	case 0xd4c3b2a1:
+		order = binary.LittleEndian
+	case 0x4d3cb2a1:
+		order, nanos = binary.LittleEndian, true
+	default:
+		return nil, errors.New("replay: not a pcap file")
+	}
+	link := order.Uint32(header[20:])
+
+	conns := make(map[[2]string]*tcpConn)
+	var started []*tcpConn
+	for index := 0; ; index++ {
+		var packetHeader [16]byte
+		_, err := io.ReadFull(r, packetHeader[:])
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		size := order.Uint32(packetHeader[8:])
+		if size > maxPacketSize {
+			return nil, fmt.Errorf("replay: invalid pcap packet length %v", size)
+		}
+		data := make([]byte, size)
+		_, err = io.ReadFull(r, data)
+		if err != nil {
+			return nil, err
+		}
+		frac := time.Duration(order.Uint32(packetHeader[4:]))
+		if !nanos {
+			frac *= time.Microsecond
+		}
+		t := time.Unix(int64(order.Uint32(packetHeader[:4])), int64(frac))
+
+		ip, err := linkPayload(link, data)
+		if err != nil {
+			return nil, err
+		}
+		seg, ok := parseIP(ip)
+		if !ok {
+			continue
+		}
+		var key [2]string
+		var stream *tcpStream
+		switch {
+		case seg.dstPort == port:
+			key = [2]string{seg.src, seg.dst}
+		case seg.srcPort == port:
+			key = [2]string{seg.dst, seg.src}
+		default:
+			continue
+		}
+		conn := conns[key]
+		if seg.dstPort == port && seg.flags&(tcpSYN|tcpACK) == tcpSYN {
+			// a new connection, possibly reusing the address of an old one
+			conn = &tcpConn{}
+			conn.front.start(seg.seq)
+			conns[key] = conn
+			started = append(started, conn)
+		}
+		if conn == nil {
+			continue
+		}
+		if seg.dstPort == port {
+			stream = &conn.front
+		} else {
+			stream = &conn.back
+			if seg.flags&(tcpSYN|tcpACK) == tcpSYN|tcpACK {
+				stream.start(seg.seq)
+			}
+		}
+		stream.add(seg.seq, seg.payload, index, t)
+	}
+
+	var sessions []Session
+	for _, conn := range started {
+		if sess := conn.session(); len(sess) > 0 {
+			sessions = append(sessions, sess)
+		}
+	}
+	return sessions, nil
+}
+
+// Get the IP packet inside a link-layer frame, or nil if there is none.
+func linkPayload(link uint32, data []byte) ([]byte, error) {
+	switch link {
+	case linkNull, linkLoop:
+		// the address family is in the byte order of the capturing
+		// machine, but the IP version tells just as well
+		return skip(data, 4), nil
+	case linkEthernet:
+		data = skip(data, 12)
+		for len(data) >= 2 {
+			switch binary.BigEndian.Uint16(data) {
+			case 0x8100, 0x88a8:
+				// VLAN tag
+				data = skip(data, 4)
+			case 0x0800, 0x86dd:
+				return data[2:], nil
+			default:
+				return nil, nil
+			}
+		}
+		return nil, nil
+	case linkRaw, linkRawAlt:
+		return data, nil
+	case linkLinuxSLL:
+		return skip(data, 16), nil
+	case linkLinuxSLL2:
+		return skip(data, 20), nil
+	}
+	return nil, fmt.Errorf("replay: unsupported pcap link type %v", link)
+}
+
+func skip(data []byte, n int) []byte {
+	if len(data) < n {
+		return nil
+	}
+	return data[n:]
+}
+
+// A TCP segment, with the addresses of its IP packet.
+type tcpSegment struct {
+	src, dst         string
+	srcPort, dstPort int
+	seq              uint32
+	flags            byte
+	payload          []byte
+}
+
+// Parse a TCP segment from an IPv4 or IPv6 packet, returning false if
+// the packet holds anything else. Fragments and IPv6 extension headers
+// are not supported.
+func parseIP(data []byte) (seg tcpSegment, ok bool) {
+	var src, dst net.IP
+	switch {
+	case len(data) >= 20 && data[0]>>4 == 4:
+		headerSize := int(data[0]&0x0f) * 4
+		size := int(binary.BigEndian.Uint16(data[2:]))
+		if data[9] != 6 || binary.BigEndian.Uint16(data[6:])&0x3fff != 0 ||
+			headerSize < 20 || size < headerSize || size > len(data) {
+			return seg, false
+		}
+		src, dst = net.IP(data[12:16]), net.IP(data[16:20])
+		// drop any link-layer padding
+		data = data[headerSize:size]
+	case len(data) >= 40 && data[0]>>4 == 6:
+		size := 40 + int(binary.BigEndian.Uint16(data[4:]))
+		if data[6] != 6 || size > len(data) {
+			return seg, false
+		}
+		src, dst = net.IP(data[8:24]), net.IP(data[24:40])
+		data = data[40:size]
+	default:
+		return seg, false
+	}
+	if len(data) < 20 {
+		return seg, false
+	}
+	headerSize := int(data[12]>>4) * 4
+	if headerSize < 20 || headerSize > len(data) {
+		return seg, false
+	}
+	seg.srcPort = int(binary.BigEndian.Uint16(data))
+	seg.dstPort = int(binary.BigEndian.Uint16(data[2:]))
+	seg.src = net.JoinHostPort(src.String(), strconv.Itoa(seg.srcPort))
+	seg.dst = net.JoinHostPort(dst.String(), strconv.Itoa(seg.dstPort))
+	seg.seq = binary.BigEndian.Uint32(data[4:])
+	seg.flags = data[13]
+	seg.payload = data[headerSize:]
+	return seg, true
+}
+
+// One direction of a TCP connection, reassembled from its segments.
+type tcpStream struct {
+	started bool
+	next    uint32
+	data    []byte
+	// where each packet adding to data left off
+	marks []streamMark
+	// segments received ahead of a gap
+	pending []pendingSegment
+}
+
+type streamMark struct {
+	end   int
+	index int
+	time  time.Time
+}
+
+type pendingSegment struct {
+	seq  uint32
+	data []byte
+}
+
+func (s *tcpStream) start(seq uint32) {
+	// the SYN takes up a sequence number
+	*s = tcpStream{started: true, next: seq + 1}
+}
+
+// Add the payload of a segment. Retransmitted data is dropped, and
+// data after a gap is held until the gap is filled.
+func (s *tcpStream) add(seq uint32, payload []byte, index int, t time.Time) {
+	if !s.started || len(payload) == 0 {
+		return
+	}
+	s.pending = append(s.pending, pendingSegment{seq, payload})
+	size := len(s.data)
+	for progress := true; progress; {
+		progress = false
+		for i := 0; i < len(s.pending); i++ {
+			seg := s.pending[i]
+			// the amount of the segment already in data, taking
+			// sequence number wraparound into account
+			overlap := int(int32(s.next - seg.seq))
+			if overlap < 0 {
+				continue
+			}
+			if overlap < len(seg.data) {
+				s.data = append(s.data, seg.data[overlap:]...)
+				s.next += uint32(len(seg.data) - overlap)
+				progress = true
+			}
+			s.pending = append(s.pending[:i], s.pending[i+1:]...)
+			i--
+		}
+	}
+	if len(s.data) > size {
+		s.marks = append(s.marks, streamMark{len(s.data), index, t})
+	}
+}
+
+// Get the mark of the packet completing the data up to end.
+func (s *tcpStream) markAt(end int) streamMark {
+	i := sort.Search(len(s.marks), func(i int) bool { return s.marks[i].end >= end })
+	return s.marks[i]
+}
+
+// A record, with the index of the packet completing it.
+type indexedRecord struct {
+	record *post.TraceRecord
+	index  int
+}
+
+func (s *tcpStream) record(dir post.Direction, msgType post.MessageType, start, end int) indexedRecord {
+	mark := s.markAt(end)
+	return indexedRecord{
+		record: &post.TraceRecord{
+			Time: mark.time,
+			Dir:  dir,
+			Type: msgType,
+			Body: s.data[start:end],
+		},
+		index: mark.index,
+	}
+}
+
+// A TCP connection to the server.
+type tcpConn struct {
+	front tcpStream
+	back  tcpStream
+}
+
+// Split the data of the connection into messages, in the order they
+// were sent. A message cut off by the end of the capture is dropped.
+// The session is empty if the connection cannot be replayed.
+func (c *tcpConn) session() Session {
+	var front, back []indexedRecord
+	// the number of SSLRequests and GSSENCRequests, each answered by a
+	// single byte
+	requests := 0
+	data := c.front.data
+	pos := 0
+	startup := true
+	for startup && pos+4 <= len(data) {
+		if data[pos] == netutil.TLSHandshake {
+			return nil
+		}
+		size := int(binary.BigEndian.Uint32(data[pos:]))
+		if size < 8 {
+			return nil
+		}
+		if pos+size > len(data) {
+			break
+		}
+		record := c.front.record(post.FromFrontend, 0, pos+4, pos+size)
+		front = append(front, record)
+		pos += size
+		msg, err := record.record.Message()
+		if err != nil {
+			return nil
+		}
+		switch msg.(type) {
+		case *post.SSLRequest, *post.GSSENCRequest:
+			requests++
+		case *post.CancelRequest:
+			return sessionOf(front)
+		default:
+			startup = false
+		}
+	}
+	front = append(front, splitMessages(&c.front, post.FromFrontend, pos)...)
+
+	data = c.back.data
+	for pos = 0; pos < requests && pos < len(data); pos++ {
+		if post.ServerSSL(data[pos]) != post.SSLRejected {
+			return nil
+		}
+		back = append(back, c.back.record(post.FromBackend, 0, pos, pos+1))
+	}
+	back = append(back, splitMessages(&c.back, post.FromBackend, pos)...)
+
+	// merge the two directions by the packets completing each message
+	sess := make(Session, 0, len(front)+len(back))
+	for len(front) > 0 || len(back) > 0 {
+		if len(back) == 0 || len(front) > 0 && front[0].index < back[0].index {
+			sess = append(sess, front[0].record)
+			front = front[1:]
+		} else {
+			sess = append(sess, back[0].record)
+			back = back[1:]
+		}
+	}
+	return sess
+}
+
+// Split typed messages from the data of a stream, starting at pos.
+func splitMessages(s *tcpStream, dir post.Direction, pos int) []indexedRecord {
+	var records []indexedRecord
+	for pos+5 <= len(s.data) {
+		size := int(binary.BigEndian.Uint32(s.data[pos+1:]))
+		if size < 4 || pos+1+size > len(s.data) {
+			break
+		}
+		records = append(records,
+			s.record(dir, post.MessageType(s.data[pos]), pos+5, pos+1+size))
+		pos += 1 + size
+	}
+	return records
+}
+
+func sessionOf(records []indexedRecord) Session {
+	sess := make(Session, len(records))
+	for i, record := range records {
+		sess[i] = record.record
+	}
+	return sess
+}
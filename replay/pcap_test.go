@@ -0,0 +1,175 @@
+package replay
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/msakrejda/post"
+)
+
+// Write pcap files of Ethernet frames for testing.
+type pcapWriter struct {
+	buf bytes.Buffer
+}
+
+func newPcapWriter() *pcapWriter {
+	w := &pcapWriter{}
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header, 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(header[4:], 2)
+	binary.LittleEndian.PutUint16(header[6:], 4)
+	binary.LittleEndian.PutUint32(header[16:], 65535)
+	binary.LittleEndian.PutUint32(header[20:], linkEthernet)
+	w.buf.Write(header)
+	return w
+}
+
+// Write a TCP segment between the given addresses, which are either
+// both IPv4 or both IPv6.
+func (w *pcapWriter) segment(src, dst string, srcPort, dstPort int,
+	seq uint32, flags byte, payload []byte) {
+	tcp := make([]byte, 20, 20+len(payload))
+	binary.BigEndian.PutUint16(tcp, uint16(srcPort))
+	binary.BigEndian.PutUint16(tcp[2:], uint16(dstPort))
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	tcp[12] = 5 << 4
+	tcp[13] = flags
+	tcp = append(tcp, payload...)
+
+	var ip []byte
+	etherType := uint16(0x0800)
+	if srcIP := net.ParseIP(src).To4(); srcIP != nil {
+		ip = make([]byte, 20, 20+len(tcp))
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:], uint16(20+len(tcp)))
+		ip[9] = 6
+		copy(ip[12:], srcIP)
+		copy(ip[16:], net.ParseIP(dst).To4())
+	} else {
+		etherType = 0x86dd
+		ip = make([]byte, 40, 40+len(tcp))
+		ip[0] = 0x60
+		binary.BigEndian.PutUint16(ip[4:], uint16(len(tcp)))
+		ip[6] = 6
+		copy(ip[8:], net.ParseIP(src))
+		copy(ip[24:], net.ParseIP(dst))
+	}
+	ip = append(ip, tcp...)
+
+	frame := make([]byte, 14, 14+len(ip))
+	binary.BigEndian.PutUint16(frame[12:], etherType)
+	frame = append(frame, ip...)
+	// minimum Ethernet frame size
+	for len(frame) < 60 {
+		frame = append(frame, 0)
+	}
+
+	header := make([]byte, 16)
+	binary.LittleEndian.PutUint32(header[8:], uint32(len(frame)))
+	binary.LittleEndian.PutUint32(header[12:], uint32(len(frame)))
+	w.buf.Write(header)
+	w.buf.Write(frame)
+}
+
+func encode(msgs ...post.Encoder) []byte {
+	var data []byte
+	for _, msg := range msgs {
+		data = msg.Encode(data)
+	}
+	return data
+}
+
+func TestReadPcap(t *testing.T) {
+	const (
+		client  = "10.0.0.1"
+		server  = "10.0.0.2"
+		client6 = "fd00::1"
+		server6 = "fd00::2"
+		syn     = tcpSYN
+		synAck  = tcpSYN | tcpACK
+		ack     = tcpACK
+	)
+	startup := encode(&post.StartupMessage{
+		ProtocolVersion: post.ProtocolVersion30,
+		Parameters:      map[string]string{"user": "alice"},
+	})
+	ready := encode(&post.ReadyForQuery{Status: post.Idle})
+
+	w := newPcapWriter()
+	// a connection refusing TLS, with the StartupMessage out of order
+	// and retransmitted
+	w.segment(client, server, 40000, 5432, 1000, syn, nil)
+	w.segment(server, client, 5432, 40000, 5000, synAck, nil)
+	w.segment(client, server, 40000, 5432, 1001, ack, encode(&post.SSLRequest{}))
+	w.segment(server, client, 5432, 40000, 5001, ack, []byte{'N'})
+	w.segment(client, server, 40000, 5432, 1009+10, ack, startup[10:])
+	w.segment(client, server, 40000, 5432, 1009, ack, startup[:10])
+	w.segment(client, server, 40000, 5432, 1009, ack, startup[:10])
+	w.segment(server, client, 5432, 40000, 5002, ack, ready)
+	// a connection that started before the capture
+	w.segment(client, server, 40001, 5432, 1, ack, encode(&post.Query{Query: "select 2"}))
+	// a connection using TLS
+	w.segment(client, server, 40002, 5432, 1, syn, nil)
+	w.segment(server, client, 5432, 40002, 1, synAck, nil)
+	w.segment(client, server, 40002, 5432, 2, ack, encode(&post.SSLRequest{}))
+	w.segment(server, client, 5432, 40002, 2, ack, []byte{'S'})
+	// an IPv6 connection
+	w.segment(client6, server6, 40003, 5432, 0xfffffffe, syn, nil)
+	w.segment(server6, client6, 5432, 40003, 7, synAck, nil)
+	w.segment(client6, server6, 40003, 5432, 0xffffffff, ack, startup)
+	w.segment(server6, client6, 5432, 40003, 8, ack, ready)
+	// traffic to another port
+	w.segment(client, server, 40004, 5433, 1, syn, nil)
+	// the rest of the first connection
+	w.segment(client, server, 40000, 5432, 1009+uint32(len(startup)), ack,
+		encode(&post.Query{Query: "select 1"}, &post.Terminate{}))
+
+	sessions, err := ReadPcap(&w.buf, 5432)
+	if err != nil {
+		t.Fatalf("want nil err; got %v", err)
+	}
+	expected := [][]string{
+		{"F SSLRequest", "B SSLResponse", "F StartupMessage", "B ReadyForQuery",
+			"F Query", "F Terminate"},
+		{"F StartupMessage", "B ReadyForQuery"},
+	}
+	var actual [][]string
+	for _, sess := range sessions {
+		var names []string
+		for _, record := range sess {
+			names = append(names, string(record.Dir)+" "+record.Name())
+		}
+		actual = append(actual, names)
+	}
+	if !reflect.DeepEqual(expected, actual) {
+		t.Fatalf("want %q; got %q", expected, actual)
+	}
+	if body := sessions[0][2].Body; !bytes.Equal(body, startup[4:]) {
+		t.Errorf("want startup body %q; got %q", startup[4:], body)
+	}
+	if body := sessions[0][4].Body; string(body) != "select 1\x00" {
+		t.Errorf("want query body; got %q", body)
+	}
+}
+
+func TestReadPcapErrors(t *testing.T) {
+	// a big-endian header for the unsupported link type 0xffff,
+	// followed by an empty packet
+	unsupported := make([]byte, 24+16)
+	binary.BigEndian.PutUint32(unsupported, 0xa1b2c3d4)
+	binary.BigEndian.PutUint32(unsupported[20:], 0xffff)
+	var errorTests = [][]byte{
+		[]byte("POSTCAP1\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00"),
+		unsupported,
+		unsupported[:30],
+	}
+	for i, tt := range errorTests {
+		_, err := ReadPcap(bytes.NewReader(tt), 5432)
+		if err == nil {
+			t.Errorf("%d: want err; got nil", i)
+		}
+	}
+}
@@ -0,0 +1,245 @@
+// Package replay turns recorded protocol sessions into a scripted
+// server, to reproduce problems offline without the original database.
+//
+// A recording is either a capture written by post.CaptureWriter or a
+// pcap file of traffic to a server port. The Server plays back the
+// backend half of each session and checks that the client sends the
+// frontend half byte for byte, stopping with a *MismatchError at the
+// first difference. Anything the client sends that depends on chance,
+// such as SCRAM nonces, will not match, so recordings are best made
+// with trust or password authentication.
+package replay
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/msakrejda/post"
+	"github.com/msakrejda/post/internal/netutil"
+)
+
+// A Session is the recorded messages of a single connection, in the
+// order they were sent.
+type Session []*post.TraceRecord
+
+// A MismatchError reports a message from the client that differs from
+// the recording.
+type MismatchError struct {
+	// The position of the expected message in the Session.
+	Index    int
+	Expected *post.TraceRecord
+	Actual   *post.TraceRecord
+}
+
+func (e *MismatchError) Error() string {
+	return fmt.Sprintf("replay: message %d differs from the recording: want %v; got %v",
+		e.Index, describe(e.Expected), describe(e.Actual))
+}
+
+// Describe a record as its String does, but without the time.
+func describe(record *post.TraceRecord) string {
+	s := record.String()
+	return s[strings.IndexByte(s, '\t')+1:]
+}
+
+// Get a Tracer calling f.
+type tracerFunc func(dir post.Direction, msgType post.MessageType, body []byte)
+
+func (f tracerFunc) TraceMessage(dir post.Direction, msgType post.MessageType, body []byte) {
+	f(dir, msgType, body)
+}
+
+// Play the backend half of sess to the client on p, checking that the
+// client sends the frontend half. If the recording accepts an
+// SSLRequest, TLS is started with config; if config is nil, or the
+// recording accepts a GSSENCRequest, the request is refused instead,
+// which clients willing to go without encryption take in stride. Replay
+// replaces any Tracer set on p.
+func Replay(p *post.ProtoStream, sess Session, config *tls.Config) error {
+	var received *post.TraceRecord
+	p.SetTracer(tracerFunc(func(dir post.Direction, msgType post.MessageType, body []byte) {
+		if dir == post.FromFrontend {
+			received = &post.TraceRecord{
+				Time: time.Now(),
+				Dir:  dir,
+				Type: msgType,
+				Body: append([]byte(nil), body...),
+			}
+		}
+	}))
+	defer p.SetTracer(nil)
+
+	for i, expected := range sess {
+		var err error
+		if expected.Dir == post.FromBackend {
+			err = send(p, expected, config)
+			if err != nil {
+				return fmt.Errorf("replay: message %d: %w", i, err)
+			}
+			continue
+		}
+		err = p.Flush()
+		if err != nil {
+			return err
+		}
+		received = nil
+		if expected.Type == 0 {
+			_, err = p.ReceiveStartupMessage()
+		} else {
+			_, err = p.ReceiveFrontendMessage()
+		}
+		if received == nil {
+			return fmt.Errorf("replay: message %d: %w", i, err)
+		}
+		// a message that fails to decode is fine as long as it was
+		// recorded that way
+		if received.Type != expected.Type || !bytes.Equal(received.Body, expected.Body) {
+			return &MismatchError{i, expected, received}
+		}
+	}
+	return p.Flush()
+}
+
+func send(p *post.ProtoStream, record *post.TraceRecord, config *tls.Config) error {
+	if record.Type != 0 {
+		return p.Send(&post.UnknownMessage{MsgType: record.Type, Body: record.Body})
+	}
+	if len(record.Body) != 1 {
+		return fmt.Errorf("invalid SSL response of %v bytes", len(record.Body))
+	}
+	resp := post.ServerSSL(record.Body[0])
+	if resp != post.SSLAccepted || config == nil {
+		resp = post.SSLRejected
+	}
+	err := p.SendSSLResponse(resp)
+	if err == nil {
+		err = p.Flush()
+	}
+	if err != nil || resp == post.SSLRejected {
+		return err
+	}
+	_, err = p.AcceptTLS(config)
+	return err
+}
+
+// A Server replays recorded sessions to the clients connecting to it.
+type Server struct {
+	// The sessions to replay, one for each connection in the order they
+	// are accepted. Connections beyond the last session are closed
+	// right away.
+	Sessions []Session
+	// TLSConfig, if set, is used to start TLS where the recording did.
+	TLSConfig *tls.Config
+	// ErrorLog, if set, is called with the error, e.g., a
+	// *MismatchError, that ends a replay started by Serve.
+	ErrorLog func(err error)
+
+	mu   sync.Mutex
+	next int
+}
+
+// Replay sessions to the connections accepted from listener, each in
+// its own goroutine, until accepting fails or ctx is done.
+func (s *Server) Serve(ctx context.Context, listener net.Listener) error {
+	stop := netutil.CloseWhenDone(ctx, listener)
+	defer stop()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		go func() {
+			err := s.ServeConn(ctx, conn)
+			if err != nil && s.ErrorLog != nil {
+				s.ErrorLog(err)
+			}
+		}()
+	}
+}
+
+// Replay the next session to a single client connection. The
+// connection is closed on return.
+func (s *Server) ServeConn(ctx context.Context, conn net.Conn) error {
+	defer conn.Close()
+	s.mu.Lock()
+	if s.next == len(s.Sessions) {
+		s.mu.Unlock()
+		return errors.New("replay: no more sessions to replay")
+	}
+	sess := s.Sessions[s.next]
+	s.next++
+	s.mu.Unlock()
+
+	stop := netutil.CloseWhenDone(ctx, conn)
+	defer stop()
+	err := Replay(post.NewProtoStreamConn(conn), sess, s.TLSConfig)
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// Read the sessions recorded in either a capture or a pcap file,
+// telling them apart by their first bytes. The port is that of the
+// server, as used by ReadPcap.
+func Read(r io.Reader, port int) ([]Session, error) {
+	buf := bufio.NewReader(r)
+	magic, err := buf.Peek(4)
+	if err != nil {
+		return nil, err
+	}
+	if string(magic) == "POST" {
+		return ReadCapture(buf)
+	}
+	return ReadPcap(buf, port)
+}
+
+// Read the sessions in a capture. A capture of several connections is
+// split into sessions where a new connection starts, which only works
+// when the connections did not overlap.
+func ReadCapture(r io.Reader) ([]Session, error) {
+	capture, err := post.NewCaptureReader(r)
+	if err != nil {
+		return nil, err
+	}
+	var sessions []Session
+	// whether the current session is past its startup phase, so the
+	// next startup packet starts a new one
+	started := true
+	for {
+		record, err := capture.Next()
+		if err == io.EOF {
+			return sessions, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if record.Dir == post.FromFrontend && record.Type == 0 {
+			if started {
+				sessions = append(sessions, nil)
+				started = false
+			}
+			msg, _ := record.Message()
+			if _, ok := msg.(*post.CancelRequest); ok {
+				started = true
+			}
+		} else if record.Type != 0 {
+			started = true
+		}
+		if len(sessions) == 0 {
+			return nil, errors.New("replay: capture does not start with a new connection")
+		}
+		sessions[len(sessions)-1] = append(sessions[len(sessions)-1], record)
+	}
+}
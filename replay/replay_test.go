@@ -0,0 +1,143 @@
+package replay
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/msakrejda/post"
+	"github.com/msakrejda/post/internal/testquery"
+	"github.com/msakrejda/post/posttest"
+)
+
+// Record a session with a posttest server.
+func record(t *testing.T) (post.Config, []Session, []post.BackendMessage) {
+	s := posttest.NewServer(t)
+	s.OnQuery("select id, name from users").Columns("id", "name").Row(1, "alice")
+	var buf bytes.Buffer
+	capture, err := post.NewCaptureWriter(&buf)
+	if err != nil {
+		t.Fatalf("want nil err; got %v", err)
+	}
+	config := s.Config()
+	config.Tracer = capture
+	conn, err := post.Connect(context.Background(), config)
+	if err != nil {
+		t.Fatalf("want nil err; got %v", err)
+	}
+	msgs := testquery.Run(t, conn, "select id, name from users")
+	conn.Close()
+	sessions, err := ReadCapture(&buf)
+	if err != nil {
+		t.Fatalf("want nil err; got %v", err)
+	}
+	config.Tracer = nil
+	return config, sessions, msgs
+}
+
+// Connect to a replay server over a pipe, sending the result of
+// serving the connection to done.
+func replayConfig(s *Server, config post.Config, done chan<- error) post.Config {
+	config.Dial = func(ctx context.Context, _, _ string) (net.Conn, error) {
+		client, server := net.Pipe()
+		go func() { done <- s.ServeConn(context.Background(), server) }()
+		return client, nil
+	}
+	return config
+}
+
+func TestReplay(t *testing.T) {
+	config, sessions, expected := record(t)
+	if len(sessions) != 1 {
+		t.Fatalf("want 1 session; got %v", len(sessions))
+	}
+	done := make(chan error, 1)
+	s := &Server{Sessions: sessions}
+	conn, err := post.Connect(context.Background(), replayConfig(s, config, done))
+	if err != nil {
+		t.Fatalf("want nil err; got %v", err)
+	}
+	actual := testquery.Run(t, conn, "select id, name from users")
+	if !reflect.DeepEqual(expected, actual) {
+		t.Errorf("want %#v; got %#v", expected, actual)
+	}
+	conn.Close()
+	if err := <-done; err != nil {
+		t.Errorf("want nil err; got %v", err)
+	}
+
+	// there is only one session to go around
+	_, err = post.Connect(context.Background(), replayConfig(s, config, done))
+	if err == nil {
+		t.Error("want err; got nil")
+	}
+	if err := <-done; err == nil {
+		t.Error("want err; got nil")
+	}
+}
+
+func TestReplayMismatch(t *testing.T) {
+	config, sessions, _ := record(t)
+	done := make(chan error, 1)
+	s := &Server{Sessions: sessions}
+	conn, err := post.Connect(context.Background(), replayConfig(s, config, done))
+	if err != nil {
+		t.Fatalf("want nil err; got %v", err)
+	}
+	defer conn.Close()
+	conn.ProtoStream().SendQuery("select 1")
+	conn.ProtoStream().Flush()
+	select {
+	case err = <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("want err; got nothing")
+	}
+	var mismatch *MismatchError
+	if !errors.As(err, &mismatch) {
+		t.Fatalf("want MismatchError; got %v", err)
+	}
+	if query := string(mismatch.Actual.Body); query != "select 1\x00" {
+		t.Errorf("want select 1; got %q", query)
+	}
+	if expected := sessions[0][mismatch.Index]; mismatch.Expected != expected {
+		t.Errorf("want expected record %v; got %v", expected, mismatch.Expected)
+	}
+}
+
+func TestReadCaptureSessions(t *testing.T) {
+	records := []*post.TraceRecord{
+		{Dir: post.FromFrontend, Body: (&post.SSLRequest{}).Encode(nil)[4:]},
+		{Dir: post.FromBackend, Body: []byte{'N'}},
+		{Dir: post.FromFrontend, Body: (&post.StartupMessage{ProtocolVersion: post.ProtocolVersion30}).Encode(nil)[4:]},
+		{Dir: post.FromBackend, Type: post.MsgReadyForQuery, Body: []byte{'I'}},
+		{Dir: post.FromFrontend, Body: (&post.CancelRequest{Pid: 1, SecretKey: []byte{0, 0, 0, 2}}).Encode(nil)[4:]},
+		{Dir: post.FromFrontend, Body: (&post.StartupMessage{ProtocolVersion: post.ProtocolVersion30}).Encode(nil)[4:]},
+		{Dir: post.FromBackend, Type: post.MsgReadyForQuery, Body: []byte{'I'}},
+		{Dir: post.FromFrontend, Type: post.MsgTerminate, Body: []byte{}},
+	}
+	var buf bytes.Buffer
+	capture, err := post.NewCaptureWriter(&buf)
+	if err != nil {
+		t.Fatalf("want nil err; got %v", err)
+	}
+	for _, record := range records {
+		capture.Write(record)
+	}
+	sessions, err := ReadCapture(&buf)
+	if err != nil {
+		t.Fatalf("want nil err; got %v", err)
+	}
+	expected := []int{4, 1, 3}
+	if len(sessions) != len(expected) {
+		t.Fatalf("want %v sessions; got %v", len(expected), len(sessions))
+	}
+	for i, size := range expected {
+		if len(sessions[i]) != size {
+			t.Errorf("%d: want %v records; got %v", i, size, len(sessions[i]))
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package post
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	scramSHA256     = "SCRAM-SHA-256"
+	scramSHA256Plus = "SCRAM-SHA-256-PLUS"
+)
+
+// A scramClient carries the client side of a SCRAM-SHA-256 exchange
+// (RFC 5802, RFC 7677) through its three steps.
+type scramClient struct {
+	user     string
+	password string
+	nonce    string
+
+	// The gs2 channel binding flag: "n" if the client does not support
+	// channel binding, "y" if it does but thinks the server does not,
+	// or "p=tls-server-end-point" if the exchange is bound to the TLS
+	// session identified by cbindData.
+	cbindFlag string
+	cbindData []byte
+
+	clientFirstBare string
+	saltedPassword  []byte
+	authMessage     string
+}
+
+// Create a new SCRAM client with a random nonce. The server ignores the
+// SCRAM user name in favor of the one in the startup message, so it is
+// normally left empty.
+func newScramClient(user, password string) (*scramClient, error) {
+	raw := make([]byte, 18)
+	_, err := rand.Read(raw)
+	if err != nil {
+		return nil, err
+	}
+	return &scramClient{
+		user:     user,
+		password: password,
+		nonce:    base64.StdEncoding.EncodeToString(raw),
+	}, nil
+}
+
+// Produce the client-first-message.
+func (s *scramClient) clientFirst() []byte {
+	s.clientFirstBare = "n=" + scramEscape(s.user) + ",r=" + s.nonce
+	return []byte(s.gs2Header() + s.clientFirstBare)
+}
+
+func (s *scramClient) gs2Header() string {
+	if s.cbindFlag == "" {
+		return "n,,"
+	}
+	return s.cbindFlag + ",,"
+}
+
+// Process the server-first-message and produce the client-final-message.
+func (s *scramClient) clientFinal(serverFirst []byte) ([]byte, error) {
+	attrs, err := parseScramAttrs(string(serverFirst))
+	if err != nil {
+		return nil, err
+	}
+	nonce := attrs['r']
+	if !strings.HasPrefix(nonce, s.nonce) || len(nonce) == len(s.nonce) {
+		return nil, errors.New("post: SCRAM server nonce does not extend client nonce")
+	}
+	salt, err := base64.StdEncoding.DecodeString(attrs['s'])
+	if err != nil || len(salt) == 0 {
+		return nil, fmt.Errorf("post: invalid SCRAM salt %q", attrs['s'])
+	}
+	iterations, err := strconv.Atoi(attrs['i'])
+	if err != nil || iterations < 1 {
+		return nil, fmt.Errorf("post: invalid SCRAM iteration count %q", attrs['i'])
+	}
+	s.saltedPassword = scramHi([]byte(s.password), salt, iterations)
+
+	channelBinding := base64.StdEncoding.EncodeToString(
+		append([]byte(s.gs2Header()), s.cbindData...))
+	withoutProof := "c=" + channelBinding + ",r=" + nonce
+	s.authMessage = s.clientFirstBare + "," + string(serverFirst) + "," + withoutProof
+
+	clientKey := scramHMAC(s.saltedPassword, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	clientSignature := scramHMAC(storedKey[:], s.authMessage)
+	proof := make([]byte, len(clientKey))
+	for i := range clientKey {
+		proof[i] = clientKey[i] ^ clientSignature[i]
+	}
+	return []byte(withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof)), nil
+}
+
+// Check the server-final-message, which proves that the server knows the
+// password too.
+func (s *scramClient) verifyServerFinal(serverFinal []byte) error {
+	if s.authMessage == "" {
+		return errors.New("post: SCRAM server-final-message received out of order")
+	}
+	attrs, err := parseScramAttrs(string(serverFinal))
+	if err != nil {
+		return err
+	}
+	if e, ok := attrs['e']; ok {
+		return fmt.Errorf("post: SCRAM authentication failed: %v", e)
+	}
+	signature, err := base64.StdEncoding.DecodeString(attrs['v'])
+	if err != nil {
+		return fmt.Errorf("post: invalid SCRAM server signature %q", attrs['v'])
+	}
+	serverKey := scramHMAC(s.saltedPassword, "Server Key")
+	expected := scramHMAC(serverKey, s.authMessage)
+	if subtle.ConstantTimeCompare(signature, expected) != 1 {
+		return errors.New("post: SCRAM server signature does not match")
+	}
+	return nil
+}
+
+// Split a SCRAM message into its single-letter attributes.
+func parseScramAttrs(msg string) (map[byte]string, error) {
+	attrs := make(map[byte]string)
+	for _, field := range strings.Split(msg, ",") {
+		if len(field) < 2 || field[1] != '=' {
+			return nil, fmt.Errorf("post: malformed SCRAM message %q", msg)
+		}
+		attrs[field[0]] = field[2:]
+	}
+	return attrs, nil
+}
+
+func scramEscape(name string) string {
+	return strings.NewReplacer("=", "=3D", ",", "=2C").Replace(name)
+}
+
+func scramHMAC(key []byte, msg string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(msg))
+	return mac.Sum(nil)
+}
+
+// The Hi function of RFC 5802, i.e., PBKDF2 with HMAC-SHA-256 and an
+// output length of a single block.
+func scramHi(password, salt []byte, iterations int) []byte {
+	mac := hmac.New(sha256.New, password)
+	mac.Write(salt)
+	mac.Write([]byte{0x0, 0x0, 0x0, 0x1})
+	u := mac.Sum(nil)
+	result := make([]byte, len(u))
+	copy(result, u)
+	for i := 1; i < iterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range result {
+			result[j] ^= u[j]
+		}
+	}
+	return result
+}
+
+// Split the payload of an AuthenticationSASL message into the list of
+// mechanisms offered by the server.
+func parseSASLMechanisms(payload []byte) []string {
+	var mechanisms []string
+	for _, name := range strings.Split(string(payload), "\x00") {
+		if name == "" {
+			break
+		}
+		mechanisms = append(mechanisms, name)
+	}
+	return mechanisms
+}
@@ -0,0 +1,112 @@
+package post
+
+import (
+	"reflect"
+	"testing"
+)
+
+// The example exchange from RFC 7677, section 3
+const (
+	rfc7677ClientFirst = "n,,n=user,r=rOprNGfwEbeRWgbNEkqO"
+	rfc7677ServerFirst = "r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0," +
+		"s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"
+	rfc7677ClientFinal = "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0," +
+		"p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ="
+	rfc7677ServerFinal = "v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4="
+)
+
+func newRFC7677Client() *scramClient {
+	return &scramClient{user: "user", password: "pencil", nonce: "rOprNGfwEbeRWgbNEkqO"}
+}
+
+func TestScramExchange(t *testing.T) {
+	s := newRFC7677Client()
+	if first := string(s.clientFirst()); first != rfc7677ClientFirst {
+		t.Errorf("want %v; got %v", rfc7677ClientFirst, first)
+	}
+	final, err := s.clientFinal([]byte(rfc7677ServerFirst))
+	if err != nil {
+		t.Fatalf("want nil err; got %v", err)
+	}
+	if string(final) != rfc7677ClientFinal {
+		t.Errorf("want %v; got %v", rfc7677ClientFinal, string(final))
+	}
+	err = s.verifyServerFinal([]byte(rfc7677ServerFinal))
+	if err != nil {
+		t.Errorf("want nil err; got %v", err)
+	}
+}
+
+var scramServerFirstErrorTests = []string{
+	"r=someoneElsesNonce,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096",
+	"r=rOprNGfwEbeRWgbNEkqO,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096",
+	"r=rOprNGfwEbeRWgbNEkqOxyz,s=???,i=4096",
+	"r=rOprNGfwEbeRWgbNEkqOxyz,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=0",
+	"r=rOprNGfwEbeRWgbNEkqOxyz,garbage",
+}
+
+func TestScramServerFirstErrors(t *testing.T) {
+	for i, tt := range scramServerFirstErrorTests {
+		s := newRFC7677Client()
+		s.clientFirst()
+		_, err := s.clientFinal([]byte(tt))
+		if err == nil {
+			t.Errorf("%d: want error; got nil", i)
+		}
+	}
+}
+
+var scramServerFinalErrorTests = []string{
+	"v=AAAATRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=",
+	"v=not base64",
+	"e=invalid-proof",
+}
+
+func TestScramServerFinalErrors(t *testing.T) {
+	for i, tt := range scramServerFinalErrorTests {
+		s := newRFC7677Client()
+		s.clientFirst()
+		_, err := s.clientFinal([]byte(rfc7677ServerFirst))
+		if err != nil {
+			t.Fatalf("%d: want nil err; got %v", i, err)
+		}
+		err = s.verifyServerFinal([]byte(tt))
+		if err == nil {
+			t.Errorf("%d: want error; got nil", i)
+		}
+	}
+}
+
+func TestScramServerFinalOutOfOrder(t *testing.T) {
+	s := newRFC7677Client()
+	s.clientFirst()
+	err := s.verifyServerFinal([]byte(rfc7677ServerFinal))
+	if err == nil {
+		t.Error("want error; got nil")
+	}
+}
+
+func TestScramEscape(t *testing.T) {
+	if escaped := scramEscape("a=b,c"); escaped != "a=3Db=2Cc" {
+		t.Errorf("want a=3Db=2Cc; got %v", escaped)
+	}
+}
+
+var saslMechanismTests = []struct {
+	payload    []byte
+	mechanisms []string
+}{
+	{[]byte{0x0}, nil},
+	{[]byte("SCRAM-SHA-256\x00\x00"), []string{"SCRAM-SHA-256"}},
+	{[]byte("SCRAM-SHA-256-PLUS\x00SCRAM-SHA-256\x00\x00"),
+		[]string{"SCRAM-SHA-256-PLUS", "SCRAM-SHA-256"}},
+}
+
+func TestParseSASLMechanisms(t *testing.T) {
+	for i, tt := range saslMechanismTests {
+		mechanisms := parseSASLMechanisms(tt.payload)
+		if !reflect.DeepEqual(tt.mechanisms, mechanisms) {
+			t.Errorf("%d: want %#v; got %#v", i, tt.mechanisms, mechanisms)
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package post
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+// The server half of the protocol: receiving frontend messages and
+// sending backend messages, for writing servers, proxies, and test
+// fakes.
+
+// Limits on the size of incoming messages, as enforced by the server:
+// startup packets must be small, and nothing may exceed 1GB.
+const (
+	maxStartupPacketSize = 10000
+	maxMessageSize       = 1<<30 - 1
+)
+
+// Read the first message of a connection, which has no type byte. It is
+// returned as a *StartupMessage, *SSLRequest, *GSSENCRequest, or
+// *CancelRequest depending on the code in place of the protocol
+// version. The protocol version of a StartupMessage is not checked.
+func (p *ProtoStream) ReceiveStartupMessage() (msg FrontendMessage, err error) {
+	size, err := p.str.ReadInt32()
+	if err != nil {
+		return nil, err
+	}
+	if size < 8 || size > maxStartupPacketSize {
+		return nil, fmt.Errorf("post: invalid startup packet length %v", size)
+	}
+	body := make([]byte, size-4)
+	_, err = io.ReadFull(p.str, body)
+	if err != nil {
+		return nil, err
+	}
+	msg = newStartupMessage(body)
+	p.server = true
+	p.traceReceived(0, body)
+	err = msg.Decode(body)
+	if err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// Read the next message from the client and decode it according to its
+// type. PasswordMessage, SASLInitialResponse, SASLResponse, and
+// GSSResponse all share the type 'p', so they cannot be told apart
+// without knowing the state of the authentication exchange; these, and
+// any messages of unknown type, are returned as an *UnknownMessage.
+// Decode its Body as the message expected, or use Next and the
+// dedicated Receive method instead.
+func (p *ProtoStream) ReceiveFrontendMessage() (msg FrontendMessage, err error) {
+	msgType, err := p.Next()
+	if err != nil {
+		return nil, err
+	}
+	msg = newFrontendMessage(msgType)
+	err = p.receive(msg)
+	if err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func (p *ProtoStream) ReceiveBind() (*Bind, error) {
+	msg := &Bind{}
+	return msg, p.receive(msg)
+}
+
+func (p *ProtoStream) ReceiveClose() (*Close, error) {
+	msg := &Close{}
+	return msg, p.receive(msg)
+}
+
+func (p *ProtoStream) ReceiveCopyFail() (reason string, err error) {
+	msg := &CopyFail{}
+	err = p.receive(msg)
+	return msg.Reason, err
+}
+
+func (p *ProtoStream) ReceiveDescribe() (*Describe, error) {
+	msg := &Describe{}
+	return msg, p.receive(msg)
+}
+
+func (p *ProtoStream) ReceiveExecute() (*Execute, error) {
+	msg := &Execute{}
+	return msg, p.receive(msg)
+}
+
+func (p *ProtoStream) ReceiveFlush() (err error) {
+	return p.receive(&Flush{})
+}
+
+func (p *ProtoStream) ReceiveGSSResponse() (data []byte, err error) {
+	msg := &GSSResponse{}
+	err = p.receive(msg)
+	return msg.Data, err
+}
+
+func (p *ProtoStream) ReceiveParse() (*Parse, error) {
+	msg := &Parse{}
+	return msg, p.receive(msg)
+}
+
+func (p *ProtoStream) ReceivePasswordMessage() (password string, err error) {
+	msg := &PasswordMessage{}
+	err = p.receive(msg)
+	return msg.Password, err
+}
+
+func (p *ProtoStream) ReceiveQuery() (query string, err error) {
+	msg := &Query{}
+	err = p.receive(msg)
+	return msg.Query, err
+}
+
+func (p *ProtoStream) ReceiveSASLInitialResponse() (*SASLInitialResponse, error) {
+	msg := &SASLInitialResponse{}
+	return msg, p.receive(msg)
+}
+
+func (p *ProtoStream) ReceiveSASLResponse() (data []byte, err error) {
+	msg := &SASLResponse{}
+	err = p.receive(msg)
+	return msg.Data, err
+}
+
+func (p *ProtoStream) ReceiveSync() (err error) {
+	return p.receive(&Sync{})
+}
+
+func (p *ProtoStream) ReceiveTerminate() (err error) {
+	return p.receive(&Terminate{})
+}
+
+// Answer an SSLRequest or GSSENCRequest.
+func (p *ProtoStream) SendSSLResponse(resp ServerSSL) (err error) {
+	p.traceSent(0, []byte{byte(resp)})
+	_, err = p.str.WriteByte(byte(resp))
+	return err
+}
+
+// Upgrade the stream to TLS in place, acting as the server. This is
+// meant to be called after answering an SSLRequest with SSLAccepted
+// (and flushing that answer); the stream must be running over a
+// net.Conn.
+func (p *ProtoStream) AcceptTLS(config *tls.Config) (*tls.Conn, error) {
+	conn, ok := p.str.ReadWriter().(net.Conn)
+	if !ok {
+		return nil, errors.New("post: TLS requires a stream over a net.Conn")
+	}
+	if p.str.Buffered() > 0 {
+		// anything the client sent along with its SSLRequest was not
+		// encrypted and could have been injected
+		return nil, errors.New("post: received unencrypted data after SSLRequest")
+	}
+	tlsConn := tls.Server(conn, config)
+	err := tlsConn.Handshake()
+	if err != nil {
+		return nil, err
+	}
+	return tlsConn, p.str.Reset(tlsConn)
+}
+
+func (p *ProtoStream) SendAuthResponse(subtype AuthResponseType, payload []byte) (err error) {
+	return p.Send(&AuthResponse{subtype, payload})
+}
+
+func (p *ProtoStream) SendBackendKeyData(pid int32, secretKey []byte) (err error) {
+	return p.Send(&BackendKeyData{pid, secretKey})
+}
+
+func (p *ProtoStream) SendBindComplete() (err error) {
+	return p.Send(&BindComplete{})
+}
+
+func (p *ProtoStream) SendCloseComplete() (err error) {
+	return p.Send(&CloseComplete{})
+}
+
+func (p *ProtoStream) SendCommandComplete(tag string) (err error) {
+	return p.Send(&CommandComplete{CommandTag(tag)})
+}
+
+func (p *ProtoStream) SendCopyInResponse(format CopyFormat, columnFormats []DataFormat) (err error) {
+	return p.Send(&CopyInResponse{format, columnFormats})
+}
+
+func (p *ProtoStream) SendCopyOutResponse(format CopyFormat, columnFormats []DataFormat) (err error) {
+	return p.Send(&CopyOutResponse{format, columnFormats})
+}
+
+func (p *ProtoStream) SendCopyBothResponse(format CopyFormat, columnFormats []DataFormat) (err error) {
+	return p.Send(&CopyBothResponse{format, columnFormats})
+}
+
+// Send a DataRow with the given column values; a nil value is NULL.
+func (p *ProtoStream) SendDataRow(values [][]byte) (err error) {
+	return p.Send(&DataRow{values})
+}
+
+func (p *ProtoStream) SendEmptyQueryResponse() (err error) {
+	return p.Send(&EmptyQueryResponse{})
+}
+
+func (p *ProtoStream) SendErrorResponse(pgErr *PgError) (err error) {
+	return p.Send(pgErr)
+}
+
+func (p *ProtoStream) SendNoData() (err error) {
+	return p.Send(&NoData{})
+}
+
+func (p *ProtoStream) SendNoticeResponse(notice *Notice) (err error) {
+	return p.Send(notice)
+}
+
+func (p *ProtoStream) SendNotificationResponse(pid int32, channel, payload string) (err error) {
+	return p.Send(&Notification{pid, channel, payload})
+}
+
+func (p *ProtoStream) SendNegotiateProtocolVersion(newestMinor int32, unrecognized []string) (err error) {
+	return p.Send(&NegotiateProtocolVersion{newestMinor, unrecognized})
+}
+
+func (p *ProtoStream) SendParameterDescription(types []Oid) (err error) {
+	return p.Send(&ParameterDescription{types})
+}
+
+func (p *ProtoStream) SendParameterStatus(parameter, value string) (err error) {
+	return p.Send(&ParameterStatus{parameter, value})
+}
+
+func (p *ProtoStream) SendParseComplete() (err error) {
+	return p.Send(&ParseComplete{})
+}
+
+func (p *ProtoStream) SendPortalSuspended() (err error) {
+	return p.Send(&PortalSuspended{})
+}
+
+func (p *ProtoStream) SendReadyForQuery(status TransactionStatus) (err error) {
+	return p.Send(&ReadyForQuery{status})
+}
+
+func (p *ProtoStream) SendRowDescription(fields []FieldDescription) (err error) {
+	return p.Send(&RowDescription{fields})
+}
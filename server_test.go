@@ -0,0 +1,183 @@
+package post
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+// Backend messages, encoded by the server, should be decoded back to the
+// same thing by the client.
+var backendMessageTests = []BackendMessage{
+	&AuthResponse{AuthenticationOk, nil},
+	&AuthResponse{AuthenticationMD5Password, []byte{0x1, 0x2, 0x3, 0x4}},
+	&BackendKeyData{0x1234, []byte{0, 0, 0x56, 0x78}},
+	&BindComplete{},
+	&CloseComplete{},
+	&CommandComplete{"SELECT 1"},
+	&CopyData{[]byte("1\tfoo\n")},
+	&CopyDone{},
+	&CopyInResponse{CopyText, []DataFormat{TextFormat, TextFormat}},
+	&CopyOutResponse{CopyBinary, []DataFormat{BinaryFormat}},
+	&CopyBothResponse{CopyBinary, []DataFormat{}},
+	&DataRow{[][]byte{[]byte("1"), nil, {}}},
+	&EmptyQueryResponse{},
+	NewPgError(map[ErrorField]string{Severity: "ERROR", Code: "42P01",
+		Message: "relation \"foo\" does not exist", Position: "15", 'X': "extra"}),
+	(*Notice)(NewPgError(map[ErrorField]string{Severity: "NOTICE", Code: "00000",
+		Message: "hello"})),
+	&NegotiateProtocolVersion{0, []string{"_pq_.foo", "_pq_.bar"}},
+	&NegotiateProtocolVersion{2, []string{}},
+	&NoData{},
+	&Notification{42, "chan", "payload"},
+	&ParameterDescription{[]Oid{23, 25}},
+	&ParameterStatus{"server_version", "17.0"},
+	&ParseComplete{},
+	&PortalSuspended{},
+	&ReadyForQuery{InTransaction},
+	&RowDescription{[]FieldDescription{
+		{"id", 16384, 1, 23, 4, -1, TextFormat},
+		{"name", 16384, 2, 25, -1, -1, BinaryFormat},
+	}},
+}
+
+func TestSendBackendMessages(t *testing.T) {
+	for i, msg := range backendMessageTests {
+		s, buf := newProtoStream()
+		err := s.Send(msg.(Encoder))
+		if err != nil {
+			t.Errorf("%d: want nil err; got %v", i, err)
+		}
+		err = s.Flush()
+		if err != nil {
+			t.Errorf("%d: want nil err; got %v", i, err)
+		}
+		encoded := buf.Bytes()
+		received, err := newProtoStreamContent(encoded).ReceiveMessage()
+		if err != nil {
+			t.Errorf("%d: want nil err; got %v", i, err)
+		}
+		if !reflect.DeepEqual(msg, received) {
+			t.Errorf("%d: want %#v; got %#v", i, msg, received)
+		}
+		decoded := reflect.New(reflect.TypeOf(msg).Elem()).Interface().(FrontendMessage)
+		err = decoded.Decode(encoded[5:])
+		if err != nil {
+			t.Errorf("%d: want nil err; got %v", i, err)
+		}
+		if !reflect.DeepEqual(msg, decoded) {
+			t.Errorf("%d: want %#v; got %#v", i, msg, decoded)
+		}
+	}
+}
+
+func TestSendErrorResponseFromStruct(t *testing.T) {
+	s, buf := newProtoStream()
+	err := s.SendErrorResponse(&PgError{Severity: "FATAL", Code: "28P01", Line: 7})
+	if err != nil {
+		t.Errorf("want nil err; got %v", err)
+	}
+	s.Flush()
+	expected := []byte{'E', 0x0, 0x0, 0x0, 0x16,
+		'S', 'F', 'A', 'T', 'A', 'L', 0x0,
+		'C', '2', '8', 'P', '0', '1', 0x0,
+		'L', '7', 0x0,
+		0x0}
+	compareBytes(t, expected, buf.Bytes())
+}
+
+func TestSendErrorResponseFromFields(t *testing.T) {
+	s, buf := newProtoStream()
+	pgErr := &PgError{Fields: map[ErrorField]string{Code: "42P01", Message: "nope", 'X': "extra"}}
+	err := s.SendErrorResponse(pgErr)
+	if err != nil {
+		t.Errorf("want nil err; got %v", err)
+	}
+	s.Flush()
+	received, err := newProtoStreamContent(buf.Bytes()).ReceiveMessage()
+	if err != nil {
+		t.Fatalf("want nil err; got %v", err)
+	}
+	expected := NewPgError(pgErr.Fields)
+	if !reflect.DeepEqual(expected, received) {
+		t.Errorf("want %#v; got %#v", expected, received)
+	}
+}
+
+var startupTests = []FrontendMessage{
+	&StartupMessage{ProtocolVersion30, map[string]string{"user": "bob"}},
+	&SSLRequest{},
+	&GSSENCRequest{},
+	&CancelRequest{1, []byte{0, 0, 0, 2}},
+}
+
+func TestReceiveStartupMessage(t *testing.T) {
+	for i, msg := range startupTests {
+		s := newProtoStreamContent(msg.Encode(nil))
+		received, err := s.ReceiveStartupMessage()
+		if err != nil {
+			t.Errorf("%d: want nil err; got %v", i, err)
+		}
+		if !reflect.DeepEqual(msg, received) {
+			t.Errorf("%d: want %#v; got %#v", i, msg, received)
+		}
+	}
+}
+
+func TestReceiveStartupMessageTooLong(t *testing.T) {
+	s := newProtoStreamContent([]byte{0x0, 0x1, 0x0, 0x0, 0x0, 0x3, 0x0, 0x0})
+	_, err := s.ReceiveStartupMessage()
+	if err == nil {
+		t.Error("want err; got nil")
+	}
+}
+
+func TestReceiveFrontendMessage(t *testing.T) {
+	var buf bytes.Buffer
+	client := NewProtoStreamReadWriter(&buf)
+	client.SendParse("s", "select $1", []Oid{23})
+	client.SendBind("", "s", []int16{0}, [][]byte{[]byte("1")}, []int16{})
+	client.SendDescribe(Portal, "")
+	client.SendExecute("", 0)
+	client.SendSync()
+	client.SendPasswordMessage("secret")
+	client.Flush()
+
+	expected := []FrontendMessage{
+		&Parse{"s", "select $1", []Oid{23}},
+		&Bind{"", "s", []DataFormat{0}, [][]byte{[]byte("1")}, []DataFormat{}},
+		&Describe{Portal, ""},
+		&Execute{"", 0},
+		&Sync{},
+		&UnknownMessage{MsgPasswordMessage, []byte("secret\x00")},
+	}
+	server := NewProtoStreamReadWriter(&buf)
+	for i, msg := range expected {
+		received, err := server.ReceiveFrontendMessage()
+		if err != nil {
+			t.Errorf("%d: want nil err; got %v", i, err)
+		}
+		if !reflect.DeepEqual(msg, received) {
+			t.Errorf("%d: want %#v; got %#v", i, msg, received)
+		}
+	}
+}
+
+func TestReceivePasswordMessage(t *testing.T) {
+	var buf bytes.Buffer
+	client := NewProtoStreamReadWriter(&buf)
+	client.SendPasswordMessage("secret")
+	client.Flush()
+	server := NewProtoStreamReadWriter(&buf)
+	err := server.Expect(MsgPasswordMessage)
+	if err != nil {
+		t.Fatalf("want nil err; got %v", err)
+	}
+	password, err := server.ReceivePasswordMessage()
+	if err != nil {
+		t.Errorf("want nil err; got %v", err)
+	}
+	if password != "secret" {
+		t.Errorf("want secret; got %v", password)
+	}
+}
@@ -0,0 +1,188 @@
+package sqlstate
+
+// Get the class of a code, i.e., its first two characters. This is the
+// code of the class's generic condition without the trailing "000".
+func Class(code string) string {
+	if len(code) < 2 {
+		return ""
+	}
+	return code[:2]
+}
+
+// Whether an error with the given code means the transaction was rolled
+// back because of a conflict with a concurrent transaction, and should
+// succeed if retried from the beginning.
+func IsRetryable(code string) bool {
+	return code == SerializationFailure || code == DeadlockDetected
+}
+
+// The class predicates below report whether a code belongs to the class
+// of the named generic condition.
+
+func IsSuccessfulCompletion(code string) bool {
+	return Class(code) == Class(SuccessfulCompletion)
+}
+
+func IsWarning(code string) bool {
+	return Class(code) == Class(Warning)
+}
+
+func IsNoData(code string) bool {
+	return Class(code) == Class(NoData)
+}
+
+func IsSQLStatementNotYetComplete(code string) bool {
+	return Class(code) == Class(SQLStatementNotYetComplete)
+}
+
+func IsConnectionException(code string) bool {
+	return Class(code) == Class(ConnectionException)
+}
+
+func IsTriggeredActionException(code string) bool {
+	return Class(code) == Class(TriggeredActionException)
+}
+
+func IsFeatureNotSupported(code string) bool {
+	return Class(code) == Class(FeatureNotSupported)
+}
+
+func IsInvalidTransactionInitiation(code string) bool {
+	return Class(code) == Class(InvalidTransactionInitiation)
+}
+
+func IsLocatorException(code string) bool {
+	return Class(code) == Class(LocatorException)
+}
+
+func IsInvalidGrantor(code string) bool {
+	return Class(code) == Class(InvalidGrantor)
+}
+
+func IsInvalidRoleSpecification(code string) bool {
+	return Class(code) == Class(InvalidRoleSpecification)
+}
+
+func IsDiagnosticsException(code string) bool {
+	return Class(code) == Class(DiagnosticsException)
+}
+
+func IsCaseNotFound(code string) bool {
+	return Class(code) == Class(CaseNotFound)
+}
+
+func IsCardinalityViolation(code string) bool {
+	return Class(code) == Class(CardinalityViolation)
+}
+
+func IsDataException(code string) bool {
+	return Class(code) == Class(DataException)
+}
+
+func IsIntegrityConstraintViolation(code string) bool {
+	return Class(code) == Class(IntegrityConstraintViolation)
+}
+
+func IsInvalidCursorState(code string) bool {
+	return Class(code) == Class(InvalidCursorState)
+}
+
+func IsInvalidTransactionState(code string) bool {
+	return Class(code) == Class(InvalidTransactionState)
+}
+
+func IsInvalidSQLStatementName(code string) bool {
+	return Class(code) == Class(InvalidSQLStatementName)
+}
+
+func IsTriggeredDataChangeViolation(code string) bool {
+	return Class(code) == Class(TriggeredDataChangeViolation)
+}
+
+func IsInvalidAuthorizationSpecification(code string) bool {
+	return Class(code) == Class(InvalidAuthorizationSpecification)
+}
+
+func IsDependentPrivilegeDescriptorsStillExist(code string) bool {
+	return Class(code) == Class(DependentPrivilegeDescriptorsStillExist)
+}
+
+func IsInvalidTransactionTermination(code string) bool {
+	return Class(code) == Class(InvalidTransactionTermination)
+}
+
+func IsSQLRoutineException(code string) bool {
+	return Class(code) == Class(SQLRoutineException)
+}
+
+func IsInvalidCursorName(code string) bool {
+	return Class(code) == Class(InvalidCursorName)
+}
+
+func IsExternalRoutineException(code string) bool {
+	return Class(code) == Class(ExternalRoutineException)
+}
+
+func IsExternalRoutineInvocationException(code string) bool {
+	return Class(code) == Class(ExternalRoutineInvocationException)
+}
+
+func IsSavepointException(code string) bool {
+	return Class(code) == Class(SavepointException)
+}
+
+func IsInvalidCatalogName(code string) bool {
+	return Class(code) == Class(InvalidCatalogName)
+}
+
+func IsInvalidSchemaName(code string) bool {
+	return Class(code) == Class(InvalidSchemaName)
+}
+
+func IsTransactionRollback(code string) bool {
+	return Class(code) == Class(TransactionRollback)
+}
+
+func IsSyntaxErrorOrAccessRuleViolation(code string) bool {
+	return Class(code) == Class(SyntaxErrorOrAccessRuleViolation)
+}
+
+func IsWithCheckOptionViolation(code string) bool {
+	return Class(code) == Class(WithCheckOptionViolation)
+}
+
+func IsInsufficientResources(code string) bool {
+	return Class(code) == Class(InsufficientResources)
+}
+
+func IsProgramLimitExceeded(code string) bool {
+	return Class(code) == Class(ProgramLimitExceeded)
+}
+
+func IsObjectNotInPrerequisiteState(code string) bool {
+	return Class(code) == Class(ObjectNotInPrerequisiteState)
+}
+
+func IsOperatorIntervention(code string) bool {
+	return Class(code) == Class(OperatorIntervention)
+}
+
+func IsSystemError(code string) bool {
+	return Class(code) == Class(SystemError)
+}
+
+func IsConfigFileError(code string) bool {
+	return Class(code) == Class(ConfigFileError)
+}
+
+func IsFDWError(code string) bool {
+	return Class(code) == Class(FDWError)
+}
+
+func IsPLpgSQLError(code string) bool {
+	return Class(code) == Class(PLpgSQLError)
+}
+
+func IsInternalError(code string) bool {
+	return Class(code) == Class(InternalError)
+}
@@ -0,0 +1,70 @@
+package sqlstate
+
+import (
+	"testing"
+)
+
+var classTests = []struct {
+	code  string
+	class string
+}{
+	{UniqueViolation, "23"},
+	{SerializationFailure, "40"},
+	{"HV00R", "HV"},
+	{"4", ""},
+	{"", ""},
+}
+
+func TestClass(t *testing.T) {
+	for i, tt := range classTests {
+		if class := Class(tt.code); class != tt.class {
+			t.Errorf("%d: want %#v; got %#v", i, tt.class, class)
+		}
+	}
+}
+
+var retryableTests = []struct {
+	code      string
+	retryable bool
+}{
+	{SerializationFailure, true},
+	{DeadlockDetected, true},
+	{TransactionRollback, false},
+	{UniqueViolation, false},
+	{"", false},
+}
+
+func TestIsRetryable(t *testing.T) {
+	for i, tt := range retryableTests {
+		if retryable := IsRetryable(tt.code); retryable != tt.retryable {
+			t.Errorf("%d: want %v; got %v", i, tt.retryable, retryable)
+		}
+	}
+}
+
+var classPredicateTests = []struct {
+	predicate func(string) bool
+	code      string
+	result    bool
+}{
+	{IsIntegrityConstraintViolation, UniqueViolation, true},
+	{IsIntegrityConstraintViolation, ForeignKeyViolation, true},
+	{IsIntegrityConstraintViolation, "23000", true},
+	{IsIntegrityConstraintViolation, SerializationFailure, false},
+	{IsTransactionRollback, DeadlockDetected, true},
+	{IsSyntaxErrorOrAccessRuleViolation, UndefinedTable, true},
+	{IsDataException, DivisionByZero, true},
+	{IsFDWError, FDWTableNotFound, true},
+	{IsPLpgSQLError, RaiseException, true},
+	{IsInternalError, DataCorrupted, true},
+	{IsWarning, NoData, false},
+	{IsWarning, "", false},
+}
+
+func TestClassPredicates(t *testing.T) {
+	for i, tt := range classPredicateTests {
+		if result := tt.predicate(tt.code); result != tt.result {
+			t.Errorf("%d: want %v for %v; got %v", i, tt.result, tt.code, result)
+		}
+	}
+}
@@ -3,12 +3,14 @@ package post
 import (
 	"bufio"
 	"encoding/binary"
+	"errors"
+	"io"
 	"net"
 )
 
 type Stream struct {
 	str  *bufio.ReadWriter
-	conn net.Conn
+	rw   io.ReadWriter
 	buf  [4]byte
 	buf1 []byte
 	buf2 []byte
@@ -17,15 +19,51 @@ type Stream struct {
 
 var be = binary.BigEndian
 
+// Create a new Stream on top of the given connection.
 func NewStream(conn net.Conn) *Stream {
-	var buf = bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
-	var s = Stream{conn: conn, str: buf}
-	s.buf2 = s.buf[0:1]
+	return NewStreamReadWriter(conn)
+}
+
+// Create a new Stream on top of an arbitrary io.ReadWriter, such as a
+// pipe, a TLS wrapper, or an in-memory buffer.
+func NewStreamReadWriter(rw io.ReadWriter) *Stream {
+	var buf = bufio.NewReadWriter(bufio.NewReader(rw), bufio.NewWriter(rw))
+	var s = Stream{rw: rw, str: buf}
+	s.buf1 = s.buf[0:1]
 	s.buf2 = s.buf[0:2]
 	s.buf4 = s.buf[0:4]
 	return &s
 }
 
+// Get the io.ReadWriter the stream is running over.
+func (s *Stream) ReadWriter() io.ReadWriter {
+	return s.rw
+}
+
+// Get the number of bytes that have been read from the underlying
+// io.ReadWriter but not yet consumed.
+func (s *Stream) Buffered() int {
+	return s.str.Reader.Buffered()
+}
+
+// Switch the stream over to a different io.ReadWriter, typically a TLS
+// connection layered over the current one. Any pending writes are
+// flushed first. The switch is refused if unconsumed data is buffered,
+// since that data arrived over the old connection.
+func (s *Stream) Reset(rw io.ReadWriter) error {
+	if s.Buffered() > 0 {
+		return errors.New("post: cannot switch streams with unread data buffered")
+	}
+	err := s.Flush()
+	if err != nil {
+		return err
+	}
+	s.rw = rw
+	s.str.Reader.Reset(rw)
+	s.str.Writer.Reset(rw)
+	return nil
+}
+
 func (s *Stream) WriteByte(val byte) (n int, err error) {
 	return 1, s.str.WriteByte(val)
 }
@@ -61,7 +99,7 @@ func (s *Stream) ReadByte() (b byte, err error) {
 }
 
 func (s *Stream) ReadInt16() (val int16, err error) {
-	_, err = s.str.Read(s.buf2)
+	_, err = io.ReadFull(s.str, s.buf2)
 	if err != nil {
 		return 0, err
 	}
@@ -69,7 +107,7 @@ func (s *Stream) ReadInt16() (val int16, err error) {
 }
 
 func (s *Stream) ReadInt32() (val int32, err error) {
-	_, err = s.str.Read(s.buf4)
+	_, err = io.ReadFull(s.str, s.buf4)
 	if err != nil {
 		return 0, err
 	}
@@ -78,7 +116,10 @@ func (s *Stream) ReadInt32() (val int32, err error) {
 
 func (s *Stream) ReadCString() (val string, err error) {
 	str, err := s.str.ReadString(0)
-	return str[:len(str)-1], err
+	if err != nil {
+		return "", err
+	}
+	return str[:len(str)-1], nil
 }
 
 func (s *Stream) Read(buf []byte) (n int, err error) {
@@ -2,7 +2,9 @@ package post
 
 import (
 	"bytes"
+	"io"
 	"testing"
+	"testing/iotest"
 	"net"
 	"time"
 )
@@ -275,3 +277,108 @@ func TestRead(t *testing.T) {
 		}
 	}
 }
+
+type oneByteReadWriter struct {
+	io.Reader
+	io.Writer
+}
+
+func newOneByteReadWriter(data []byte) *oneByteReadWriter {
+	return &oneByteReadWriter{iotest.OneByteReader(bytes.NewBuffer(data)), nil}
+}
+
+func TestNewStreamReadWriter(t *testing.T) {
+	var buf bytes.Buffer
+	s := NewStreamReadWriter(&buf)
+	_, err := s.WriteInt32(0x01020304)
+	if err != nil {
+		t.Errorf("want nil err on write; got %#v", err)
+	}
+	err = s.Flush()
+	if err != nil {
+		t.Errorf("want nil err on flush; got %#v", err)
+	}
+	result, err := s.ReadInt32()
+	if err != nil {
+		t.Errorf("want nil error; got %v", err)
+	}
+	if result != 0x01020304 {
+		t.Errorf("want %#v; got %#v", 0x01020304, result)
+	}
+}
+
+func TestReadInt16ShortReads(t *testing.T) {
+	for i, tt := range uint16Tests {
+		s := NewStreamReadWriter(newOneByteReadWriter(tt.bytes))
+		result, err := s.ReadInt16()
+		if err != nil {
+			t.Errorf("%d: want nil error; got %v", i, err)
+		}
+		if result != tt.value {
+			t.Errorf("%d: want %#v; got %#v", i, tt.value, result)
+		}
+	}
+}
+
+func TestReadInt32ShortReads(t *testing.T) {
+	for i, tt := range uint32Tests {
+		s := NewStreamReadWriter(newOneByteReadWriter(tt.bytes))
+		result, err := s.ReadInt32()
+		if err != nil {
+			t.Errorf("%d: want nil error; got %v", i, err)
+		}
+		if result != tt.value {
+			t.Errorf("%d: want %#v; got %#v", i, tt.value, result)
+		}
+	}
+}
+
+func TestReadCStringError(t *testing.T) {
+	s := NewStream(newFakeConnBytes([]byte{}))
+	_, err := s.ReadCString()
+	if err == nil {
+		t.Error("want error; got nil")
+	}
+}
+
+func TestReset(t *testing.T) {
+	s := NewStream(newFakeConnBytes([]byte{0x1}))
+	var buf bytes.Buffer
+	_, err := s.WriteByte(0x2)
+	if err != nil {
+		t.Errorf("want nil err on write; got %#v", err)
+	}
+	err = s.Reset(&buf)
+	if err != nil {
+		t.Errorf("want nil err on reset; got %#v", err)
+	}
+	if s.ReadWriter() != &buf {
+		t.Errorf("want %#v; got %#v", &buf, s.ReadWriter())
+	}
+	_, err = s.WriteByte(0x3)
+	if err != nil {
+		t.Errorf("want nil err on write; got %#v", err)
+	}
+	err = s.Flush()
+	if err != nil {
+		t.Errorf("want nil err on flush; got %#v", err)
+	}
+	if !bytes.Equal([]byte{0x3}, buf.Bytes()) {
+		t.Errorf("want %#v; got %#v", []byte{0x3}, buf.Bytes())
+	}
+}
+
+func TestResetBuffered(t *testing.T) {
+	s := NewStream(newFakeConnBytes([]byte{0x1, 0x2}))
+	_, err := s.ReadByte()
+	if err != nil {
+		t.Errorf("want nil error; got %v", err)
+	}
+	if s.Buffered() != 1 {
+		t.Errorf("want 1 byte buffered; got %v", s.Buffered())
+	}
+	err = s.Reset(newFakeConn())
+	if err == nil {
+		t.Error("want error; got nil")
+	}
+}
@@ -0,0 +1,65 @@
+package post
+
+import (
+	"strconv"
+	"strings"
+)
+
+// A CommandTag is the tag of a CommandComplete message, naming the
+// command completed and, for some commands, counting the rows it
+// affected, e.g., "SELECT 2", "INSERT 0 1", or "CREATE TABLE".
+type CommandTag string
+
+// Get the command, e.g., "INSERT" or "CREATE TABLE", without any counts.
+func (t CommandTag) Command() string {
+	command, _, _ := t.parse()
+	return command
+}
+
+// Get the number of rows affected: inserted, updated, deleted, merged,
+// copied, fetched, moved, or returned by a SELECT or CREATE TABLE AS.
+// It is zero for commands that do not report a count.
+func (t CommandTag) RowsAffected() int64 {
+	_, rows, _ := t.parse()
+	return rows
+}
+
+// Get the OID of the inserted row reported by INSERT. Servers before
+// version 12 report it when inserting a single row into a table with
+// OIDs; otherwise, it is zero.
+func (t CommandTag) InsertOid() Oid {
+	_, _, oid := t.parse()
+	return oid
+}
+
+// Split the tag into the command and its counts. Tags of commands not
+// known to report counts, or not in the expected form, are left whole.
+func (t CommandTag) parse() (command string, rows int64, oid Oid) {
+	fields := strings.Fields(string(t))
+	if len(fields) == 0 {
+		return "", 0, 0
+	}
+	counts := 0
+	switch fields[0] {
+	case "INSERT":
+		counts = 2
+	case "SELECT", "UPDATE", "DELETE", "MERGE", "COPY", "FETCH", "MOVE":
+		counts = 1
+	}
+	// servers before 8.2 send COPY without a count
+	if counts == 0 || len(fields) != counts+1 {
+		return string(t), 0, 0
+	}
+	rows, err := strconv.ParseInt(fields[counts], 10, 64)
+	if err != nil {
+		return string(t), 0, 0
+	}
+	if counts == 2 {
+		parsed, err := strconv.ParseUint(fields[1], 10, 32)
+		if err != nil {
+			return string(t), 0, 0
+		}
+		oid = Oid(parsed)
+	}
+	return fields[0], rows, oid
+}
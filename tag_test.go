@@ -0,0 +1,39 @@
+package post
+
+import "testing"
+
+func TestCommandTag(t *testing.T) {
+	var tagTests = []struct {
+		tag     CommandTag
+		command string
+		rows    int64
+		oid     Oid
+	}{
+		{"SELECT 2", "SELECT", 2, 0},
+		{"INSERT 0 5", "INSERT", 5, 0},
+		{"INSERT 16384 1", "INSERT", 1, 16384},
+		{"UPDATE 3", "UPDATE", 3, 0},
+		{"DELETE 0", "DELETE", 0, 0},
+		{"MERGE 7", "MERGE", 7, 0},
+		{"COPY 10000000000", "COPY", 10000000000, 0},
+		{"COPY", "COPY", 0, 0},
+		{"FETCH 1", "FETCH", 1, 0},
+		{"MOVE 4", "MOVE", 4, 0},
+		{"CREATE TABLE", "CREATE TABLE", 0, 0},
+		{"BEGIN", "BEGIN", 0, 0},
+		{"INSERT 5", "INSERT 5", 0, 0},
+		{"SELECT x", "SELECT x", 0, 0},
+		{"", "", 0, 0},
+	}
+	for i, tt := range tagTests {
+		if command := tt.tag.Command(); command != tt.command {
+			t.Errorf("%d: want command %q; got %q", i, tt.command, command)
+		}
+		if rows := tt.tag.RowsAffected(); rows != tt.rows {
+			t.Errorf("%d: want %v rows; got %v", i, tt.rows, rows)
+		}
+		if oid := tt.tag.InsertOid(); oid != tt.oid {
+			t.Errorf("%d: want oid %v; got %v", i, tt.oid, oid)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package post
+
+import (
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// SSLMode determines whether and how TLS is used for a connection,
+// following the sslmode settings of libpq.
+type SSLMode string
+
+const (
+	// Never use TLS.
+	SSLModeDisable SSLMode = "disable"
+	// Try a connection without TLS first; if that fails, try again
+	// with TLS.
+	SSLModeAllow SSLMode = "allow"
+	// Use TLS if the server supports it, but fall back to an
+	// unencrypted connection if it does not, or if the connection
+	// with TLS fails, e.g., in the handshake. This is the default.
+	SSLModePrefer SSLMode = "prefer"
+	// Always use TLS, but do not verify the server's certificate.
+	SSLModeRequire SSLMode = "require"
+	// Always use TLS and verify that the server's certificate is
+	// signed by a trusted certificate authority.
+	SSLModeVerifyCA SSLMode = "verify-ca"
+	// Always use TLS, verify the server's certificate, and verify that
+	// it matches the host name being connected to.
+	SSLModeVerifyFull SSLMode = "verify-full"
+)
+
+// SSLNegotiation determines how TLS is started on a connection,
+// following the sslnegotiation settings of libpq.
+type SSLNegotiation string
+
+const (
+	// Send an SSLRequest and start TLS once the server accepts it.
+	SSLNegotiationPostgres SSLNegotiation = "postgres"
+	// Start TLS immediately, identifying the protocol to the server with
+	// the "postgresql" ALPN protocol. This saves a round trip, but only
+	// works with newer servers, and it requires SSLModeRequire or
+	// stronger, since there is no way to fall back to an unencrypted
+	// connection.
+	SSLNegotiationDirect SSLNegotiation = "direct"
+)
+
+// The ALPN protocol name servers expect for direct TLS connections.
+const alpnProtocol = "postgresql"
+
+// How a single connection attempt starts TLS.
+type tlsNegotiation int
+
+const (
+	negotiateNone tlsNegotiation = iota
+	negotiateSSLRequest
+	negotiateDirect
+)
+
+// Work out which ways of connecting to try, in order.
+func (c *Config) tlsAttempts(mode SSLMode) ([]tlsNegotiation, error) {
+	switch c.SSLNegotiation {
+	case "", SSLNegotiationPostgres:
+	case SSLNegotiationDirect:
+		switch mode {
+		case SSLModeRequire, SSLModeVerifyCA, SSLModeVerifyFull:
+		default:
+			return nil, fmt.Errorf("post: sslnegotiation %v requires sslmode require or stronger; got %v",
+				SSLNegotiationDirect, mode)
+		}
+		if c.SSLNegotiationFallback {
+			return []tlsNegotiation{negotiateDirect, negotiateSSLRequest}, nil
+		}
+		return []tlsNegotiation{negotiateDirect}, nil
+	default:
+		return nil, fmt.Errorf("post: invalid sslnegotiation %q", c.SSLNegotiation)
+	}
+	switch mode {
+	case SSLModeDisable:
+		return []tlsNegotiation{negotiateNone}, nil
+	case SSLModeAllow:
+		// the server may insist on TLS; if so, try again with it
+		return []tlsNegotiation{negotiateNone, negotiateSSLRequest}, nil
+	case SSLModePrefer:
+		// TLS may be broken; if so, try again without it
+		return []tlsNegotiation{negotiateSSLRequest, negotiateNone}, nil
+	default:
+		return []tlsNegotiation{negotiateSSLRequest}, nil
+	}
+}
+
+// ErrSSLRejected is returned when TLS is required but the server
+// answers the SSLRequest with SSLRejected.
+var ErrSSLRejected = errors.New("post: server does not support TLS")
+
+func (c *Config) sslMode() (SSLMode, error) {
+	switch c.SSLMode {
+	case "":
+		return SSLModePrefer, nil
+	case SSLModeDisable, SSLModeAllow, SSLModePrefer, SSLModeRequire,
+		SSLModeVerifyCA, SSLModeVerifyFull:
+		return c.SSLMode, nil
+	default:
+		return "", fmt.Errorf("post: invalid sslmode %q", c.SSLMode)
+	}
+}
+
+// Build the TLS client configuration for the given mode out of the
+// user-supplied TLSConfig, if any.
+func (c *Config) tlsClientConfig(mode SSLMode) *tls.Config {
+	var config *tls.Config
+	if c.TLSConfig != nil {
+		config = c.TLSConfig.Clone()
+	} else {
+		config = &tls.Config{}
+	}
+	if config.ServerName == "" && !strings.HasPrefix(c.Host, "/") {
+		config.ServerName = c.Host
+		if config.ServerName == "" {
+			config.ServerName = "localhost"
+		}
+	}
+	switch mode {
+	case SSLModeVerifyFull:
+		// the standard verification does exactly this
+	case SSLModeVerifyCA:
+		config.InsecureSkipVerify = true
+		verify := config.VerifyConnection
+		roots := config.RootCAs
+		config.VerifyConnection = func(state tls.ConnectionState) error {
+			err := verifyChain(state, roots)
+			if err == nil && verify != nil {
+				err = verify(state)
+			}
+			return err
+		}
+	default:
+		config.InsecureSkipVerify = true
+	}
+	return config
+}
+
+// Verify the server's certificate chain without checking the host name.
+func verifyChain(state tls.ConnectionState, roots *x509.CertPool) error {
+	if len(state.PeerCertificates) == 0 {
+		return errors.New("post: server sent no certificate")
+	}
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range state.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := state.PeerCertificates[0].Verify(opts)
+	return err
+}
+
+// Ask the server for TLS with an SSLRequest and, if it agrees, upgrade
+// the connection in place. If the server refuses, carry on unencrypted
+// only if the mode allows it.
+func (c *Conn) startTLS(mode SSLMode) (err error) {
+	err = c.proto.SendSSLRequest()
+	if err != nil {
+		return err
+	}
+	err = c.proto.Flush()
+	if err != nil {
+		return err
+	}
+	resp, err := c.proto.ReceiveSSLResponse()
+	if err != nil {
+		return err
+	}
+	switch resp {
+	case SSLAccepted:
+	case SSLRejected:
+		if mode == SSLModePrefer || mode == SSLModeAllow {
+			return nil
+		}
+		return fmt.Errorf("%w, but sslmode is %v", ErrSSLRejected, mode)
+	default:
+		return fmt.Errorf("post: unexpected response %q to SSLRequest", byte(resp))
+	}
+	tlsConn, err := c.proto.StartTLS(c.config.tlsClientConfig(mode))
+	if err != nil {
+		return err
+	}
+	c.conn = tlsConn
+	return nil
+}
+
+// Start TLS immediately, without an SSLRequest, and insist that the
+// server agree to speak the protocol over it.
+func (c *Conn) startDirectTLS(mode SSLMode) error {
+	config := c.config.tlsClientConfig(mode)
+	config.NextProtos = []string{alpnProtocol}
+	tlsConn, err := c.proto.StartTLS(config)
+	if err != nil {
+		return err
+	}
+	c.conn = tlsConn
+	if proto := tlsConn.ConnectionState().NegotiatedProtocol; proto != alpnProtocol {
+		return fmt.Errorf("post: server did not accept ALPN protocol %q for direct TLS",
+			alpnProtocol)
+	}
+	return nil
+}
+
+// Get the state of the TLS session, if the connection uses TLS.
+func (c *Conn) tlsState() (*tls.ConnectionState, bool) {
+	tlsConn, ok := c.conn.(*tls.Conn)
+	if !ok {
+		return nil, false
+	}
+	state := tlsConn.ConnectionState()
+	return &state, true
+}
+
+// Compute the tls-server-end-point channel binding data (RFC 5929): a
+// hash of the server's certificate, using the hash function of the
+// certificate's signature algorithm, upgraded to SHA-256 if that is MD5
+// or SHA-1.
+func tlsServerEndPoint(state *tls.ConnectionState) ([]byte, error) {
+	if len(state.PeerCertificates) == 0 {
+		return nil, errors.New("post: no server certificate for channel binding")
+	}
+	cert := state.PeerCertificates[0]
+	var hash crypto.Hash
+	switch cert.SignatureAlgorithm {
+	case x509.MD5WithRSA, x509.SHA1WithRSA, x509.ECDSAWithSHA1,
+		x509.SHA256WithRSA, x509.SHA256WithRSAPSS, x509.ECDSAWithSHA256:
+		hash = crypto.SHA256
+	case x509.SHA384WithRSA, x509.SHA384WithRSAPSS, x509.ECDSAWithSHA384:
+		hash = crypto.SHA384
+	case x509.SHA512WithRSA, x509.SHA512WithRSAPSS, x509.ECDSAWithSHA512:
+		hash = crypto.SHA512
+	default:
+		return nil, fmt.Errorf("post: channel binding unsupported for %v certificates",
+			cert.SignatureAlgorithm)
+	}
+	h := hash.New()
+	h.Write(cert.Raw)
+	return h.Sum(nil), nil
+}
@@ -0,0 +1,461 @@
+package post
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/msakrejda/post/internal/testcert"
+)
+
+// Read an SSLRequest, accept it, and complete the server side of the
+// TLS handshake. The returned backend speaks over TLS.
+func (b *fakeBackend) acceptTLS(cert tls.Certificate) *fakeBackend {
+	var req [8]byte
+	_, err := io.ReadFull(b, req[:])
+	if err != nil {
+		b.t.Errorf("want nil err reading SSLRequest; got %v", err)
+		return b
+	}
+	compareBytes(b.t, []byte{0x0, 0x0, 0x0, 0x8, 0x4, 0xd2, 0x16, 0x2f}, req[:])
+	b.write([]byte{'S'})
+	tlsConn := tls.Server(b.Conn, &tls.Config{Certificates: []tls.Certificate{cert}})
+	err = tlsConn.Handshake()
+	if err != nil {
+		b.t.Errorf("want nil err on TLS handshake; got %v", err)
+	}
+	return &fakeBackend{tlsConn, b.t}
+}
+
+// Read an SSLRequest and reject it.
+func (b *fakeBackend) rejectTLS() {
+	var req [8]byte
+	_, err := io.ReadFull(b, req[:])
+	if err != nil {
+		b.t.Errorf("want nil err reading SSLRequest; got %v", err)
+	}
+	b.write([]byte{'N'})
+}
+
+// Like pipeConfig, but over a loopback TCP connection. Unlike a
+// net.Pipe, it buffers writes, so a client that rejects the server's
+// certificate can send its alert while the server is still sending the
+// rest of its handshake.
+func loopbackConfig(t *testing.T, serve func(b *fakeBackend)) (Config, <-chan struct{}) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("want nil err; got %v", err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer ln.Close()
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Errorf("want nil err; got %v", err)
+			return
+		}
+		defer conn.Close()
+		serve(&fakeBackend{conn, t})
+	}()
+	config := Config{
+		User:    "bob",
+		SSLMode: SSLModeDisable,
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "tcp", ln.Addr().String())
+		},
+	}
+	return config, done
+}
+
+var sslModeTests = []struct {
+	mode    SSLMode
+	host    string
+	trusted bool
+	ok      bool
+}{
+	{SSLModePrefer, "", false, true},
+	{SSLModeRequire, "", false, true},
+	{SSLModeVerifyCA, "", true, true},
+	{SSLModeVerifyCA, "db.example.com", true, true},
+	{SSLModeVerifyCA, "", false, false},
+	{SSLModeVerifyFull, "", true, true},
+	{SSLModeVerifyFull, "db.example.com", true, false},
+	{SSLModeVerifyFull, "", false, false},
+}
+
+func TestConnectTLS(t *testing.T) {
+	cert, tlsConfig := testcert.New(t)
+	for i, tt := range sslModeTests {
+		config, done := loopbackConfig(t, func(b *fakeBackend) {
+			var req [8]byte
+			io.ReadFull(b, req[:])
+			b.write([]byte{'S'})
+			tlsConn := tls.Server(b.Conn, &tls.Config{Certificates: []tls.Certificate{cert}})
+			if tlsConn.Handshake() != nil {
+				return
+			}
+			b = &fakeBackend{tlsConn, t}
+			b.readStartup()
+			b.write(authOkMsg)
+			b.write(readyForQueryMsg)
+		})
+		config.SSLMode = tt.mode
+		config.Host = tt.host
+		if tt.trusted {
+			config.TLSConfig = tlsConfig
+		}
+		c, err := Connect(context.Background(), config)
+		<-done
+		if !tt.ok {
+			if err == nil {
+				t.Errorf("%d: want error; got nil", i)
+				c.conn.Close()
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%d: want nil err; got %v", i, err)
+			continue
+		}
+		if _, ok := c.tlsState(); !ok {
+			t.Errorf("%d: want TLS connection", i)
+		}
+		c.conn.Close()
+	}
+}
+
+var sslRejectedTests = []struct {
+	mode SSLMode
+	ok   bool
+}{
+	{SSLModePrefer, true},
+	{SSLModeRequire, false},
+	{SSLModeVerifyCA, false},
+	{SSLModeVerifyFull, false},
+}
+
+func TestConnectTLSRejected(t *testing.T) {
+	_, tlsConfig := testcert.New(t)
+	for i, tt := range sslRejectedTests {
+		config, done := pipeConfig(t, func(b *fakeBackend) {
+			b.rejectTLS()
+			if tt.ok {
+				b.readStartup()
+				b.write(authOkMsg)
+				b.write(readyForQueryMsg)
+			}
+		})
+		config.SSLMode = tt.mode
+		config.TLSConfig = tlsConfig
+		c, err := Connect(context.Background(), config)
+		<-done
+		if !tt.ok {
+			if !errors.Is(err, ErrSSLRejected) {
+				t.Errorf("%d: want %v; got %v", i, ErrSSLRejected, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%d: want nil err; got %v", i, err)
+			continue
+		}
+		if _, ok := c.tlsState(); ok {
+			t.Errorf("%d: want unencrypted connection", i)
+		}
+		c.conn.Close()
+	}
+}
+
+func TestConnectTLSAllow(t *testing.T) {
+	cert, tlsConfig := testcert.New(t)
+	var attempts int
+	var wg sync.WaitGroup
+	config := Config{
+		User:      "bob",
+		SSLMode:   SSLModeAllow,
+		TLSConfig: tlsConfig,
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			attempts++
+			attempt := attempts
+			client, server := net.Pipe()
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer server.Close()
+				b := &fakeBackend{server, t}
+				if attempt == 1 {
+					// only hostssl connections are allowed
+					b.readStartup()
+					b.write(backendMsg('E',
+						[]byte("SFATAL\x00"),
+						[]byte("C28000\x00"),
+						[]byte("Mno pg_hba.conf entry\x00"),
+						[]byte{0x0}))
+					return
+				}
+				b = b.acceptTLS(cert)
+				b.readStartup()
+				b.write(authOkMsg)
+				b.write(readyForQueryMsg)
+			}()
+			return client, nil
+		},
+	}
+	c, err := Connect(context.Background(), config)
+	wg.Wait()
+	if err != nil {
+		t.Fatalf("want nil err; got %v", err)
+	}
+	if attempts != 2 {
+		t.Errorf("want 2 attempts; got %v", attempts)
+	}
+	if _, ok := c.tlsState(); !ok {
+		t.Error("want TLS connection")
+	}
+	c.conn.Close()
+}
+
+func TestConnectTLSPreferFallback(t *testing.T) {
+	var attempts int
+	var wg sync.WaitGroup
+	config := Config{
+		User:    "bob",
+		SSLMode: SSLModePrefer,
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			attempts++
+			attempt := attempts
+			client, server := net.Pipe()
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer server.Close()
+				b := &fakeBackend{server, t}
+				if attempt == 1 {
+					// accept TLS, then fail the handshake
+					var req [8]byte
+					io.ReadFull(b, req[:])
+					b.write([]byte{'S'})
+					return
+				}
+				b.readStartup()
+				b.write(authOkMsg)
+				b.write(readyForQueryMsg)
+			}()
+			return client, nil
+		},
+	}
+	c, err := Connect(context.Background(), config)
+	wg.Wait()
+	if err != nil {
+		t.Fatalf("want nil err; got %v", err)
+	}
+	if attempts != 2 {
+		t.Errorf("want 2 attempts; got %v", attempts)
+	}
+	if _, ok := c.tlsState(); ok {
+		t.Error("want unencrypted connection")
+	}
+	c.conn.Close()
+}
+
+func TestConnectInvalidSSLMode(t *testing.T) {
+	_, err := Connect(context.Background(), Config{User: "bob", SSLMode: "sometimes"})
+	if err == nil {
+		t.Error("want error; got nil")
+	}
+}
+
+func TestStartTLSBufferedData(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		defer server.Close()
+		// an attacker injecting a message after the SSLRequest response
+		server.Write([]byte{'S', 'Z', 0x0, 0x0, 0x0, 0x5, 'I'})
+	}()
+	s := NewProtoStreamConn(client)
+	resp, err := s.ReceiveSSLResponse()
+	if err != nil || resp != SSLAccepted {
+		t.Fatalf("want SSLAccepted; got %v, %v", resp, err)
+	}
+	_, err = s.StartTLS(&tls.Config{InsecureSkipVerify: true})
+	if err == nil {
+		t.Error("want error; got nil")
+	}
+}
+
+func TestStartTLSNotConn(t *testing.T) {
+	var buf bytes.Buffer
+	s := NewProtoStreamReadWriter(&buf)
+	_, err := s.StartTLS(&tls.Config{})
+	if err == nil {
+		t.Error("want error; got nil")
+	}
+}
+
+func TestTLSServerEndPoint(t *testing.T) {
+	cert, _ := testcert.New(t)
+	state := &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert.Leaf}}
+	data, err := tlsServerEndPoint(state)
+	if err != nil {
+		t.Fatalf("want nil err; got %v", err)
+	}
+	expected := sha256.Sum256(cert.Leaf.Raw)
+	compareBytes(t, expected[:], data)
+}
+
+func TestTLSServerEndPointNoCertificate(t *testing.T) {
+	_, err := tlsServerEndPoint(&tls.ConnectionState{})
+	if err == nil {
+		t.Error("want error; got nil")
+	}
+}
+
+// Complete the server side of a direct TLS handshake, offering the given
+// ALPN protocols.
+func (b *fakeBackend) acceptDirectTLS(cert tls.Certificate, protos ...string) *fakeBackend {
+	tlsConn := tls.Server(b.Conn, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   protos,
+	})
+	err := tlsConn.Handshake()
+	if err != nil {
+		b.t.Errorf("want nil err on TLS handshake; got %v", err)
+	}
+	return &fakeBackend{tlsConn, b.t}
+}
+
+func TestConnectDirectTLS(t *testing.T) {
+	cert, tlsConfig := testcert.New(t)
+	config, done := pipeConfig(t, func(b *fakeBackend) {
+		b = b.acceptDirectTLS(cert, "postgresql")
+		b.readStartup()
+		b.write(authOkMsg)
+		b.write(readyForQueryMsg)
+	})
+	config.SSLMode = SSLModeVerifyFull
+	config.SSLNegotiation = SSLNegotiationDirect
+	config.TLSConfig = tlsConfig
+	c, err := Connect(context.Background(), config)
+	<-done
+	if err != nil {
+		t.Fatalf("want nil err; got %v", err)
+	}
+	state, ok := c.tlsState()
+	if !ok {
+		t.Fatal("want TLS connection")
+	}
+	if state.NegotiatedProtocol != "postgresql" {
+		t.Errorf("want ALPN protocol postgresql; got %v", state.NegotiatedProtocol)
+	}
+	c.conn.Close()
+}
+
+func TestConnectDirectTLSNoALPN(t *testing.T) {
+	cert, tlsConfig := testcert.New(t)
+	config, done := pipeConfig(t, func(b *fakeBackend) {
+		b.acceptDirectTLS(cert)
+	})
+	config.SSLMode = SSLModeVerifyFull
+	config.SSLNegotiation = SSLNegotiationDirect
+	config.TLSConfig = tlsConfig
+	_, err := Connect(context.Background(), config)
+	<-done
+	if err == nil {
+		t.Error("want error; got nil")
+	}
+}
+
+func TestConnectDirectTLSFallback(t *testing.T) {
+	cert, tlsConfig := testcert.New(t)
+	var attempts int
+	var wg sync.WaitGroup
+	config := Config{
+		User:                   "bob",
+		SSLMode:                SSLModeVerifyFull,
+		SSLNegotiation:         SSLNegotiationDirect,
+		SSLNegotiationFallback: true,
+		TLSConfig:              tlsConfig,
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			attempts++
+			attempt := attempts
+			client, server := net.Pipe()
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer server.Close()
+				b := &fakeBackend{server, t}
+				if attempt == 1 {
+					// an older server takes the ClientHello for a
+					// startup message with a bogus length and hangs up
+					var header [8]byte
+					io.ReadFull(b, header[:])
+					return
+				}
+				b = b.acceptTLS(cert)
+				b.readStartup()
+				b.write(authOkMsg)
+				b.write(readyForQueryMsg)
+			}()
+			return client, nil
+		},
+	}
+	c, err := Connect(context.Background(), config)
+	wg.Wait()
+	if err != nil {
+		t.Fatalf("want nil err; got %v", err)
+	}
+	if attempts != 2 {
+		t.Errorf("want 2 attempts; got %v", attempts)
+	}
+	if _, ok := c.tlsState(); !ok {
+		t.Error("want TLS connection")
+	}
+	c.conn.Close()
+}
+
+var tlsAttemptTests = []struct {
+	mode        SSLMode
+	negotiation SSLNegotiation
+	fallback    bool
+	attempts    []tlsNegotiation
+}{
+	{SSLModeDisable, "", false, []tlsNegotiation{negotiateNone}},
+	{SSLModeAllow, "", false, []tlsNegotiation{negotiateNone, negotiateSSLRequest}},
+	{SSLModePrefer, SSLNegotiationPostgres, false,
+		[]tlsNegotiation{negotiateSSLRequest, negotiateNone}},
+	{SSLModeRequire, SSLNegotiationDirect, false, []tlsNegotiation{negotiateDirect}},
+	{SSLModeVerifyFull, SSLNegotiationDirect, true,
+		[]tlsNegotiation{negotiateDirect, negotiateSSLRequest}},
+	{SSLModePrefer, SSLNegotiationDirect, false, nil},
+	{SSLModeRequire, "eventually", false, nil},
+}
+
+func TestConfigTLSAttempts(t *testing.T) {
+	for i, tt := range tlsAttemptTests {
+		config := Config{SSLNegotiation: tt.negotiation, SSLNegotiationFallback: tt.fallback}
+		attempts, err := config.tlsAttempts(tt.mode)
+		if tt.attempts == nil {
+			if err == nil {
+				t.Errorf("%d: want error; got nil", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%d: want nil err; got %v", i, err)
+		}
+		if !reflect.DeepEqual(tt.attempts, attempts) {
+			t.Errorf("%d: want %v; got %v", i, tt.attempts, attempts)
+		}
+	}
+}
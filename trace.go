@@ -0,0 +1,345 @@
+package post
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Direction tells which side of a connection sent a traced message.
+type Direction byte
+
+const (
+	FromFrontend Direction = 'F'
+	FromBackend  Direction = 'B'
+)
+
+// A Tracer is told about every message sent or received on a
+// ProtoStream, in the order they go over the wire. The type is zero for
+// startup-phase messages, which have none; in that case a FromBackend
+// message is the single byte answering an SSLRequest or GSSENCRequest.
+// The body is only valid for the duration of the call.
+type Tracer interface {
+	TraceMessage(dir Direction, msgType MessageType, body []byte)
+}
+
+// Trace all messages sent and received from now on with tracer, or
+// stop tracing if it is nil.
+func (p *ProtoStream) SetTracer(tracer Tracer) {
+	p.tracer = tracer
+}
+
+func (p *ProtoStream) traceSent(msgType MessageType, body []byte) {
+	if p.tracer == nil {
+		return
+	}
+	p.traceMu.Lock()
+	defer p.traceMu.Unlock()
+	if p.server {
+		p.tracer.TraceMessage(FromBackend, msgType, body)
+	} else {
+		p.tracer.TraceMessage(FromFrontend, msgType, body)
+	}
+}
+
+func (p *ProtoStream) traceReceived(msgType MessageType, body []byte) {
+	if p.tracer == nil {
+		return
+	}
+	p.traceMu.Lock()
+	defer p.traceMu.Unlock()
+	if p.server {
+		p.tracer.TraceMessage(FromFrontend, msgType, body)
+	} else {
+		p.tracer.TraceMessage(FromBackend, msgType, body)
+	}
+}
+
+// A TraceRecord is a single traced message.
+type TraceRecord struct {
+	Time time.Time
+	Dir  Direction
+	// The message type, or zero for startup-phase messages.
+	Type MessageType
+	// The message body, after the type and length.
+	Body []byte
+}
+
+// Get the name of the message, as in the protocol documentation.
+func (r *TraceRecord) Name() string {
+	switch {
+	case r.Type == 0 && r.Dir == FromBackend:
+		return "SSLResponse"
+	case r.Type == MsgPasswordMessage && r.Dir == FromFrontend:
+		// could be any of the authentication responses
+		return "PasswordMessage"
+	}
+	msg, _ := r.Message()
+	switch msg.(type) {
+	case *AuthResponse:
+		return "Authentication"
+	case *PgError:
+		return "ErrorResponse"
+	case *Notice:
+		return "NoticeResponse"
+	case *Notification:
+		return "NotificationResponse"
+	case *UnknownMessage, nil:
+		return "Unknown"
+	}
+	return reflect.TypeOf(msg).Elem().Name()
+}
+
+// Decode the message. Messages the package has no type for, and the
+// authentication responses, which cannot be told apart without knowing
+// the state of the exchange, are decoded as an *UnknownMessage. The
+// answer to an SSLRequest is decoded as a ServerSSL.
+func (r *TraceRecord) Message() (interface{}, error) {
+	var msg decoder
+	switch {
+	case r.Type == 0 && r.Dir == FromBackend:
+		if len(r.Body) != 1 {
+			return nil, fmt.Errorf("post: invalid SSLResponse of %v bytes", len(r.Body))
+		}
+		return ServerSSL(r.Body[0]), nil
+	case r.Type == 0:
+		msg = newStartupMessage(r.Body)
+	case r.Dir == FromFrontend:
+		msg = newFrontendMessage(r.Type)
+	default:
+		msg = newBackendMessage(r.Type).(decoder)
+	}
+	err := msg.Decode(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// Format the record on one line: the time, the direction, the length
+// as sent on the wire, the message name, and its decoded fields.
+func (r *TraceRecord) String() string {
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "%v\t%c\t%v\t%v\t", r.Time.Format(time.RFC3339Nano),
+		r.Dir, len(r.Body)+4, r.Name())
+	msg, err := r.Message()
+	if err != nil {
+		fmt.Fprintf(&buf, "%q (%v)", r.Body, err)
+	} else {
+		formatFields(&buf, msg)
+	}
+	return buf.String()
+}
+
+// Write the fields of a decoded message, with byte slices quoted so
+// they stay readable and on one line.
+func formatFields(buf *strings.Builder, msg interface{}) {
+	switch msg := msg.(type) {
+	case *PgError:
+		formatErrorFields(buf, msg.Fields)
+		return
+	case *Notice:
+		formatErrorFields(buf, msg.Fields)
+		return
+	}
+	val := reflect.Indirect(reflect.ValueOf(msg))
+	if val.Kind() != reflect.Struct {
+		fmt.Fprintf(buf, "%q", val.Interface())
+		return
+	}
+	for i := 0; i < val.NumField(); i++ {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		fmt.Fprintf(buf, "%v=", val.Type().Field(i).Name)
+		formatValue(buf, val.Field(i))
+	}
+}
+
+func formatValue(buf *strings.Builder, val reflect.Value) {
+	switch {
+	case val.Kind() == reflect.Slice && val.Type().Elem().Kind() == reflect.Uint8:
+		if val.IsNil() {
+			buf.WriteString("NULL")
+		} else {
+			fmt.Fprintf(buf, "%q", val.Bytes())
+		}
+	case val.Kind() == reflect.Slice:
+		buf.WriteByte('[')
+		for i := 0; i < val.Len(); i++ {
+			if i > 0 {
+				buf.WriteByte(' ')
+			}
+			formatValue(buf, val.Index(i))
+		}
+		buf.WriteByte(']')
+	case val.Kind() == reflect.String:
+		fmt.Fprintf(buf, "%q", val.String())
+	case val.Kind() == reflect.Uint8:
+		// the one-byte codes, like TargetKind and TransactionStatus
+		fmt.Fprintf(buf, "%q", byte(val.Uint()))
+	case val.Kind() == reflect.Map:
+		keys := val.MapKeys()
+		sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+		buf.WriteByte('{')
+		for i, key := range keys {
+			if i > 0 {
+				buf.WriteByte(' ')
+			}
+			fmt.Fprintf(buf, "%v:%q", key, val.MapIndex(key))
+		}
+		buf.WriteByte('}')
+	default:
+		fmt.Fprintf(buf, "%+v", val.Interface())
+	}
+}
+
+func formatErrorFields(buf *strings.Builder, fields map[ErrorField]string) {
+	codes := make([]ErrorField, 0, len(fields))
+	for code := range fields {
+		codes = append(codes, code)
+	}
+	sort.Slice(codes, func(i, j int) bool { return codes[i] < codes[j] })
+	for i, code := range codes {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		fmt.Fprintf(buf, "%c=%q", code, fields[code])
+	}
+}
+
+// A TextTracer writes each message as a line of human-readable text, as
+// formatted by TraceRecord.String.
+type TextTracer struct {
+	mu  sync.Mutex
+	w   io.Writer
+	err error
+}
+
+func NewTextTracer(w io.Writer) *TextTracer {
+	return &TextTracer{w: w}
+}
+
+func (t *TextTracer) TraceMessage(dir Direction, msgType MessageType, body []byte) {
+	record := &TraceRecord{time.Now(), dir, msgType, body}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.err == nil {
+		_, t.err = fmt.Fprintln(t.w, record)
+	}
+}
+
+// Get the first error writing the trace, if any.
+func (t *TextTracer) Err() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.err
+}
+
+// The capture format starts with captureMagic, followed by a record
+// for each message: the time in nanoseconds since the Unix epoch (8
+// bytes), the direction (1 byte), the message type (1 byte), the length
+// of the body (4 bytes), and the body. Integers are big-endian.
+const captureMagic = "POSTCAP1"
+
+// A CaptureWriter records messages in a compact binary format, which a
+// CaptureReader can read back, e.g., for replay.
+type CaptureWriter struct {
+	mu  sync.Mutex
+	w   io.Writer
+	buf []byte
+	err error
+}
+
+// Create a CaptureWriter, writing the header of the capture to w
+// right away.
+func NewCaptureWriter(w io.Writer) (*CaptureWriter, error) {
+	_, err := io.WriteString(w, captureMagic)
+	if err != nil {
+		return nil, err
+	}
+	return &CaptureWriter{w: w}, nil
+}
+
+func (c *CaptureWriter) TraceMessage(dir Direction, msgType MessageType, body []byte) {
+	c.Write(&TraceRecord{time.Now(), dir, msgType, body})
+}
+
+// Write a record to the capture.
+func (c *CaptureWriter) Write(record *TraceRecord) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return c.err
+	}
+	var nanos [8]byte
+	binary.BigEndian.PutUint64(nanos[:], uint64(record.Time.UnixNano()))
+	buf := append(c.buf[:0], nanos[:]...)
+	buf = append(buf, byte(record.Dir), byte(record.Type))
+	buf = appendInt32(buf, int32(len(record.Body)))
+	buf = append(buf, record.Body...)
+	c.buf = buf
+	_, c.err = c.w.Write(buf)
+	return c.err
+}
+
+// Get the first error writing the capture, if any.
+func (c *CaptureWriter) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// A CaptureReader reads the records written by a CaptureWriter.
+type CaptureReader struct {
+	r io.Reader
+}
+
+// Create a CaptureReader, checking the header of the capture.
+func NewCaptureReader(r io.Reader) (*CaptureReader, error) {
+	var magic [len(captureMagic)]byte
+	_, err := io.ReadFull(r, magic[:])
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(magic[:], []byte(captureMagic)) {
+		return nil, errors.New("post: not a capture")
+	}
+	return &CaptureReader{r}, nil
+}
+
+// Read the next record, or return io.EOF at the end of the capture.
+func (c *CaptureReader) Next() (*TraceRecord, error) {
+	var header [14]byte
+	_, err := io.ReadFull(c.r, header[:])
+	if err == io.ErrUnexpectedEOF {
+		return nil, errors.New("post: truncated capture")
+	} else if err != nil {
+		return nil, err
+	}
+	size := int32(binary.BigEndian.Uint32(header[10:]))
+	if size < 0 || size > maxMessageSize {
+		return nil, fmt.Errorf("post: invalid capture record length %v", size)
+	}
+	record := &TraceRecord{
+		Time: time.Unix(0, int64(binary.BigEndian.Uint64(header[:8]))),
+		Dir:  Direction(header[8]),
+		Type: MessageType(header[9]),
+		Body: make([]byte, size),
+	}
+	_, err = io.ReadFull(c.r, record.Body)
+	if err != nil {
+		if err == io.EOF {
+			err = errors.New("post: truncated capture")
+		}
+		return nil, err
+	}
+	return record, nil
+}
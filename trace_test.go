@@ -0,0 +1,203 @@
+package post
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A Tracer that keeps copies of everything it is told about.
+type traceRecorder struct {
+	records []TraceRecord
+}
+
+func (r *traceRecorder) TraceMessage(dir Direction, msgType MessageType, body []byte) {
+	r.records = append(r.records,
+		TraceRecord{Dir: dir, Type: msgType, Body: append([]byte{}, body...)})
+}
+
+func TestTraceBothDirections(t *testing.T) {
+	var toServer, toClient bytes.Buffer
+	clientTrace, serverTrace := &traceRecorder{}, &traceRecorder{}
+	client := NewProtoStreamReadWriter(struct {
+		io.Reader
+		io.Writer
+	}{&toClient, &toServer})
+	client.SetTracer(clientTrace)
+	server := NewProtoStreamReadWriter(struct {
+		io.Reader
+		io.Writer
+	}{&toServer, &toClient})
+	server.SetTracer(serverTrace)
+
+	client.SendSSLRequest()
+	client.SendStartupMessage(map[string]string{"user": "alice"})
+	client.SendQuery("select 1")
+	client.Flush()
+	for i := 0; i < 3; i++ {
+		var err error
+		if i < 2 {
+			_, err = server.ReceiveStartupMessage()
+		} else {
+			_, err = server.ReceiveFrontendMessage()
+		}
+		if err != nil {
+			t.Fatalf("%d: want nil err; got %v", i, err)
+		}
+		if i == 0 {
+			server.SendSSLResponse(SSLRejected)
+			server.Flush()
+		}
+	}
+	server.SendReadyForQuery(Idle)
+	server.Flush()
+	if _, err := client.ReceiveSSLResponse(); err != nil {
+		t.Fatalf("want nil err; got %v", err)
+	}
+	if _, err := client.ReceiveMessage(); err != nil {
+		t.Fatalf("want nil err; got %v", err)
+	}
+
+	var traceTests = []struct {
+		trace    *traceRecorder
+		expected []string
+	}{
+		{clientTrace, []string{"F SSLRequest", "F StartupMessage", "F Query",
+			"B SSLResponse", "B ReadyForQuery"}},
+		{serverTrace, []string{"F SSLRequest", "B SSLResponse", "F StartupMessage",
+			"F Query", "B ReadyForQuery"}},
+	}
+	for i, tt := range traceTests {
+		var actual []string
+		for _, record := range tt.trace.records {
+			actual = append(actual, string(record.Dir)+" "+record.Name())
+		}
+		if !reflect.DeepEqual(tt.expected, actual) {
+			t.Errorf("%d: want %q; got %q", i, tt.expected, actual)
+		}
+	}
+	if !reflect.DeepEqual(clientTrace.records[2].Body, []byte("select 1\x00")) {
+		t.Errorf("want query body; got %q", clientTrace.records[2].Body)
+	}
+}
+
+func TestTraceRecordString(t *testing.T) {
+	var stringTests = []struct {
+		dir      Direction
+		msgType  MessageType
+		msg      Encoder
+		expected string
+	}{
+		{FromFrontend, MsgQuery, &Query{"select 1"},
+			"F\t13\tQuery\tQuery=\"select 1\""},
+		{FromFrontend, MsgBind, &Bind{"", "s", []DataFormat{1}, [][]byte{[]byte("\x00\x01"), nil}, nil},
+			"F\t25\tBind\tPortal=\"\" Statement=\"s\" ParameterFormats=[1] Parameters=[\"\\x00\\x01\" NULL] ResultFormats=[]"},
+		{FromFrontend, 0, &StartupMessage{ProtocolVersion30, map[string]string{"user": "alice", "database": "db"}},
+			"F\t32\tStartupMessage\tProtocolVersion=196608 Parameters={database:\"db\" user:\"alice\"}"},
+		{FromBackend, MsgReadyForQuery, &ReadyForQuery{Idle},
+			"B\t5\tReadyForQuery\tStatus='I'"},
+		{FromBackend, MsgErrorResponse, &PgError{Severity: "ERROR", Code: "42P01", Message: "nope"},
+			"B\t25\tErrorResponse\tC=\"42P01\" M=\"nope\" S=\"ERROR\""},
+		{FromBackend, MsgAuthentication, &AuthResponse{AuthenticationOk, nil},
+			"B\t8\tAuthentication\tSubtype=0 Payload=NULL"},
+		{FromFrontend, MsgFunctionCall, &FunctionCall{1598, nil, [][]byte{[]byte("x")}, TextFormat},
+			"F\t19\tFunctionCall\tFunctionOid=1598 ArgFormats=[] Arguments=[\"x\"] ResultFormat=0"},
+		{FromBackend, MsgFunctionCallResponse, &FunctionCallResponse{[]byte("y")},
+			"B\t9\tFunctionCallResponse\tResult=\"y\""},
+	}
+	for i, tt := range stringTests {
+		msg := tt.msg.Encode(nil)
+		body := msg[5:]
+		if tt.msgType == 0 {
+			body = msg[4:]
+		}
+		record := &TraceRecord{time.Unix(0, 0).UTC(), tt.dir, tt.msgType, body}
+		actual := record.String()
+		prefix := "1970-01-01T00:00:00Z\t"
+		if !strings.HasPrefix(actual, prefix) {
+			t.Errorf("%d: want time prefix; got %q", i, actual)
+			continue
+		}
+		if actual = actual[len(prefix):]; actual != tt.expected {
+			t.Errorf("%d: want %q; got %q", i, tt.expected, actual)
+		}
+	}
+}
+
+func TestTextTracer(t *testing.T) {
+	var buf bytes.Buffer
+	tracer := NewTextTracer(&buf)
+	tracer.TraceMessage(FromFrontend, MsgSync, nil)
+	tracer.TraceMessage(FromBackend, 0, []byte{'S'})
+	if err := tracer.Err(); err != nil {
+		t.Fatalf("want nil err; got %v", err)
+	}
+	lines := strings.Split(buf.String(), "\n")
+	expected := []string{"F\t4\tSync\t", "B\t5\tSSLResponse\t'S'", ""}
+	if len(lines) != len(expected) {
+		t.Fatalf("want %v lines; got %q", len(expected), lines)
+	}
+	for i, line := range lines[:2] {
+		if !strings.HasSuffix(line, "\t"+expected[i]) {
+			t.Errorf("%d: want %q; got %q", i, expected[i], line)
+		}
+	}
+}
+
+func TestCaptureRoundTrip(t *testing.T) {
+	records := []*TraceRecord{
+		{time.Unix(1, 2), FromFrontend, 0, []byte{0x04, 0xd2, 0x16, 0x2f}},
+		{time.Unix(3, 4), FromBackend, 0, []byte{'N'}},
+		{time.Unix(5, 6), FromFrontend, MsgQuery, []byte("select 1\x00")},
+		{time.Unix(7, 8), FromBackend, MsgReadyForQuery, []byte{'I'}},
+		{time.Unix(9, 10), FromFrontend, MsgSync, []byte{}},
+	}
+	var buf bytes.Buffer
+	w, err := NewCaptureWriter(&buf)
+	if err != nil {
+		t.Fatalf("want nil err; got %v", err)
+	}
+	for i, record := range records {
+		if err := w.Write(record); err != nil {
+			t.Fatalf("%d: want nil err; got %v", i, err)
+		}
+	}
+	r, err := NewCaptureReader(&buf)
+	if err != nil {
+		t.Fatalf("want nil err; got %v", err)
+	}
+	for i, expected := range records {
+		actual, err := r.Next()
+		if err != nil {
+			t.Fatalf("%d: want nil err; got %v", i, err)
+		}
+		if !actual.Time.Equal(expected.Time) || actual.Dir != expected.Dir ||
+			actual.Type != expected.Type || !bytes.Equal(actual.Body, expected.Body) {
+			t.Errorf("%d: want %v; got %v", i, expected, actual)
+		}
+	}
+	if _, err := r.Next(); err != io.EOF {
+		t.Errorf("want EOF; got %v", err)
+	}
+}
+
+func TestCaptureReaderErrors(t *testing.T) {
+	var errorTests = []string{
+		"NOTACAP!",
+		captureMagic + "\x00\x00",
+		captureMagic + "\x00\x00\x00\x00\x00\x00\x00\x00FQ\x00\x00\x00\x09sel",
+		captureMagic + "\x00\x00\x00\x00\x00\x00\x00\x00FQ\xff\xff\xff\xff",
+	}
+	for i, tt := range errorTests {
+		r, err := NewCaptureReader(strings.NewReader(tt))
+		if err == nil {
+			_, err = r.Next()
+		}
+		if err == nil || err == io.EOF {
+			t.Errorf("%d: want err; got %v", i, err)
+		}
+	}
+}